@@ -1,7 +1,6 @@
 package aicomms
 
 import (
-	"encoding/json"
 	"time"
 
 	"github.com/expki/go-vectorsearch/compute"
@@ -32,27 +31,18 @@ type Embeddings []Embedding
 func (e Embeddings) Value() [][]uint8 {
 	value := make([][]uint8, len(e))
 	for i, v := range e {
-		value[i] = v
+		value[i] = v.Value()
 	}
 	return value
 }
 
-type Embedding []uint8
-
-func (e *Embedding) UnmarshalJSON(data []byte) error {
-	var vector []float32
-	err := json.Unmarshal(data, &vector)
-	if err != nil {
-		return err
-	}
-	*e = compute.QuantizeVectorFloat32(vector)
-	return nil
-}
+// Embedding keeps the vector as returned by the model so it can be quantized with the calibration of the category.
+type Embedding []float32
 
 func (e Embedding) Dims() int {
-	return len(e) - 8
+	return len(e)
 }
 
 func (e Embedding) Value() []uint8 {
-	return e
+	return compute.QuantizeVectorFloat32(e)
 }
@@ -5,16 +5,19 @@ import (
 	"sync"
 	"time"
 
+	"github.com/expki/go-vectorsearch/compute"
 	"github.com/expki/go-vectorsearch/config"
 	"github.com/expki/go-vectorsearch/database"
 )
 
 func NewCache(appCtx context.Context) *Cache {
 	c := &Cache{
-		done:      make(chan struct{}),
-		owner:     make(map[string]*item[database.Owner]),
-		category:  make(map[string]*item[database.Category]),
-		centroids: make(map[string]*item[[]database.Centroid]),
+		done:         make(chan struct{}),
+		owner:        make(map[string]*item[database.Owner]),
+		category:     make(map[string]*item[database.Category]),
+		centroids:    make(map[string]*item[[]database.Centroid]),
+		codebook:     make(map[string]*item[*compute.Codebook]),
+		calibrations: make(map[string]*item[compute.Calibrations]),
 	}
 	go c.cleanupTask(appCtx)
 	return c
@@ -27,12 +30,16 @@ func (c *Cache) Close() {
 type Cache struct {
 	done chan struct{}
 
-	ownerLock     sync.RWMutex
-	owner         map[string]*item[database.Owner]
-	categoryLock  sync.RWMutex
-	category      map[string]*item[database.Category]
-	centroidsLock sync.RWMutex
-	centroids     map[string]*item[[]database.Centroid]
+	ownerLock        sync.RWMutex
+	owner            map[string]*item[database.Owner]
+	categoryLock     sync.RWMutex
+	category         map[string]*item[database.Category]
+	centroidsLock    sync.RWMutex
+	centroids        map[string]*item[[]database.Centroid]
+	codebookLock     sync.RWMutex
+	codebook         map[string]*item[*compute.Codebook]
+	calibrationsLock sync.RWMutex
+	calibrations     map[string]*item[compute.Calibrations]
 }
 
 func (c *Cache) cleanupTask(appCtx context.Context) {
@@ -74,6 +81,24 @@ func (c *Cache) cleanupTask(appCtx context.Context) {
 				}
 			}
 			c.ownerLock.Unlock()
+
+			// Cleanup codebook
+			c.codebookLock.Lock()
+			for key, value := range c.codebook {
+				if value.expiration.Before(now) {
+					delete(c.codebook, key)
+				}
+			}
+			c.codebookLock.Unlock()
+
+			// Cleanup calibrations
+			c.calibrationsLock.Lock()
+			for key, value := range c.calibrations {
+				if value.expiration.Before(now) {
+					delete(c.calibrations, key)
+				}
+			}
+			c.calibrationsLock.Unlock()
 		}
 	}
 }
@@ -4,15 +4,18 @@ import (
 	"errors"
 	"time"
 
+	"github.com/expki/go-vectorsearch/compute"
 	"github.com/expki/go-vectorsearch/config"
 	"github.com/expki/go-vectorsearch/database"
 	"golang.org/x/sync/singleflight"
 )
 
 var (
-	ownerSingleflight     singleflight.Group
-	categorySingleflight  singleflight.Group
-	centroidsSingleflight singleflight.Group
+	ownerSingleflight        singleflight.Group
+	categorySingleflight     singleflight.Group
+	centroidsSingleflight    singleflight.Group
+	codebookSingleflight     singleflight.Group
+	calibrationsSingleflight singleflight.Group
 )
 
 func (c *Cache) FetchOwner(name string, fetch func() (database.Owner, error)) (value database.Owner, err error) {
@@ -161,3 +164,122 @@ func (c *Cache) FetchCentroids(categoryID uint64, fetch func() ([]database.Centr
 	}
 	return values, err
 }
+
+func (c *Cache) FetchCodebook(categoryID uint64, fetch func() (*compute.Codebook, error)) (value *compute.Codebook, err error) {
+	key := codebookKey{CategoryID: categoryID}.String()
+
+	// singleflight fetch
+	valueAny, err, _ := codebookSingleflight.Do(key, func() (any, error) {
+		// retrieve cache item
+		c.codebookLock.RLock()
+		cacheValue, ok := c.codebook[key]
+		c.codebookLock.RUnlock()
+
+		// check cache value
+		valid := false
+		if ok && cacheValue.expiration.After(time.Now()) {
+			value = cacheValue.value
+			valid = true
+		}
+
+		// return cache value if valid
+		if valid {
+			return value, nil
+		}
+
+		// fetch new result
+		value, err = fetch()
+		if err != nil {
+			return value, err
+		}
+
+		// save new result
+		c.codebookLock.Lock()
+		c.codebook[key] = &item[*compute.Codebook]{
+			expiration: time.Now().Add(config.CACHE_DURATION),
+			value:      value,
+		}
+		c.codebookLock.Unlock()
+
+		// return new result
+		return value, err
+	})
+	if err != nil {
+		return value, err
+	}
+	value, ok := valueAny.(*compute.Codebook)
+	if !ok {
+		return value, errors.New("failed to cast singleflight response value to type")
+	}
+	return value, err
+}
+
+func (c *Cache) FetchCalibrations(categoryID uint64, fetch func() (compute.Calibrations, error)) (value compute.Calibrations, err error) {
+	key := calibrationsKey{CategoryID: categoryID}.String()
+
+	// singleflight fetch
+	valueAny, err, _ := calibrationsSingleflight.Do(key, func() (any, error) {
+		// retrieve cache item
+		c.calibrationsLock.RLock()
+		cacheValue, ok := c.calibrations[key]
+		c.calibrationsLock.RUnlock()
+
+		// check cache value
+		valid := false
+		if ok && cacheValue.expiration.After(time.Now()) {
+			value = cacheValue.value
+			valid = true
+		}
+
+		// return cache value if valid
+		if valid {
+			return value, nil
+		}
+
+		// fetch new result
+		value, err = fetch()
+		if err != nil {
+			return value, err
+		}
+
+		// save new result
+		c.calibrationsLock.Lock()
+		c.calibrations[key] = &item[compute.Calibrations]{
+			expiration: time.Now().Add(config.CACHE_DURATION),
+			value:      value,
+		}
+		c.calibrationsLock.Unlock()
+
+		// return new result
+		return value, err
+	})
+	if err != nil {
+		return value, err
+	}
+	value, ok := valueAny.(compute.Calibrations)
+	if !ok {
+		return value, errors.New("failed to cast singleflight response value to type")
+	}
+	return value, err
+}
+
+func (c *Cache) InvalidateCategory(name string, ownerID uint64) {
+	key := categoryKey{Name: name, OwnerID: ownerID}.String()
+	c.categoryLock.Lock()
+	delete(c.category, key)
+	c.categoryLock.Unlock()
+}
+
+func (c *Cache) InvalidateCentroids(categoryID uint64) {
+	key := centroidsKey{CategoryID: categoryID}.String()
+	c.centroidsLock.Lock()
+	delete(c.centroids, key)
+	c.centroidsLock.Unlock()
+}
+
+func (c *Cache) InvalidateCodebook(categoryID uint64) {
+	key := codebookKey{CategoryID: categoryID}.String()
+	c.codebookLock.Lock()
+	delete(c.codebook, key)
+	c.codebookLock.Unlock()
+}
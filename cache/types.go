@@ -31,6 +31,22 @@ func (k centroidsKey) String() string {
 	return strconv.FormatUint(k.CategoryID, 10)
 }
 
+type codebookKey struct {
+	CategoryID uint64
+}
+
+func (k codebookKey) String() string {
+	return strconv.FormatUint(k.CategoryID, 10)
+}
+
+type calibrationsKey struct {
+	CategoryID uint64
+}
+
+func (k calibrationsKey) String() string {
+	return strconv.FormatUint(k.CategoryID, 10)
+}
+
 type item[T any] struct {
 	expiration time.Time
 	value      T
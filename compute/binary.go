@@ -0,0 +1,32 @@
+package compute
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// BinaryQuantize returns one bit per dimension set when the value is positive.
+func BinaryQuantize(vector []float32) (code []uint8) {
+	code = make([]uint8, (len(vector)+7)/8)
+	for idx, value := range vector {
+		if value > 0 {
+			code[idx/8] |= 1 << (idx % 8)
+		}
+	}
+	return code
+}
+
+// HammingDistance returns the number of bits that differ between the codes.
+func HammingDistance(a []uint8, b []uint8) (distance int) {
+	if len(a) != len(b) {
+		return len(a)*8 + len(b)*8
+	}
+	idx := 0
+	for ; idx+8 <= len(a); idx += 8 {
+		distance += bits.OnesCount64(binary.LittleEndian.Uint64(a[idx:]) ^ binary.LittleEndian.Uint64(b[idx:]))
+	}
+	for ; idx < len(a); idx++ {
+		distance += bits.OnesCount8(a[idx] ^ b[idx])
+	}
+	return distance
+}
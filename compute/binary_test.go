@@ -0,0 +1,92 @@
+package compute
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestBinaryQuantize(t *testing.T) {
+	tests := []struct {
+		name   string
+		vector []float32
+		code   []uint8
+	}{
+		{name: "empty", vector: nil, code: []uint8{}},
+		{name: "signs", vector: []float32{1, -1, 0.5, -0.5, 0, 2, -2, 3}, code: []uint8{0b10100101}},
+		{name: "zero is negative", vector: []float32{0, 0, 0}, code: []uint8{0}},
+		{name: "partial byte", vector: []float32{-1, -1, -1, -1, -1, -1, -1, -1, 1, -1, 1}, code: []uint8{0, 0b101}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := BinaryQuantize(test.vector); !slices.Equal(code, test.code) {
+				t.Errorf("code is %08b, want %08b", code, test.code)
+			}
+		})
+	}
+}
+
+func TestHammingDistance(t *testing.T) {
+	long := make([]uint8, 19)
+	flipped := slices.Clone(long)
+	flipped[0], flipped[9], flipped[18] = 0xFF, 0x01, 0x80
+	tests := []struct {
+		name     string
+		a        []uint8
+		b        []uint8
+		distance int
+	}{
+		{name: "empty", a: nil, b: nil, distance: 0},
+		{name: "equal", a: []uint8{0xAB, 0xCD}, b: []uint8{0xAB, 0xCD}, distance: 0},
+		{name: "single bit", a: []uint8{0b0001}, b: []uint8{0b0011}, distance: 1},
+		{name: "words and remainder", a: long, b: flipped, distance: 10},
+		{name: "different lengths", a: []uint8{0}, b: []uint8{0, 0}, distance: 24},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if distance := HammingDistance(test.a, test.b); distance != test.distance {
+				t.Errorf("distance is %d, want %d", distance, test.distance)
+			}
+			if distance := HammingDistance(test.b, test.a); distance != test.distance {
+				t.Errorf("reversed distance is %d, want %d", distance, test.distance)
+			}
+		})
+	}
+}
+
+func TestBinaryPrefilterRecall(t *testing.T) {
+	tests := []struct {
+		name string
+		dims int
+		keep int
+	}{
+		{name: "small vectors", dims: 32, keep: 100},
+		{name: "large vectors", dims: 256, keep: 20},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vectors := unitVectors(5, 1000, test.dims)
+			codes := make([][]uint8, len(vectors))
+			for idx, vector := range vectors {
+				codes[idx] = BinaryQuantize(vector)
+			}
+			for _, idx := range []int{0, 250, 999} {
+				// a query close to the vector keeps it among the closest codes
+				query := slices.Clone(vectors[idx])
+				for dim := range query {
+					query[dim] += 0.02 * float32(dim%3-1)
+				}
+				queryCode := BinaryQuantize(query)
+				target := HammingDistance(queryCode, codes[idx])
+				closer := 0
+				for _, code := range codes {
+					if HammingDistance(queryCode, code) < target {
+						closer++
+					}
+				}
+				if closer >= test.keep {
+					t.Errorf("vector %d has %d closer codes, want fewer than %d", idx, closer, test.keep)
+				}
+			}
+		})
+	}
+}
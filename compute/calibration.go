@@ -0,0 +1,164 @@
+package compute
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Calibrated vectors replace the 8-byte min/max header with a NaN marker whose low byte is the format version followed by the calibration id.
+// A min/max header never holds NaN so both encodings can be stored side by side.
+const (
+	calibrationMarker  uint32 = 0x7FC0CA00
+	CalibrationVersion uint8  = 1
+)
+
+// Calibration holds the offset and scale of each dimension, a quantized value q decodes to offset + q/255*scale.
+type Calibration struct {
+	Offset []float32
+	Scale  []float32
+}
+
+// Calibrations holds the calibrations of a category by id, calibrated vectors name theirs in the header.
+type Calibrations map[uint32]Calibration
+
+// Calibrate returns the calibration covering the range of each dimension of the sample vectors.
+func Calibrate(samples [][]float32) (calibration Calibration) {
+	if len(samples) == 0 {
+		return calibration
+	}
+	dims := len(samples[0])
+	minimum := make([]float32, dims)
+	maximum := make([]float32, dims)
+	for idx := range dims {
+		minimum[idx] = math.MaxFloat32
+		maximum[idx] = -math.MaxFloat32
+	}
+	for _, vector := range samples {
+		if len(vector) != dims {
+			continue
+		}
+		for idx, value := range vector {
+			minimum[idx] = min(minimum[idx], value)
+			maximum[idx] = max(maximum[idx], value)
+		}
+	}
+	calibration.Offset = minimum
+	calibration.Scale = make([]float32, dims)
+	for idx := range dims {
+		if minimum[idx] > maximum[idx] {
+			// dimension not seen in the samples
+			calibration.Offset[idx] = 0
+			calibration.Scale[idx] = 1
+			continue
+		}
+		calibration.Scale[idx] = maximum[idx] - minimum[idx]
+		if calibration.Scale[idx] == 0 {
+			// constant dimension
+			calibration.Scale[idx] = 1
+		}
+	}
+	return calibration
+}
+
+// CalibrationID returns the calibration id of a calibrated vector, ok is false for min/max vectors.
+func CalibrationID(vectorQuantized []uint8) (id uint32, ok bool) {
+	if len(vectorQuantized) < 8 || binary.LittleEndian.Uint32(vectorQuantized)&^0xFF != calibrationMarker {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(vectorQuantized[4:]), true
+}
+
+// QuantizeVectorCalibrated scales each dimension by the calibration to 1-byte, values outside the calibrated range are clamped.
+// Vectors of other dimensions than the calibration are quantized by their min/max.
+func QuantizeVectorCalibrated(vector []float32, id uint32, calibration Calibration) (vectorQuantized []uint8) {
+	if len(vector) != len(calibration.Offset) {
+		return QuantizeVectorFloat32(vector)
+	}
+	vectorQuantized = make([]uint8, 8+len(vector))
+	binary.LittleEndian.PutUint32(vectorQuantized, calibrationMarker|uint32(CalibrationVersion))
+	binary.LittleEndian.PutUint32(vectorQuantized[4:], id)
+	for i, value := range vector {
+		normalized := (value - calibration.Offset[i]) / calibration.Scale[i]
+		vectorQuantized[8+i] = uint8(math.Round(float64(max(0, min(1, normalized)) * 255)))
+	}
+	return vectorQuantized
+}
+
+// dequantizeVector decodes min/max vectors by their header and calibrated vectors by the calibration their header names.
+func dequantizeVector[T float32 | float64](vectorQuantized []uint8, calibrations Calibrations) (vector []T, err error) {
+	id, ok := CalibrationID(vectorQuantized)
+	if !ok {
+		return DequantizeVector[T](vectorQuantized)
+	}
+	calibration, ok := calibrations[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: calibration %d is not loaded", ErrCalibrated, id)
+	}
+	if len(calibration.Offset) != len(vectorQuantized)-8 {
+		return nil, fmt.Errorf("calibration %d has %d dimensions, vector has %d", id, len(calibration.Offset), len(vectorQuantized)-8)
+	}
+	vector = make([]T, len(vectorQuantized)-8)
+	for i, value := range vectorQuantized[8:] {
+		vector[i] = T(calibration.Offset[i] + float32(value)/255*calibration.Scale[i])
+	}
+	return vector, nil
+}
+
+// DequantizeVectorFloat32 decodes a min/max or calibrated vector.
+func (c Calibrations) DequantizeVectorFloat32(vectorQuantized []uint8) (vector []float32, err error) {
+	return dequantizeVector[float32](vectorQuantized, c)
+}
+
+// DequantizeVectorFloat64 decodes a min/max or calibrated vector.
+func (c Calibrations) DequantizeVectorFloat64(vectorQuantized []uint8) (vector []float64, err error) {
+	return dequantizeVector[float64](vectorQuantized, c)
+}
+
+// DequantizeMatrixFloat32 decodes min/max or calibrated vectors.
+func (c Calibrations) DequantizeMatrixFloat32(matrixQuantized [][]uint8) (matrix [][]float32, err error) {
+	matrix = make([][]float32, len(matrixQuantized))
+	for i, vector := range matrixQuantized {
+		matrix[i], err = c.DequantizeVectorFloat32(vector)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return matrix, nil
+}
+
+// NewVector creates a vector from a min/max or calibrated vector.
+func (c Calibrations) NewVector(vectorQuantized []uint8) (Vector, error) {
+	return newVector(vectorQuantized, c)
+}
+
+// NewMatrix creates a matrix from min/max or calibrated vectors.
+func (c Calibrations) NewMatrix(matrixQuantized [][]uint8) (Matrix, error) {
+	return newMatrix(matrixQuantized, c)
+}
+
+// MarshalBinary encodes the calibration as the offsets followed by the scales.
+func (c Calibration) MarshalBinary() (data []byte, err error) {
+	data = make([]byte, 8*len(c.Offset))
+	for idx := range c.Offset {
+		binary.LittleEndian.PutUint32(data[4*idx:], math.Float32bits(c.Offset[idx]))
+		binary.LittleEndian.PutUint32(data[4*(len(c.Offset)+idx):], math.Float32bits(c.Scale[idx]))
+	}
+	return data, nil
+}
+
+// UnmarshalBinary decodes a calibration encoded by MarshalBinary.
+func (c *Calibration) UnmarshalBinary(data []byte) error {
+	if len(data)%8 != 0 {
+		return errors.New("calibration size is not a multiple of its dimensions")
+	}
+	dims := len(data) / 8
+	c.Offset = make([]float32, dims)
+	c.Scale = make([]float32, dims)
+	for idx := range dims {
+		c.Offset[idx] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*idx:]))
+		c.Scale[idx] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*(dims+idx):]))
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package compute
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestCalibratedRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples [][]float32
+		vector  []float32
+		want    []float32
+	}{
+		{
+			name:    "within range",
+			samples: [][]float32{{-1, 0, 10}, {1, 2, 20}},
+			vector:  []float32{0.5, 1, 15},
+			want:    []float32{0.5, 1, 15},
+		},
+		{
+			name:    "clamped to range",
+			samples: [][]float32{{-1, 0, 10}, {1, 2, 20}},
+			vector:  []float32{-3, 5, 15},
+			want:    []float32{-1, 2, 15},
+		},
+		{
+			name:    "constant dimension",
+			samples: [][]float32{{4, 1}, {4, 2}},
+			vector:  []float32{4, 1.5},
+			want:    []float32{4, 1.5},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calibration := Calibrate(test.samples)
+			quantized := QuantizeVectorCalibrated(test.vector, 42, calibration)
+			if id, ok := CalibrationID(quantized); !ok || id != 42 {
+				t.Fatalf("calibration id is %d %v, want 42", id, ok)
+			}
+			calibrations := Calibrations{42: calibration}
+			vector, err := calibrations.DequantizeVectorFloat32(quantized)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for idx, value := range vector {
+				tolerance := calibration.Scale[idx] / 255
+				if math.Abs(float64(value-test.want[idx])) > float64(tolerance) {
+					t.Errorf("dimension %d decoded as %f, want %f", idx, value, test.want[idx])
+				}
+			}
+
+			// the calibration survives storage
+			encoded, err := calibration.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded Calibration
+			if err = decoded.UnmarshalBinary(encoded); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(decoded.Offset, calibration.Offset) || !slices.Equal(decoded.Scale, calibration.Scale) {
+				t.Errorf("decoded calibration %+v, want %+v", decoded, calibration)
+			}
+		})
+	}
+}
+
+func TestCalibratedDecodeErrors(t *testing.T) {
+	calibration := Calibrate([][]float32{{-1, 0, 1}, {1, 1, 2}})
+	calibrated := QuantizeVectorCalibrated([]float32{0, 0.5, 1.5}, 3, calibration)
+	minmax := QuantizeVectorFloat32([]float32{0, 0.5, 1.5})
+	tests := []struct {
+		name         string
+		vector       []uint8
+		calibrations Calibrations
+		calibrated   bool
+		err          error
+	}{
+		{name: "min/max without calibrations", vector: minmax},
+		{name: "min/max with calibrations", vector: minmax, calibrations: Calibrations{3: calibration}},
+		{name: "calibrated", vector: calibrated, calibrations: Calibrations{3: calibration}, calibrated: true},
+		{name: "calibration not loaded", vector: calibrated, calibrations: Calibrations{4: calibration}, calibrated: true, err: ErrCalibrated},
+		{name: "calibration of other dimensions", vector: calibrated, calibrations: Calibrations{3: Calibrate([][]float32{{0, 1}})}, calibrated: true, err: errors.New("dimensions")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			check := func(name string, err error) {
+				t.Helper()
+				if test.err == nil && err != nil {
+					t.Errorf("%s: %v", name, err)
+				} else if test.err != nil && err == nil {
+					t.Errorf("%s decoded the vector", name)
+				} else if errors.Is(test.err, ErrCalibrated) && !errors.Is(err, ErrCalibrated) {
+					t.Errorf("%s error is %v, want %v", name, err, ErrCalibrated)
+				}
+			}
+			_, err := test.calibrations.DequantizeVectorFloat32(test.vector)
+			check("calibrations vector", err)
+			_, err = test.calibrations.NewMatrix([][]uint8{test.vector})
+			check("calibrations matrix", err)
+
+			// plain decoding refuses calibrated vectors instead of panicking
+			_, err = DequantizeVectorFloat32(test.vector)
+			if test.calibrated != errors.Is(err, ErrCalibrated) {
+				t.Errorf("vector error is %v", err)
+			}
+			_, err = DequantizeMatrixFloat64([][]uint8{minmax, test.vector})
+			if test.calibrated != errors.Is(err, ErrCalibrated) {
+				t.Errorf("matrix error is %v", err)
+			}
+			_, err = NewVector(test.vector)
+			if test.calibrated != errors.Is(err, ErrCalibrated) {
+				t.Errorf("new vector error is %v", err)
+			}
+			_, err = NewMatrix([][]uint8{test.vector})
+			if test.calibrated != errors.Is(err, ErrCalibrated) {
+				t.Errorf("new matrix error is %v", err)
+			}
+		})
+	}
+}
+
+func TestCalibratedSimilarity(t *testing.T) {
+	vectors := unitVectors(6, 50, 16)
+	calibration := Calibrate(vectors)
+	calibrations := Calibrations{1: calibration}
+	tests := []struct {
+		name  string
+		a     int
+		b     int
+		mixed bool
+	}{
+		{name: "same vector", a: 3, b: 3},
+		{name: "different vectors", a: 3, b: 17},
+		{name: "mixed encodings", a: 8, b: 40, mixed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var exact float32
+			for dim := range vectors[test.a] {
+				exact += vectors[test.a][dim] * vectors[test.b][dim]
+			}
+			target, err := calibrations.NewVector(QuantizeVectorCalibrated(vectors[test.a], 1, calibration))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored := QuantizeVectorCalibrated(vectors[test.b], 1, calibration)
+			if test.mixed {
+				stored = QuantizeVectorFloat32(vectors[test.b])
+			}
+			matrix, err := calibrations.NewMatrix([][]uint8{stored})
+			if err != nil {
+				t.Fatal(err)
+			}
+			similarity := target.MatrixCosineSimilarity(matrix)[0]
+			if math.Abs(float64(similarity-exact)) > 0.02 {
+				t.Errorf("similarity is %f, want %f", similarity, exact)
+			}
+		})
+	}
+}
@@ -7,20 +7,34 @@ import (
 	"slices"
 )
 
-func NewVector(vectorQuantized []uint8) Vector {
+// NewVector creates a vector from a min/max vector, calibrated vectors return ErrCalibrated.
+func NewVector(vectorQuantized []uint8) (Vector, error) {
+	return newVector(vectorQuantized, nil)
+}
+
+// NewMatrix creates a matrix from min/max vectors, calibrated vectors return ErrCalibrated.
+func NewMatrix(matrixQuantized [][]uint8) (Matrix, error) {
+	return newMatrix(matrixQuantized, nil)
+}
+
+func newVector(vectorQuantized []uint8, calibrations Calibrations) (Vector, error) {
 	cols := len(vectorQuantized) - 8
 	if cols <= 0 {
 		panic("vector columns are empty")
 	}
+	vector, err := dequantizeVector[float64](vectorQuantized, calibrations)
+	if err != nil {
+		return nil, err
+	}
 	return &vectorContainer{
-		data: DequantizeVectorFloat64(vectorQuantized),
+		data: vector,
 		shape: vectorShape{
 			cols: cols,
 		},
-	}
+	}, nil
 }
 
-func NewMatrix(matrixQuantized [][]uint8) Matrix {
+func newMatrix(matrixQuantized [][]uint8, calibrations Calibrations) (Matrix, error) {
 	rows := len(matrixQuantized)
 	if rows == 0 {
 		panic("matrix rows are empty")
@@ -29,9 +43,12 @@ func NewMatrix(matrixQuantized [][]uint8) Matrix {
 	if cols <= 0 {
 		panic("matrix columns are empty")
 	}
-	matrix := DequantizeMatrixFloat64(matrixQuantized)
 	flat := make([]float64, rows*cols)
-	for i, row := range matrix {
+	for i, vectorQuantized := range matrixQuantized {
+		row, err := dequantizeVector[float64](vectorQuantized, calibrations)
+		if err != nil {
+			return nil, err
+		}
 		copy(flat[i*cols:], row)
 	}
 	return &matrixContainer{
@@ -40,7 +57,7 @@ func NewMatrix(matrixQuantized [][]uint8) Matrix {
 			rows: rows,
 			cols: cols,
 		},
-	}
+	}, nil
 }
 
 type vectorContainer struct {
@@ -8,19 +8,32 @@ import (
 	"gorgonia.org/tensor"
 )
 
-func NewVector(vectorQuantized []uint8) Vector {
+// NewVector creates a vector from a min/max vector, calibrated vectors return ErrCalibrated.
+func NewVector(vectorQuantized []uint8) (Vector, error) {
+	return newVector(vectorQuantized, nil)
+}
+
+// NewMatrix creates a matrix from min/max vectors, calibrated vectors return ErrCalibrated.
+func NewMatrix(matrixQuantized [][]uint8) (Matrix, error) {
+	return newMatrix(matrixQuantized, nil)
+}
+
+func newVector(vectorQuantized []uint8, calibrations Calibrations) (Vector, error) {
 	cols := len(vectorQuantized) - 8
 	if cols <= 0 {
 		panic("vector columns are empty")
 	}
-	vector := DequantizeVectorFloat32(vectorQuantized)
+	vector, err := dequantizeVector[float32](vectorQuantized, calibrations)
+	if err != nil {
+		return nil, err
+	}
 	return &vectorContainer{
 		dense: tensor.New(tensor.WithBacking(vector), tensor.WithShape(1, cols)),
 		shape: tensor.Shape{cols},
-	}
+	}, nil
 }
 
-func NewMatrix(matrixQuantized [][]uint8) Matrix {
+func newMatrix(matrixQuantized [][]uint8, calibrations Calibrations) (Matrix, error) {
 	rows := len(matrixQuantized)
 	if rows == 0 {
 		panic("matrix rows are empty")
@@ -29,15 +42,18 @@ func NewMatrix(matrixQuantized [][]uint8) Matrix {
 	if cols <= 0 {
 		panic("matrix columns are empty")
 	}
-	matrix := DequantizeMatrixFloat32(matrixQuantized)
 	flat := make([]float32, rows*cols)
-	for i, row := range matrix {
+	for i, vectorQuantized := range matrixQuantized {
+		row, err := dequantizeVector[float32](vectorQuantized, calibrations)
+		if err != nil {
+			return nil, err
+		}
 		copy(flat[i*cols:], row)
 	}
 	return &matrixContainer{
 		dense: tensor.New(tensor.WithBacking(flat), tensor.WithShape(rows, cols)),
 		shape: tensor.Shape{rows, cols},
-	}
+	}, nil
 }
 
 type vectorContainer struct {
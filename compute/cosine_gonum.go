@@ -57,6 +57,7 @@ func VectorMatrixCosineSimilarity() (calculate func(vector Vector, matrix Matrix
 
 // MatrixCosineSimilarity facilitates the computation of cosine similarity between a matrix and a matrix with single graph.
 // The first matrix is the input matrix and the second matrix is the batch of vectors to compare against.
+// Similarities are returned row-major with a row of input similarities for each vector in the batch.
 func (matrix1 *matrixContainer) MatrixCosineSimilarity(matrix2 Matrix) (relativeSimilaritieList []float32, nearestIndexList []int) {
 	realMatrix2 := (matrix2.(*matrixContainer))
 	A := matrix1.data     // Centroids
@@ -117,6 +118,7 @@ func (matrix1 *matrixContainer) MatrixCosineSimilarity(matrix2 Matrix) (relative
 
 // MatrixCosineSimilarity facilitates the computation of cosine similarity between a matrix and a matrix with reusable graph.
 // The first matrix is the input matrix and the second matrix is the batch of vectors to compare against.
+// Similarities are returned row-major with a row of input similarities for each vector in the batch.
 func MatrixCosineSimilarity() (calculate func(matrix1 Matrix, matrix2 Matrix) (relativeSimilaritieList []float32, nearestIndexList []int), done func()) {
 	return func(matrix1 Matrix, matrix2 Matrix) (relativeSimilaritieList []float32, nearestIndexList []int) {
 			return matrix1.MatrixCosineSimilarity(matrix2)
@@ -147,6 +147,7 @@ func VectorMatrixCosineSimilarity() (calculate func(vector Vector, matrix Matrix
 
 // MatrixCosineSimilarity facilitates the computation of cosine similarity between a matrix and a matrix with single graph.
 // The first matrix is the input matrix and the second matrix is the batch of vectors to compare against.
+// Similarities are returned row-major with a row of input similarities for each vector in the batch.
 func (matrix1 *matrixContainer) MatrixCosineSimilarity(matrix2 Matrix) (relativeSimilaritieList []float32, nearestIndexList []int) {
 	realMatrix2 := matrix2.(*matrixContainer)
 	if matrix1.shape[1] != realMatrix2.shape[1] {
@@ -215,11 +216,12 @@ func (matrix1 *matrixContainer) MatrixCosineSimilarity(matrix2 Matrix) (relative
 	// Convert to Go slice
 	nearestIndexList = argmaxTensor.Data().([]int)
 
-	return cosSim.Value().Data().([]float32), nearestIndexList
+	return transpose(cosSim.Value().Data().([]float32), matrix1.shape[0], realMatrix2.shape[0]), nearestIndexList
 }
 
 // MatrixCosineSimilarity facilitates the computation of cosine similarity between a matrix and a matrix with reusable graph.
 // The first matrix is the input matrix and the second matrix is the batch of vectors to compare against.
+// Similarities are returned row-major with a row of input similarities for each vector in the batch.
 func MatrixCosineSimilarity() (calculate func(matrix1 Matrix, matrix2 Matrix) (relativeSimilaritieList []float32, nearestIndexList []int), done func()) {
 	buildGraph := func(matrixShape1, matrixShape2 tensor.Shape) (M1, M2, cosineSim *gorgonia.Node, machine partialTapeMachine) {
 		g := gorgonia.NewGraph()
@@ -318,7 +320,7 @@ func MatrixCosineSimilarity() (calculate func(matrix1 Matrix, matrix2 Matrix) (r
 
 			// Convert to Go slice
 			nearestIndexList = argmaxTensor.Data().([]int)
-			relativeSimilaritieList = cosineSim.Value().Data().([]float32)
+			relativeSimilaritieList = transpose(cosineSim.Value().Data().([]float32), realMatrix1.shape[0], realMatrix2.shape[0])
 
 			// Reset the machine to clear the tape for the next run
 			machine.Reset()
@@ -331,6 +333,17 @@ func MatrixCosineSimilarity() (calculate func(matrix1 Matrix, matrix2 Matrix) (r
 		}
 }
 
+// transpose converts a row-major rows x cols slice into a row-major cols x rows slice.
+func transpose(data []float32, rows, cols int) (transposed []float32) {
+	transposed = make([]float32, len(data))
+	for i := range rows {
+		for j := range cols {
+			transposed[j*rows+i] = data[i*cols+j]
+		}
+	}
+	return transposed
+}
+
 // rowWiseL2Norm computes the row-wise L2-norms for a matrix node [N, D], returning a node of shape [N].
 func rowWiseL2Norm(mat *gorgonia.Node) (*gorgonia.Node, error) {
 	// square each element
@@ -0,0 +1,83 @@
+package compute
+
+import (
+	"math"
+	"slices"
+)
+
+// MeanVector returns the mean of the unit length vectors.
+func MeanVector(matrix [][]float32) (vectorQuantized []uint8) {
+	if len(matrix) == 0 {
+		return nil
+	}
+	mean := make([]float32, len(matrix[0]))
+	for _, vector := range matrix {
+		var norm float32
+		for _, value := range vector {
+			norm += value * value
+		}
+		norm = float32(math.Sqrt(float64(norm)))
+		if norm == 0 {
+			continue
+		}
+		for i, value := range vector {
+			mean[i] += value / norm
+		}
+	}
+	for i := range mean {
+		mean[i] /= float32(len(matrix))
+	}
+	return QuantizeVectorFloat32(mean)
+}
+
+// WeightedVector returns the weighted sum of the unit length vectors, negative weights subtract a vector.
+func WeightedVector(matrix [][]float32, weights []float32) (vectorQuantized []uint8) {
+	if len(matrix) == 0 {
+		return nil
+	}
+	sum := make([]float32, len(matrix[0]))
+	for idx, vector := range matrix {
+		var norm float32
+		for _, value := range vector {
+			norm += value * value
+		}
+		norm = float32(math.Sqrt(float64(norm)))
+		if norm == 0 {
+			continue
+		}
+		for i, value := range vector {
+			sum[i] += weights[idx] * value / norm
+		}
+	}
+	return QuantizeVectorFloat32(sum)
+}
+
+// MaxVector returns the element wise maximum of the vectors.
+func MaxVector(matrix [][]float32) (vectorQuantized []uint8) {
+	if len(matrix) == 0 {
+		return nil
+	}
+	maximum := slices.Clone(matrix[0])
+	for _, vector := range matrix[1:] {
+		for i, value := range vector {
+			maximum[i] = max(maximum[i], value)
+		}
+	}
+	return QuantizeVectorFloat32(maximum)
+}
+
+// Normalize scales the vector in place to unit length, zero vectors are returned unchanged.
+func Normalize(vector []float32) []float32 {
+	var norm float64
+	for _, value := range vector {
+		norm += float64(value) * float64(value)
+	}
+	if norm == 0 {
+		return vector
+	}
+	scale := float32(1 / math.Sqrt(norm))
+	for idx := range vector {
+		vector[idx] *= scale
+	}
+	return vector
+}
@@ -0,0 +1,140 @@
+package compute
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"slices"
+)
+
+// ProductCentroids is the number of centroids of each sub-quantizer, a code stores one byte per subspace.
+const ProductCentroids = 256
+
+// Codebook holds the sub-quantizers of product quantization over unit length vectors.
+// The vector is split into subspaces of Subspace dimensions, the last subspace holds the remainder.
+type Codebook struct {
+	Dims     int
+	Subspace int
+	// Centroids holds the ProductCentroids centroids of each subspace one after the other
+	Centroids []float32
+}
+
+// NewCodebook creates a codebook with zero centroids for vectors of dims dimensions.
+func NewCodebook(dims int, subspace int) Codebook {
+	return Codebook{
+		Dims:      dims,
+		Subspace:  max(1, min(subspace, dims)),
+		Centroids: make([]float32, dims*ProductCentroids),
+	}
+}
+
+// Subspaces returns the number of sub-quantizers, which is the length of a code.
+func (c Codebook) Subspaces() int {
+	return (c.Dims + c.Subspace - 1) / c.Subspace
+}
+
+// Bounds returns the dimensions covered by the subspace.
+func (c Codebook) Bounds(subspace int) (from int, to int) {
+	from = subspace * c.Subspace
+	return from, min(from+c.Subspace, c.Dims)
+}
+
+// Centroid returns the centroid of the subspace, changes are written to the codebook.
+func (c Codebook) Centroid(subspace int, centroid int) []float32 {
+	from, to := c.Bounds(subspace)
+	offset := from*ProductCentroids + centroid*(to-from)
+	return c.Centroids[offset : offset+to-from]
+}
+
+// Nearest returns the centroid of the subspace closest to the sub vector by euclidean distance.
+func (c Codebook) Nearest(subspace int, subvector []float32) (nearest uint8) {
+	best := float32(math.MaxFloat32)
+	for centroid := range ProductCentroids {
+		var distance float32
+		for idx, value := range c.Centroid(subspace, centroid) {
+			diff := subvector[idx] - value
+			distance += diff * diff
+		}
+		if distance < best {
+			best, nearest = distance, uint8(centroid)
+		}
+	}
+	return nearest
+}
+
+// Encode returns the product quantization code of the vector.
+func (c Codebook) Encode(vector []float32) (code []uint8) {
+	vector = Normalize(slices.Clone(vector))
+	if len(vector) != c.Dims {
+		return nil
+	}
+	code = make([]uint8, c.Subspaces())
+	for subspace := range code {
+		from, to := c.Bounds(subspace)
+		code[subspace] = c.Nearest(subspace, vector[from:to])
+	}
+	return code
+}
+
+// Table returns the asymmetric distance table of the target, the dot product of each target sub vector with each centroid of its subspace.
+func (c Codebook) Table(targetQuantized []uint8) (table []float32, err error) {
+	target, err := DequantizeVectorFloat32(targetQuantized)
+	if err != nil {
+		return nil, err
+	}
+	target = Normalize(target)
+	if len(target) != c.Dims {
+		return nil, nil
+	}
+	subspaces := c.Subspaces()
+	table = make([]float32, subspaces*ProductCentroids)
+	for subspace := range subspaces {
+		from, _ := c.Bounds(subspace)
+		for centroid := range ProductCentroids {
+			var dot float32
+			for idx, value := range c.Centroid(subspace, centroid) {
+				dot += value * target[from+idx]
+			}
+			table[subspace*ProductCentroids+centroid] = dot
+		}
+	}
+	return table, nil
+}
+
+// ProductSimilarity returns the approximate cosine similarity of the code to the target of the table.
+func ProductSimilarity(table []float32, code []uint8) (similarity float32) {
+	for subspace, centroid := range code {
+		similarity += table[subspace*ProductCentroids+int(centroid)]
+	}
+	return similarity
+}
+
+// MarshalBinary encodes the codebook as the dimensions and subspace size followed by the centroids.
+func (c Codebook) MarshalBinary() (data []byte, err error) {
+	data = make([]byte, 8+4*len(c.Centroids))
+	binary.LittleEndian.PutUint32(data, uint32(c.Dims))
+	binary.LittleEndian.PutUint32(data[4:], uint32(c.Subspace))
+	for idx, value := range c.Centroids {
+		binary.LittleEndian.PutUint32(data[8+4*idx:], math.Float32bits(value))
+	}
+	return data, nil
+}
+
+// UnmarshalBinary decodes a codebook encoded by MarshalBinary.
+func (c *Codebook) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return errors.New("codebook is too short")
+	}
+	dims := int(binary.LittleEndian.Uint32(data))
+	subspace := int(binary.LittleEndian.Uint32(data[4:]))
+	if dims <= 0 || subspace <= 0 || len(data) != 8+4*dims*ProductCentroids {
+		return errors.New("codebook size does not match its dimensions")
+	}
+	c.Dims = dims
+	c.Subspace = subspace
+	c.Centroids = make([]float32, dims*ProductCentroids)
+	for idx := range c.Centroids {
+		c.Centroids[idx] = math.Float32frombits(binary.LittleEndian.Uint32(data[8+4*idx:]))
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package compute
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+// unitVectors returns n reproducible unit length vectors of the dimensions.
+func unitVectors(seed uint64, n int, dims int) (vectors [][]float32) {
+	random := rand.New(rand.NewPCG(seed, seed))
+	vectors = make([][]float32, n)
+	for idx := range vectors {
+		vectors[idx] = make([]float32, dims)
+		for dim := range vectors[idx] {
+			vectors[idx][dim] = random.Float32()*2 - 1
+		}
+		vectors[idx] = Normalize(vectors[idx])
+	}
+	return vectors
+}
+
+// exactCodebook returns a codebook whose centroid k of every subspace is the matching sub vector of vector k.
+func exactCodebook(vectors [][]float32, subspace int) (codebook Codebook) {
+	codebook = NewCodebook(len(vectors[0]), subspace)
+	for sub := range codebook.Subspaces() {
+		from, to := codebook.Bounds(sub)
+		for centroid, vector := range vectors {
+			copy(codebook.Centroid(sub, centroid), vector[from:to])
+		}
+	}
+	return codebook
+}
+
+func TestCodebookEncode(t *testing.T) {
+	tests := []struct {
+		name      string
+		dims      int
+		subspace  int
+		subspaces int
+	}{
+		{name: "even subspaces", dims: 16, subspace: 4, subspaces: 4},
+		{name: "remainder subspace", dims: 10, subspace: 4, subspaces: 3},
+		{name: "subspace larger than vector", dims: 6, subspace: 8, subspaces: 1},
+		{name: "single dimension subspaces", dims: 5, subspace: 1, subspaces: 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vectors := unitVectors(1, ProductCentroids, test.dims)
+			codebook := exactCodebook(vectors, test.subspace)
+			if codebook.Subspaces() != test.subspaces {
+				t.Fatalf("codebook has %d subspaces, want %d", codebook.Subspaces(), test.subspaces)
+			}
+			for _, idx := range []int{0, 1, 127, 255} {
+				// scaled vectors encode like their unit length
+				scaled := slices.Clone(vectors[idx])
+				for dim := range scaled {
+					scaled[dim] *= 3
+				}
+				code := codebook.Encode(scaled)
+				want := slices.Repeat([]uint8{uint8(idx)}, test.subspaces)
+				if !slices.Equal(code, want) {
+					t.Fatalf("vector %d encoded as %v, want %v", idx, code, want)
+				}
+
+				// decode the code against the table of every other vector
+				table, err := codebook.Table(QuantizeVectorFloat32(vectors[idx]))
+				if err != nil {
+					t.Fatalf("table of vector %d: %v", idx, err)
+				}
+				for _, other := range []int{0, 64, 200} {
+					var exact float32
+					for dim := range vectors[idx] {
+						exact += vectors[idx][dim] * vectors[other][dim]
+					}
+					similarity := ProductSimilarity(table, codebook.Encode(vectors[other]))
+					if math.Abs(float64(similarity-exact)) > 0.05 {
+						t.Errorf("vector %d similarity to %d is %f, want %f", idx, other, similarity, exact)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCodebookMismatch(t *testing.T) {
+	codebook := exactCodebook(unitVectors(2, ProductCentroids, 8), 4)
+	calibration := Calibrate(unitVectors(3, 10, 8))
+	tests := []struct {
+		name   string
+		vector []float32
+		target []uint8
+		err    error
+	}{
+		{name: "fewer dimensions", vector: make([]float32, 4), target: QuantizeVectorFloat32(make([]float32, 4))},
+		{name: "more dimensions", vector: make([]float32, 12), target: QuantizeVectorFloat32(make([]float32, 12))},
+		{name: "calibrated target", vector: make([]float32, 7), target: QuantizeVectorCalibrated(make([]float32, 8), 7, calibration), err: ErrCalibrated},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := codebook.Encode(test.vector); code != nil {
+				t.Errorf("encoded %d dimensions as %v", len(test.vector), code)
+			}
+			table, err := codebook.Table(test.target)
+			if !errors.Is(err, test.err) {
+				t.Errorf("table error is %v, want %v", err, test.err)
+			}
+			if table != nil {
+				t.Errorf("table has %d entries, want none", len(table))
+			}
+		})
+	}
+}
+
+func TestCodebookBinary(t *testing.T) {
+	codebook := exactCodebook(unitVectors(4, ProductCentroids, 10), 4)
+	encoded, err := codebook.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{name: "encoded", data: encoded, ok: true},
+		{name: "too short", data: encoded[:4]},
+		{name: "truncated centroids", data: encoded[:len(encoded)-4]},
+		{name: "zero dimensions", data: make([]byte, 8)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var decoded Codebook
+			err := decoded.UnmarshalBinary(test.data)
+			if !test.ok {
+				if err == nil {
+					t.Errorf("decoded malformed codebook %d x %d", decoded.Dims, decoded.Subspace)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Dims != codebook.Dims || decoded.Subspace != codebook.Subspace || !slices.Equal(decoded.Centroids, codebook.Centroids) {
+				t.Errorf("decoded codebook differs from the encoded codebook")
+			}
+		})
+	}
+}
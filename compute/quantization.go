@@ -2,9 +2,14 @@ package compute
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"math"
 )
 
+// ErrCalibrated is returned when a calibrated vector is decoded without its calibration.
+var ErrCalibrated = errors.New("vector needs its calibration to decode")
+
 func Quantize[T float32 | float64](value T, min T, max T) (valueQuantized uint8) {
 	if value < min {
 		value = min
@@ -101,34 +106,43 @@ func QuantizeVectorFloat64(vector []float64) (vectorQuantized []uint8) {
 	return vectorQuantized
 }
 
-func DequantizeVector[T float32 | float64](vectorQuantized []uint8) (vector []T) {
+func DequantizeVector[T float32 | float64](vectorQuantized []uint8) (vector []T, err error) {
+	if id, ok := CalibrationID(vectorQuantized); ok {
+		return nil, fmt.Errorf("%w: calibration %d", ErrCalibrated, id)
+	}
 	vector = make([]T, len(vectorQuantized)-8)
 	min := T(math.Float32frombits(binary.LittleEndian.Uint32(vectorQuantized)))
 	max := T(math.Float32frombits(binary.LittleEndian.Uint32(vectorQuantized[4:])))
 	for i, value := range vectorQuantized[8:] {
 		vector[i] = Dequantize(value, min, max)
 	}
-	return vector
+	return vector, nil
 }
 
-func DequantizeVectorFloat32(vectorQuantized []uint8) (vector []float32) {
+func DequantizeVectorFloat32(vectorQuantized []uint8) (vector []float32, err error) {
+	if id, ok := CalibrationID(vectorQuantized); ok {
+		return nil, fmt.Errorf("%w: calibration %d", ErrCalibrated, id)
+	}
 	min := math.Float32frombits(binary.LittleEndian.Uint32(vectorQuantized))
 	max := math.Float32frombits(binary.LittleEndian.Uint32(vectorQuantized[4:]))
 	vector = make([]float32, len(vectorQuantized)-8)
 	for i, value := range vectorQuantized[8:] {
 		vector[i] = DequantizeFloat32(value, min, max)
 	}
-	return vector
+	return vector, nil
 }
 
-func DequantizeVectorFloat64(vectorQuantized []uint8) (vector []float64) {
+func DequantizeVectorFloat64(vectorQuantized []uint8) (vector []float64, err error) {
+	if id, ok := CalibrationID(vectorQuantized); ok {
+		return nil, fmt.Errorf("%w: calibration %d", ErrCalibrated, id)
+	}
 	min := float64(math.Float32frombits(binary.LittleEndian.Uint32(vectorQuantized)))
 	max := float64(math.Float32frombits(binary.LittleEndian.Uint32(vectorQuantized[4:])))
 	vector = make([]float64, len(vectorQuantized)-8)
 	for i, value := range vectorQuantized[8:] {
 		vector[i] = DequantizeFloat64(value, min, max)
 	}
-	return vector
+	return vector, nil
 }
 
 func QuantizeMatrix[T float32 | float64](matrix [][]T) (matrixQuantized [][]uint8) {
@@ -155,28 +169,37 @@ func QuantizeMatrixFloat64(matrix [][]float64) (matrixQuantized [][]uint8) {
 	return matrixQuantized
 }
 
-func DequantizeMatrix[T float32 | float64](matrixQuantized [][]uint8) (matrix [][]T) {
+func DequantizeMatrix[T float32 | float64](matrixQuantized [][]uint8) (matrix [][]T, err error) {
 	matrix = make([][]T, len(matrixQuantized))
 	for i, vector := range matrixQuantized {
-		matrix[i] = DequantizeVector[T](vector)
+		matrix[i], err = DequantizeVector[T](vector)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return matrix
+	return matrix, nil
 }
 
-func DequantizeMatrixFloat32(matrixQuantized [][]uint8) (matrix [][]float32) {
+func DequantizeMatrixFloat32(matrixQuantized [][]uint8) (matrix [][]float32, err error) {
 	matrix = make([][]float32, len(matrixQuantized))
 	for i, vector := range matrixQuantized {
-		matrix[i] = DequantizeVectorFloat32(vector)
+		matrix[i], err = DequantizeVectorFloat32(vector)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return matrix
+	return matrix, nil
 }
 
-func DequantizeMatrixFloat64(matrixQuantized [][]uint8) (matrix [][]float64) {
+func DequantizeMatrixFloat64(matrixQuantized [][]uint8) (matrix [][]float64, err error) {
 	matrix = make([][]float64, len(matrixQuantized))
 	for i, vector := range matrixQuantized {
-		matrix[i] = DequantizeVectorFloat64(vector)
+		matrix[i], err = DequantizeVectorFloat64(vector)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return matrix
+	return matrix, nil
 }
 
 func rangeFloat[T float32 | float64](slice []T) (min T, max T) {
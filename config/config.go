@@ -20,6 +20,8 @@ type Config struct {
 	Server   ConfigServer `json:"server"`
 	TLS      ConfigTLS    `json:"tls"`
 	Database Database     `json:"database"`
+	Search   Search       `json:"search"`
+	Index    Index        `json:"index"`
 	Ollama   AI           `json:"ollama"`
 	OpenAI   AI           `json:"openai"`
 	LogLevel LogLevel     `json:"log_level"`
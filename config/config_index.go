@@ -0,0 +1,23 @@
+package config
+
+import (
+	_ "github.com/expki/go-vectorsearch/env"
+)
+
+type Index struct {
+	MemoryMB      uint `json:"memory_mb"`       // memory budget of the in-memory category index, disabled when zero
+	GraphMemoryMB uint `json:"graph_memory_mb"` // memory budget of loaded HNSW graphs, defaults to 1024, a node holds 4 bytes per dimension and 8 bytes per neighbour link
+}
+
+// GetBudget returns the memory budget of the in-memory category index in bytes.
+func (c Index) GetBudget() int64 {
+	return int64(c.MemoryMB) << 20
+}
+
+// GetGraphBudget returns the memory budget of loaded HNSW graphs in bytes.
+func (c Index) GetGraphBudget() int64 {
+	if c.GraphMemoryMB == 0 {
+		return HNSW_MEMORY_MB << 20
+	}
+	return int64(c.GraphMemoryMB) << 20
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	_ "github.com/expki/go-vectorsearch/env"
+)
+
+type Search struct {
+	MaxCount        uint     `json:"max_count"`        // maximum documents returned per page, defaults to 20
+	MaxProbe        uint     `json:"max_probe"`        // maximum centroids probed per category by adaptive probing, defaults to 16
+	ProbeCandidates uint     `json:"probe_candidates"` // candidates adaptive probing collects before it stops when the request sets none, defaults to 1000
+	ProbeMargin     *float32 `json:"probe_margin"`     // similarity below the closest centroid adaptive probing still scans when the request sets none, defaults to 0.05
+	EF              uint     `json:"ef"`               // HNSW search candidate list size when the request sets none, defaults to 64
+	MaxEF           uint     `json:"max_ef"`           // maximum HNSW search candidate list size, defaults to 1000
+	BM25K1          *float64 `json:"bm25_k1"`          // BM25 term frequency saturation of keyword search, defaults to 1.2
+	BM25B           *float64 `json:"bm25_b"`           // BM25 document length normalization of keyword search between 0 and 1, defaults to 0.75
+}
+
+// GetMaxCount returns the maximum documents returned per search page.
+func (c Search) GetMaxCount() uint {
+	if c.MaxCount == 0 {
+		return SEARCH_MAX_COUNT
+	}
+	return c.MaxCount
+}
+
+// GetMaxProbe returns the maximum centroids probed per category by adaptive probing.
+func (c Search) GetMaxProbe() uint {
+	if c.MaxProbe == 0 {
+		return PROBE_LIMIT
+	}
+	return c.MaxProbe
+}
+
+// GetProbeCandidates returns the candidates adaptive probing collects by default.
+func (c Search) GetProbeCandidates() uint {
+	if c.ProbeCandidates == 0 {
+		return PROBE_CANDIDATES
+	}
+	return c.ProbeCandidates
+}
+
+// GetProbeMargin returns the similarity margin of adaptive probing by default.
+func (c Search) GetProbeMargin() float32 {
+	if c.ProbeMargin == nil || *c.ProbeMargin < 0 || *c.ProbeMargin > 2 {
+		return PROBE_MARGIN
+	}
+	return *c.ProbeMargin
+}
+
+// GetEF returns the HNSW search candidate list size by default.
+func (c Search) GetEF() int {
+	if c.EF == 0 {
+		return HNSW_EF_SEARCH
+	}
+	return min(int(c.EF), c.GetMaxEF())
+}
+
+// GetMaxEF returns the maximum HNSW search candidate list size.
+func (c Search) GetMaxEF() int {
+	if c.MaxEF == 0 {
+		return HNSW_EF_LIMIT
+	}
+	return int(c.MaxEF)
+}
+
+// GetBM25 returns the term frequency saturation and document length normalization of keyword search.
+func (c Search) GetBM25() (k1 float64, b float64) {
+	k1, b = BM25_K1, BM25_B
+	if c.BM25K1 != nil && *c.BM25K1 >= 0 {
+		k1 = *c.BM25K1
+	}
+	if c.BM25B != nil && *c.BM25B >= 0 && *c.BM25B <= 1 {
+		b = *c.BM25B
+	}
+	return k1, b
+}
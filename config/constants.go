@@ -2,18 +2,134 @@ package config
 
 import "time"
 
+// Batching of database reads and cache loads.
 const (
 	BATCH_SIZE_DATABASE = 1_000
 	BATCH_SIZE_CACHE    = 10_000
-	CENTROID_SIZE       = 10_000
+)
 
+// Centroid training, a centroid is split once it holds more than CENTROID_SIZE embeddings.
+const (
+	CENTROID_SIZE           = 10_000
 	SAMPLE_SIZE             = 5 * BATCH_SIZE_CACHE
 	SPLIT_SIZE              = 5
 	SUPERSET_MUL            = 5
 	KMEANS_ITTERATION_LIMIT = 1_000
+)
+
+// Keyword search, the BM25 parameters are the defaults of the search configuration.
+const (
+	KEYWORD_MAX_LENGTH = 64
+	BM25_K1            = 1.2
+	BM25_B             = 0.75
+	RRF_K              = 60
+	FUSION_CANDIDATES  = 50
+)
+
+// Search page size, the default of the search configuration.
+const (
+	SEARCH_MAX_COUNT = 20
+)
+
+// Adaptive probing, the defaults of the search configuration.
+const (
+	PROBE_CANDIDATES = 1_000
+	PROBE_MARGIN     = 0.05
+	PROBE_LIMIT      = 16
+)
+
+// HNSW graphs, the search candidate list sizes and memory budget are the defaults of the configuration.
+const (
+	HNSW_M               = 16
+	HNSW_EF_CONSTRUCTION = 200
+	HNSW_EF_SEARCH       = 64
+	HNSW_EF_LIMIT        = 1_000
+	HNSW_WRITE_ATTEMPTS  = 3
+	HNSW_MEMORY_MB       = 1_024
+)
 
+// Product quantization codebook training and rescoring.
+const (
+	PQ_SUBVECTOR     = 8
+	PQ_SAMPLE_SIZE   = BATCH_SIZE_CACHE
+	PQ_ITERATIONS    = 20
+	PQ_RESCORE       = 100
+	PQ_RESCORE_LIMIT = 1_000
+)
+
+// Binary sign bit prefilter.
+const (
+	PREFILTER_CANDIDATES = 500
+	PREFILTER_LIMIT      = 10_000
+)
+
+// Search request limits and centroid radius pruning.
+const (
+	CHUNK_LIMIT  = 10
+	WINDOW_LIMIT = 5
+	RANGE_LIMIT  = 1_000
+	PRUNE_MARGIN = 0.01
+)
+
+// Maximal marginal relevance diversification.
+const (
+	MMR_CANDIDATES = 50
+)
+
+// Chunk score aggregation into document scores.
+const (
+	AGGREGATE_CANDIDATES = 100
+	AGGREGATE_CHUNKS     = 20
+	AGGREGATE_TOP_K      = 3
+	AGGREGATE_SATURATION = 1
+	AGGREGATE_THRESHOLD  = 0.5
+)
+
+// Search by positive and negative example documents.
+const (
+	EXAMPLE_LIMIT   = 20
+	POSITIVE_WEIGHT = 0.75
+	NEGATIVE_WEIGHT = 0.15
+)
+
+// Score boosts, searches collect a deeper candidate list for boosts to lift documents from.
+const (
+	SCORE_CANDIDATES = 100
+)
+
+// Reranking by the generate model.
+const (
+	RERANK_CANDIDATES    = 20
+	RERANK_LIMIT         = 50
+	RERANK_PASSAGE_WORDS = 200
+	RERANK_TIMEOUT       = 10 * time.Second
+)
+
+// Query expansion by the generate model.
+const (
+	EXPAND_QUERIES = 3
+	EXPAND_LIMIT   = 5
+	EXPAND_TIMEOUT = 10 * time.Second
+)
+
+// Question answering over the retrieved documents.
+const (
+	ASK_DOCUMENTS = 5
+	ASK_CHUNKS    = 3
+)
+
+// Batch search.
+const (
+	BATCH_QUERY_LIMIT = 1_000
+)
+
+// Local cache expiry, also the staleness other processes tolerate.
+const (
 	CACHE_DURATION = 5 * time.Second
 	CACHE_CLEANUP  = 15 * time.Second
+)
 
+// AI provider HTTP clients are replaced after serving this many requests.
+const (
 	HTTP_CLIENT_MAX_REQUESTS uint64 = 500
 )
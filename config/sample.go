@@ -10,6 +10,7 @@ import (
 
 // CreateSample creates a sample configuration file.
 func CreateSample(path string) error {
+	probeMargin, bm25K1, bm25B := float32(PROBE_MARGIN), float64(BM25_K1), float64(BM25_B)
 	sample := Config{
 		Server: ConfigServer{
 			HttpAddress:  ":7500",
@@ -47,6 +48,16 @@ func CreateSample(path string) error {
 			Cache:    "./vectorcache",
 			LogLevel: LogLevelError,
 		},
+		Search: Search{
+			MaxCount:        SEARCH_MAX_COUNT,
+			MaxProbe:        PROBE_LIMIT,
+			ProbeCandidates: PROBE_CANDIDATES,
+			ProbeMargin:     &probeMargin,
+			EF:              HNSW_EF_SEARCH,
+			MaxEF:           HNSW_EF_LIMIT,
+			BM25K1:          &bm25K1,
+			BM25B:           &bm25B,
+		},
 		LogLevel: LogLevelInfo,
 	}
 	raw, err := json.MarshalIndent(sample, "", "    ")
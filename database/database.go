@@ -74,12 +74,26 @@ func New(appCtx context.Context, cfg config.Database) (db *Database, err error)
 		sqldb.SetMaxIdleConns(5)
 		sqldb.SetMaxOpenConns(10)
 	}
+	if godb.Migrator().HasTable(&Keyword{}) && !godb.Migrator().HasIndex(&Keyword{}, "uq_keyword_document") {
+		// keywords indexed twice by concurrent backfills would block the unique index
+		err = godb.Clauses(dbresolver.Write).Exec("DELETE FROM keywords WHERE id NOT IN (SELECT MIN(id) FROM keywords GROUP BY document_id, term)").Error
+		if err != nil {
+			logger.Sugar().Errorf("failed to remove duplicate keywords: %v", err)
+		}
+	}
 	godb.Clauses(dbresolver.Write).AutoMigrate(
 		&Owner{},
 		&Category{},
 		&Centroid{},
 		&Document{},
 		&Embedding{},
+		&GraphNode{},
+		&Codebook{},
+		&Calibration{},
+		&IndexVersion{},
+		&GraphVersion{},
+		&Attribute{},
+		&Keyword{},
 	)
 
 	// add resolver connections
@@ -7,35 +7,79 @@ import (
 )
 
 type Embedding struct {
-	ID     uint64 `gorm:"primarykey"`
-	Vector []byte `gorm:"not null"`
+	ID      uint64 `gorm:"primarykey"`
+	Vector  []byte `gorm:"not null"`
+	Ordinal uint32 `gorm:"not null;default:0"`
+	Text    TextField
+	// Code is the product quantization code of the vector in ivf_pq categories
+	Code []byte
+	// Bits holds the sign of each dimension of the vector in categories with the binary prefilter
+	Bits []byte
 
 	// Parent
 	DocumentID uint64    `gorm:"index:idx_embedding_document;not null"`
 	Document   *Document `gorm:"foreignKey:DocumentID"`
 	CentroidID uint64    `gorm:"index:idx_embedding_centroid;not null"`
 	Centroid   *Centroid `gorm:"foreignKey:CentroidID"`
+
+	// Children
+	GraphNode *GraphNode `gorm:"foreignKey:EmbeddingID;constraint:onUpdate:CASCADE,onDelete:CASCADE"`
+}
+
+// GraphNode stores the HNSW neighbours of an embedding in each layer.
+type GraphNode struct {
+	EmbeddingID uint64 `gorm:"primarykey;autoIncrement:false"`
+	Neighbors   []byte `gorm:"not null"`
+
+	// Parent
+	CategoryID uint64    `gorm:"index:idx_graph_node_category;not null"`
+	Category   *Category `gorm:"foreignKey:CategoryID"`
 }
 
 type Document struct {
 	ID          uint64        `gorm:"primarykey"`
 	Name        string        `gorm:"not null"`
-	ExternalID  string        `gorm:"not null"`
+	ExternalID  string        `gorm:"index:idx_document_external,priority:2;not null"`
 	LastUpdated time.Time     `gorm:"index:idx_document_updated;not null"`
 	Document    DocumentField `gorm:"not null"`
+	Length      uint32        `gorm:"not null;default:0"`
 
 	// Parent
-	CategoryID uint64    `gorm:"not null"`
+	CategoryID uint64    `gorm:"index:idx_document_external,priority:1;not null"`
 	Category   *Category `gorm:"foreignKey:CategoryID"`
 
 	// Children
 	Embeddings []*Embedding `gorm:"foreignKey:DocumentID;constraint:onUpdate:CASCADE,onDelete:CASCADE"`
+	Attributes []*Attribute `gorm:"foreignKey:DocumentID;constraint:onUpdate:CASCADE,onDelete:CASCADE"`
+	Keywords   []*Keyword   `gorm:"foreignKey:DocumentID;constraint:onUpdate:CASCADE,onDelete:CASCADE"`
+}
+
+type Keyword struct {
+	ID        uint64 `gorm:"primarykey"`
+	Term      string `gorm:"index:idx_keyword_term,priority:2;uniqueIndex:uq_keyword_document,priority:2;not null"`
+	Frequency uint32 `gorm:"not null"`
+
+	// Parent
+	CategoryID uint64    `gorm:"index:idx_keyword_term,priority:1;not null"`
+	DocumentID uint64    `gorm:"uniqueIndex:uq_keyword_document,priority:1;not null"`
+	Document   *Document `gorm:"foreignKey:DocumentID"`
+}
+
+type Attribute struct {
+	ID    uint64 `gorm:"primarykey"`
+	Field string `gorm:"index:idx_attribute_document,priority:2;not null"`
+	Value []byte `gorm:"not null"`
+
+	// Parent
+	DocumentID uint64    `gorm:"index:idx_attribute_document,priority:1;not null"`
+	Document   *Document `gorm:"foreignKey:DocumentID"`
 }
 
 type Centroid struct {
-	ID          uint64    `gorm:"primarykey"`
-	Vector      []byte    `gorm:"not null"`
-	LastUpdated time.Time `gorm:"index:idx_centroid_updated;not null"`
+	ID            uint64    `gorm:"primarykey"`
+	Vector        []byte    `gorm:"not null"`
+	MinSimilarity float32   `gorm:"not null;default:-1"`
+	LastUpdated   time.Time `gorm:"index:idx_centroid_updated;not null"`
 
 	// Parent
 	CategoryID uint64    `gorm:"index:idx_centroid_category;not null"`
@@ -46,16 +90,71 @@ type Centroid struct {
 }
 
 type Category struct {
-	ID   uint64 `gorm:"primarykey"`
-	Name string `gorm:"uniqueIndex:uq_category_name;not null"`
+	ID              uint64 `gorm:"primarykey"`
+	Name            string `gorm:"uniqueIndex:uq_category_name;not null"`
+	IndexedFields   StringList
+	Aggregation     Aggregation
+	IndexType       IndexType    `gorm:"not null;default:'ivf'"`
+	BinaryPrefilter bool         `gorm:"not null;default:false"`
+	Quantization    Quantization `gorm:"not null;default:'minmax'"`
 
 	// Parent
 	OwnerID uint64 `gorm:"uniqueIndex:uq_category_name;not null"`
 	Owner   *Owner `gorm:"foreignKey:OwnerID"`
 
 	// Children
-	Centroids []*Centroid `gorm:"foreignKey:CategoryID;constraint:onUpdate:CASCADE,onDelete:CASCADE"`
-	Documents []*Document `gorm:"foreignKey:CategoryID;constraint:onUpdate:CASCADE,onDelete:CASCADE"`
+	Centroids    []*Centroid    `gorm:"foreignKey:CategoryID;constraint:onUpdate:CASCADE,onDelete:CASCADE"`
+	Documents    []*Document    `gorm:"foreignKey:CategoryID;constraint:onUpdate:CASCADE,onDelete:CASCADE"`
+	GraphNodes   []*GraphNode   `gorm:"foreignKey:CategoryID;constraint:onUpdate:CASCADE,onDelete:CASCADE"`
+	Codebook     *Codebook      `gorm:"foreignKey:CategoryID;constraint:onUpdate:CASCADE,onDelete:CASCADE"`
+	Calibrations []*Calibration `gorm:"foreignKey:CategoryID;constraint:onUpdate:CASCADE,onDelete:CASCADE"`
+	IndexVersion *IndexVersion  `gorm:"foreignKey:CategoryID;constraint:onUpdate:CASCADE,onDelete:CASCADE"`
+	GraphVersion *GraphVersion  `gorm:"foreignKey:CategoryID;constraint:onUpdate:CASCADE,onDelete:CASCADE"`
+}
+
+// GraphVersion counts the saved changes of the HNSW graph of a category, processes restore their graph when it moved on.
+// It is kept apart from the category row, which stays locked while the centroids of the category are refreshed.
+type GraphVersion struct {
+	ID      uint64 `gorm:"primarykey"`
+	Version uint64 `gorm:"not null;default:0"`
+
+	// Parent
+	CategoryID uint64    `gorm:"uniqueIndex:uq_graph_version_category;not null"`
+	Category   *Category `gorm:"foreignKey:CategoryID"`
+}
+
+// IndexVersion counts the changes to the embeddings of a category, processes load their in-memory index again when it moved on.
+// It is kept apart from the category row, which stays locked while the centroids of the category are refreshed.
+type IndexVersion struct {
+	ID      uint64 `gorm:"primarykey"`
+	Version uint64 `gorm:"not null;default:0"`
+
+	// Parent
+	CategoryID uint64    `gorm:"uniqueIndex:uq_index_version_category;not null"`
+	Category   *Category `gorm:"foreignKey:CategoryID"`
+}
+
+// Calibration stores the per dimension offset and scale of calibrated vectors, vectors reference it by id in their header.
+// The latest calibration older than the cache duration is the one new vectors of the category are quantized with.
+type Calibration struct {
+	ID          uint32    `gorm:"primarykey"`
+	Data        []byte    `gorm:"not null"`
+	LastUpdated time.Time `gorm:"not null"`
+
+	// Parent
+	CategoryID uint64    `gorm:"index:idx_calibration_category;not null"`
+	Category   *Category `gorm:"foreignKey:CategoryID"`
+}
+
+// Codebook stores the product quantization sub-quantizers of a category.
+type Codebook struct {
+	ID          uint64    `gorm:"primarykey"`
+	Data        []byte    `gorm:"not null"`
+	LastUpdated time.Time `gorm:"not null"`
+
+	// Parent
+	CategoryID uint64    `gorm:"uniqueIndex:uq_codebook_category;not null"`
+	Category   *Category `gorm:"foreignKey:CategoryID"`
 }
 
 type Owner struct {
@@ -44,6 +44,151 @@ func (d DocumentField) Value() (driver.Value, error) {
 	return compress(raw), nil
 }
 
+// TextField stores text compressed.
+type TextField string
+
+// GormDataType sets the column type, implements schema.GormDataTypeInterface
+func (TextField) GormDataType() string {
+	return "bytes"
+}
+
+// Scan scan value into TextField, implements sql.Scanner interface
+func (t *TextField) Scan(value any) error {
+	if value == nil {
+		*t = ""
+		return nil
+	}
+	bytes, ok := value.([]byte)
+	if !ok {
+		return fmt.Errorf("failed to unmarshal TextField value: %v", value)
+	}
+	original, err := decompress(bytes)
+	if err != nil {
+		return fmt.Errorf("failed to decompress TextField value: %s", hex.EncodeToString(subSlice(bytes, 20)))
+	}
+	*t = TextField(original)
+	return nil
+}
+
+// Value return compressed value, implement driver.Valuer interface
+func (t TextField) Value() (driver.Value, error) {
+	if len(t) == 0 {
+		return nil, nil
+	}
+	return compress([]byte(t)), nil
+}
+
+// StringList stores a list of strings as a json array.
+type StringList []string
+
+// GormDataType sets the column type, implements schema.GormDataTypeInterface
+func (StringList) GormDataType() string {
+	return "string"
+}
+
+// Scan scan value into StringList, implements sql.Scanner interface
+func (l *StringList) Scan(value any) error {
+	var raw []byte
+	switch value := value.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case string:
+		raw = []byte(value)
+	case []byte:
+		raw = value
+	default:
+		return fmt.Errorf("failed to unmarshal StringList value: %v", value)
+	}
+	var list []string
+	err := json.Unmarshal(raw, &list)
+	*l = list
+	return err
+}
+
+// Value return json value, implement driver.Valuer interface
+func (l StringList) Value() (driver.Value, error) {
+	if len(l) == 0 {
+		return nil, nil
+	}
+	raw, err := json.Marshal([]string(l))
+	if err != nil {
+		return nil, err
+	}
+	return string(raw), nil
+}
+
+// IndexType selects the nearest neighbour index searched for a category.
+type IndexType string
+
+const (
+	IndexTypeIVF   IndexType = "ivf"
+	IndexTypeIVFPQ IndexType = "ivf_pq"
+	IndexTypeHNSW  IndexType = "hnsw"
+)
+
+// Quantization selects how the embedding vectors of a category are scaled to 1-byte.
+type Quantization string
+
+const (
+	QuantizationMinMax     Quantization = "minmax"
+	QuantizationCalibrated Quantization = "calibrated"
+)
+
+type AggregationMode string
+
+const (
+	AggregationMax          AggregationMode = "max"
+	AggregationMeanTopK     AggregationMode = "mean_top_k"
+	AggregationSaturatedSum AggregationMode = "saturated_sum"
+	AggregationCountAbove   AggregationMode = "count_above"
+)
+
+// Aggregation describes how chunk similarities are combined into a document score, stored as a json object.
+type Aggregation struct {
+	Mode       AggregationMode `json:"mode"`
+	TopK       uint            `json:"top_k,omitempty"`
+	Threshold  *float32        `json:"threshold,omitempty"`
+	Saturation float32         `json:"saturation,omitempty"`
+}
+
+// GormDataType sets the column type, implements schema.GormDataTypeInterface
+func (Aggregation) GormDataType() string {
+	return "string"
+}
+
+// Scan scan value into Aggregation, implements sql.Scanner interface
+func (a *Aggregation) Scan(value any) error {
+	var raw []byte
+	switch value := value.(type) {
+	case nil:
+		*a = Aggregation{}
+		return nil
+	case string:
+		raw = []byte(value)
+	case []byte:
+		raw = value
+	default:
+		return fmt.Errorf("failed to unmarshal Aggregation value: %v", value)
+	}
+	var aggregation Aggregation
+	err := json.Unmarshal(raw, &aggregation)
+	*a = aggregation
+	return err
+}
+
+// Value return json value, implement driver.Valuer interface
+func (a Aggregation) Value() (driver.Value, error) {
+	if a.Mode == "" {
+		return nil, nil
+	}
+	raw, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	return string(raw), nil
+}
+
 func subSlice[T any](list []T, max int) []T {
 	if len(list) > max {
 		return list[:max]
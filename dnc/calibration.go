@@ -0,0 +1,222 @@
+package dnc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/expki/go-vectorsearch/compute"
+	"github.com/expki/go-vectorsearch/config"
+	"github.com/expki/go-vectorsearch/database"
+	"github.com/expki/go-vectorsearch/logger"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+// loadCalibrations returns every calibration of the category by id
+func loadCalibrations(ctx context.Context, db *database.Database, categoryID uint64) (calibrations compute.Calibrations, err error) {
+	var stored []database.Calibration
+	err = db.WithContext(ctx).Clauses(dbresolver.Read).Where("category_id = ?", categoryID).Find(&stored).Error
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, err
+	} else {
+		return nil, errors.Join(errors.New("failed to get calibrations"), err)
+	}
+	calibrations = make(compute.Calibrations, len(stored))
+	for _, item := range stored {
+		var calibration compute.Calibration
+		err = calibration.UnmarshalBinary(item.Data)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("failed to decode calibration %d", item.ID), err)
+		}
+		calibrations[item.ID] = calibration
+	}
+	return calibrations, nil
+}
+
+// activeCalibration returns the calibration new vectors of the category are quantized with, ok is false while the category has none.
+// It is the latest calibration older than the cache duration, every server has it cached by then.
+func activeCalibration(ctx context.Context, db *database.Database, categoryID uint64) (id uint32, ok bool, err error) {
+	var stored []database.Calibration
+	err = db.WithContext(ctx).Clauses(dbresolver.Read).
+		Select("id").
+		Where("category_id = ? AND last_updated <= ?", categoryID, time.Now().Add(-config.CACHE_DURATION)).
+		Order("id DESC").
+		Limit(1).
+		Find(&stored).
+		Error
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return 0, false, err
+	} else {
+		return 0, false, errors.Join(errors.New("failed to get active calibration"), err)
+	}
+	if len(stored) == 0 {
+		return 0, false, nil
+	}
+	return stored[0].ID, true, nil
+}
+
+// calibrateCategory creates a calibration for a calibrated category whose latest calibration does not match its dimensions and adds it to the calibrations.
+// The calibration becomes active once every server has it cached, the refresh after that migrates the category to it.
+func calibrateCategory(ctx context.Context, multibar *mpb.Progress, db *database.Database, categoryID uint64, X func() *dataset, calibrations compute.Calibrations) (err error) {
+	var category database.Category
+	err = db.WithContext(ctx).Clauses(dbresolver.Read).Select("id", "quantization").Take(&category, categoryID).Error
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	} else {
+		return errors.Join(errors.New("failed to get category"), err)
+	}
+	if category.Quantization != database.QuantizationCalibrated {
+		return nil
+	}
+	data := X()
+	var latest uint32
+	for id := range calibrations {
+		latest = max(latest, id)
+	}
+	if calibration, ok := calibrations[latest]; ok && len(calibration.Offset) == data.vectorsize {
+		// vectors stay comparable while the calibration is kept
+		return nil
+	}
+
+	// calibrate on a sample of the category
+	logger.Sugar().Debugf("calibrating category: %d", categoryID)
+	samples := sample(multibar, 0, data.ReadRow, int(data.total), config.SAMPLE_SIZE)
+	data.Reset()
+	sampleMatrix, err := compute.DequantizeMatrixFloat32(samples)
+	if err != nil {
+		return errors.Join(errors.New("failed to decode calibration samples"), err)
+	}
+	calibration := compute.Calibrate(sampleMatrix)
+	encoded, err := calibration.MarshalBinary()
+	if err != nil {
+		return errors.Join(errors.New("failed to encode calibration"), err)
+	}
+	stored := database.Calibration{
+		Data:        encoded,
+		LastUpdated: time.Now(),
+		CategoryID:  categoryID,
+	}
+	err = db.WithContext(ctx).Clauses(dbresolver.Write).Create(&stored).Error
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	} else {
+		return errors.Join(errors.New("failed to save calibration"), err)
+	}
+	calibrations[stored.ID] = calibration
+	return nil
+}
+
+// migrateCategory quantizes the vectors of the category again when their encoding differs from the category quantization
+func migrateCategory(ctx context.Context, multibar *mpb.Progress, db *database.Database, categoryID uint64, calibrations compute.Calibrations) (err error) {
+	var category database.Category
+	err = db.WithContext(ctx).Clauses(dbresolver.Read).Select("id", "quantization").Take(&category, categoryID).Error
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	} else {
+		return errors.Join(errors.New("failed to get category"), err)
+	}
+	var target *uint32
+	var calibration compute.Calibration
+	if category.Quantization == database.QuantizationCalibrated {
+		id, ok, err := activeCalibration(ctx, db, categoryID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		target = &id
+		calibration, ok = calibrations[id]
+		if !ok {
+			return fmt.Errorf("calibration %d is not loaded", id)
+		}
+	} else if len(calibrations) == 0 {
+		// category was never calibrated
+		return nil
+	}
+
+	// progress bar
+	bar := multibar.AddBar(
+		0,
+		mpb.PrependDecorators(
+			decor.Name(fmt.Sprintf("Migrate category %d: ", categoryID)),
+			decor.CountersNoUnit("%d / %d"),
+		),
+		mpb.AppendDecorators(
+			decor.EwmaETA(decor.ET_STYLE_HHMMSS, 300),
+		),
+	)
+	defer bar.EnableTriggerComplete()
+	start := time.Now()
+	var embeddings []database.Embedding
+	err = db.WithContext(ctx).Clauses(dbresolver.Read).
+		Model(&database.Embedding{}).
+		Joins("INNER JOIN documents ON documents.id = embeddings.document_id").
+		Where("documents.category_id = ?", categoryID).
+		Select("embeddings.id as id, embeddings.vector as vector, embeddings.bits as bits").
+		FindInBatches(&embeddings, config.BATCH_SIZE_DATABASE, func(tx *gorm.DB, batch int) error {
+			migrated := make([]database.Embedding, 0, len(embeddings))
+			for _, embedding := range embeddings {
+				id, calibrated := compute.CalibrationID(embedding.Vector)
+				if (target == nil && !calibrated) || (target != nil && calibrated && id == *target) {
+					continue
+				}
+				vector, err := calibrations.DequantizeVectorFloat32(embedding.Vector)
+				if err != nil {
+					return err
+				}
+				if target != nil && len(vector) != len(calibration.Offset) {
+					// calibration of other dimensions, the category is calibrated again on this refresh
+					continue
+				}
+				if target == nil {
+					embedding.Vector = compute.QuantizeVectorFloat32(vector)
+				} else {
+					embedding.Vector = compute.QuantizeVectorCalibrated(vector, *target, calibration)
+				}
+				if len(embedding.Bits) > 0 {
+					embedding.Bits = compute.BinaryQuantize(vector)
+				}
+				migrated = append(migrated, embedding)
+			}
+			if len(migrated) > 0 {
+				err := db.WithContext(ctx).Clauses(dbresolver.Write).Transaction(func(tx *gorm.DB) error {
+					for _, embedding := range migrated {
+						err := tx.Model(&database.Embedding{}).Where("id = ?", embedding.ID).Updates(map[string]any{
+							"vector": embedding.Vector,
+							"bits":   embedding.Bits,
+						}).Error
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			now := time.Now()
+			bar.EwmaIncrBy(len(embeddings), now.Sub(start))
+			start = now
+			return nil
+		}).
+		Error
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	} else {
+		return errors.Join(errors.New("failed to migrate embeddings"), err)
+	}
+	return nil
+}
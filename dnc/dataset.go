@@ -91,12 +91,13 @@ func (c *createDataset) Finalize(multibar *mpb.Progress, id uint64) (initialize
 		X.Reset()
 
 		// set centroid vector
-		X.centroid = kMeans(
-			multibar,
-			id,
-			sample(multibar, id, X.ReadRow, int(X.total), config.SAMPLE_SIZE),
-			1,
-		)[0]
+		samples := sample(multibar, id, X.ReadRow, int(X.total), config.SAMPLE_SIZE)
+		centroids, err := kMeans(multibar, id, samples, 1)
+		if err != nil {
+			logger.Sugar().Errorf("dataset centroid: %v", err)
+			centroids = samples
+		}
+		X.centroid = centroids[0]
 
 		// move reader to start
 		X.Reset()
@@ -61,8 +61,17 @@ func KMeansDivideAndConquer(ctx context.Context, db *database.Database, category
 		return errors.Join(errors.New("failed to get embedding"), err)
 	}
 
+	// get category calibrations
+	calibrations, err := loadCalibrations(ctx, db, categoryID)
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	} else {
+		return errors.Join(errors.New("failed to get calibrations"), err)
+	}
+
 	// create dataset writer
-	dataWriter, err := newDataset(&atomic.Int64{}, len(compute.DequantizeVectorFloat32(embedding.Vector)), folderPath)
+	dataWriter, err := newDataset(&atomic.Int64{}, len(embedding.Vector)-8, folderPath)
 	if err != nil {
 		return errors.Join(errors.New("failed to create file writer"), err)
 	}
@@ -97,6 +106,14 @@ func KMeansDivideAndConquer(ctx context.Context, db *database.Database, category
 		Select("embeddings.id as id, embeddings.vector as vector").
 		FindInBatches(&results, config.BATCH_SIZE_DATABASE, func(tx *gorm.DB, batch int) (err error) {
 			for _, item := range results {
+				if _, ok := compute.CalibrationID(item.Vector); ok {
+					// the dataset holds min/max vectors so clustering reads every row alike
+					vector, err := calibrations.DequantizeVectorFloat32(item.Vector)
+					if err != nil {
+						return err
+					}
+					item.Vector = compute.QuantizeVectorFloat32(vector)
+				}
 				dataWriter.WriteRow(item.Vector)
 			}
 			now := time.Now()
@@ -120,6 +137,29 @@ func KMeansDivideAndConquer(ctx context.Context, db *database.Database, category
 	// divide and conquer
 	logger.Sugar().Debug("Starting Divide and Conquer")
 	X := dataWriter.Finalize(multibar, 0)
+
+	// train product quantization codebook
+	err = trainCategoryCodebook(ctx, multibar, db, categoryID, X)
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		X().Close()
+		return err
+	} else {
+		X().Close()
+		return errors.Join(errors.New("failed to train codebook"), err)
+	}
+
+	// calibrate per dimension quantization
+	err = calibrateCategory(ctx, multibar, db, categoryID, X, calibrations)
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		X().Close()
+		return err
+	} else {
+		X().Close()
+		return errors.Join(errors.New("failed to calibrate category"), err)
+	}
+
 	Y := make(chan []uint8)
 	instance := &atomic.Uint64{}
 	concurrent := &atomic.Int64{}
@@ -155,6 +195,7 @@ func KMeansDivideAndConquer(ctx context.Context, db *database.Database, category
 			})
 		}
 		dbCentroids[idx].Vector = centroid
+		dbCentroids[idx].MinSimilarity = -1
 	}
 	err = db.WithContext(ctx).Clauses(dbresolver.Write).
 		Omit(clause.Associations).
@@ -170,7 +211,10 @@ func KMeansDivideAndConquer(ctx context.Context, db *database.Database, category
 	// compute
 	calculate, done := compute.MatrixCosineSimilarity()
 	defer done()
-	centroidMatrix := compute.NewMatrix(centroids)
+	centroidMatrix, err := compute.NewMatrix(centroids)
+	if err != nil {
+		return errors.Join(errors.New("failed to decode centroids"), err)
+	}
 
 	// re-assing to new centroids
 	logger.Sugar().Debug("Re-assigning embeddings to updated centroids")
@@ -202,7 +246,10 @@ func KMeansDivideAndConquer(ctx context.Context, db *database.Database, category
 			for idx, embedding := range updates {
 				data[idx] = embedding.Vector
 			}
-			dataMatrix := compute.NewMatrix(data)
+			dataMatrix, err := calibrations.NewMatrix(data)
+			if err != nil {
+				return err
+			}
 			_, centroidIndexes := calculate(centroidMatrix.Clone(), dataMatrix)
 
 			// group embeddings by nearest centroids
@@ -263,7 +310,7 @@ func KMeansDivideAndConquer(ctx context.Context, db *database.Database, category
 	}
 
 	// drop small
-	err = dropSmallCentroids(ctx, multibar, db)
+	err = dropSmallCentroids(ctx, multibar, db, categoryID, calibrations)
 	if err == nil {
 	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
 		return err
@@ -281,7 +328,7 @@ func KMeansDivideAndConquer(ctx context.Context, db *database.Database, category
 		}
 		wg.Add(1)
 		go func() {
-			err = recenterDbCentroid(ctx, multibar, db, dbCentroid)
+			err = recenterDbCentroid(ctx, multibar, db, dbCentroid, calibrations)
 			if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, os.ErrDeadlineExceeded) {
 				logger.Sugar().Errorf("recenter db centroids: %s", err.Error())
 			}
@@ -291,6 +338,25 @@ func KMeansDivideAndConquer(ctx context.Context, db *database.Database, category
 	}
 
 	wg.Wait()
+
+	// quantize embeddings again with the category quantization
+	err = migrateCategory(ctx, multibar, db, categoryID, calibrations)
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	} else {
+		return errors.Join(errors.New("failed to migrate embeddings"), err)
+	}
+
+	// encode embeddings without product quantization codes
+	err = encodeCategory(ctx, multibar, db, categoryID, calibrations)
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	} else {
+		return errors.Join(errors.New("failed to encode embeddings"), err)
+	}
+
 	multibar.Wait()
 	logger.Sugar().Infof("Refresh centroids completed (%d)", instance.Load())
 	return nil
@@ -321,7 +387,7 @@ func divideNconquer(ctx context.Context, multibar *mpb.Progress, concurrent *ato
 	X.Reset()
 
 	// create centroids
-	centroids := kMeans(
+	centroids, err := kMeans(
 		multibar,
 		id,
 		data,
@@ -333,11 +399,20 @@ func divideNconquer(ctx context.Context, multibar *mpb.Progress, concurrent *ato
 			),
 		),
 	)
-	centroidsMatrix := compute.NewMatrix(centroids)
+	if err != nil {
+		logger.Sugar().Errorf("split centroids: %v", err)
+		Y <- X.centroid
+		return
+	}
+	centroidsMatrix, err := compute.NewMatrix(centroids)
+	if err != nil {
+		logger.Sugar().Errorf("split centroids: %v", err)
+		Y <- X.centroid
+		return
+	}
 
 	// create dataset writers
 	dataWriterList := make([]*createDataset, len(centroids))
-	var err error
 	for idx := range len(centroids) {
 		dataWriterList[idx], err = newDataset(concurrent, X.vectorsize, X.folderpath)
 		if err != nil {
@@ -370,7 +445,14 @@ func divideNconquer(ctx context.Context, multibar *mpb.Progress, concurrent *ato
 		if len(minibatch) < config.BATCH_SIZE_CACHE {
 			continue
 		}
-		dataMatrix := compute.NewMatrix(minibatch)
+		dataMatrix, err := compute.NewMatrix(minibatch)
+		if err != nil {
+			// rows that fail to decode are left out of the split
+			logger.Sugar().Errorf("split embeddings: %v", err)
+			bar.IncrBy(len(minibatch))
+			minibatch = make([][]uint8, 0, config.BATCH_SIZE_CACHE)
+			continue
+		}
 		_, idxList := cosineSim(centroidsMatrix.Clone(), dataMatrix)
 		for idx, nearestCentroidIdx := range idxList {
 			dataWriterList[nearestCentroidIdx].WriteRow(minibatch[idx])
@@ -380,12 +462,18 @@ func divideNconquer(ctx context.Context, multibar *mpb.Progress, concurrent *ato
 	}
 
 	if len(minibatch) > 0 {
-		dataMatrix := compute.NewMatrix(minibatch)
-		_, idxList := cosineSim(centroidsMatrix.Clone(), dataMatrix)
-		for idx, nearestCentroidIdx := range idxList {
-			dataWriterList[nearestCentroidIdx].WriteRow(minibatch[idx])
+		dataMatrix, err := compute.NewMatrix(minibatch)
+		if err != nil {
+			// rows that fail to decode are left out of the split
+			logger.Sugar().Errorf("split embeddings: %v", err)
+			bar.IncrBy(len(minibatch))
+		} else {
+			_, idxList := cosineSim(centroidsMatrix.Clone(), dataMatrix)
+			for idx, nearestCentroidIdx := range idxList {
+				dataWriterList[nearestCentroidIdx].WriteRow(minibatch[idx])
+			}
+			bar.IncrBy(len(idxList))
 		}
-		bar.IncrBy(len(idxList))
 	}
 	bar.EnableTriggerComplete()
 
@@ -399,7 +487,7 @@ func divideNconquer(ctx context.Context, multibar *mpb.Progress, concurrent *ato
 	return
 }
 
-func recenterDbCentroid(ctx context.Context, multibar *mpb.Progress, db *database.Database, centroid database.Centroid) (err error) {
+func recenterDbCentroid(ctx context.Context, multibar *mpb.Progress, db *database.Database, centroid database.Centroid, calibrations compute.Calibrations) (err error) {
 	// progress bar
 	bar := multibar.AddBar(
 		0,
@@ -414,7 +502,11 @@ func recenterDbCentroid(ctx context.Context, multibar *mpb.Progress, db *databas
 	defer bar.EnableTriggerComplete()
 
 	// load centroid embeddings
-	dataSum := make([]float64, len(compute.DequantizeVectorFloat64(centroid.Vector)))
+	centroidVector, err := compute.DequantizeVectorFloat64(centroid.Vector)
+	if err != nil {
+		return errors.Join(errors.New("failed to decode centroid"), err)
+	}
+	dataSum := make([]float64, len(centroidVector))
 	var count uint64 = 0
 	var embeddings []database.Embedding
 	err = db.WithContext(ctx).Clauses(dbresolver.Read).
@@ -426,7 +518,11 @@ func recenterDbCentroid(ctx context.Context, multibar *mpb.Progress, db *databas
 				return nil
 			}
 			for _, embedding := range embeddings {
-				for idx, val := range compute.DequantizeVectorFloat64(embedding.Vector) {
+				vector, err := calibrations.DequantizeVectorFloat64(embedding.Vector)
+				if err != nil {
+					return err
+				}
+				for idx, val := range vector {
 					dataSum[idx] += val
 				}
 				count++
@@ -448,14 +544,50 @@ func recenterDbCentroid(ctx context.Context, multibar *mpb.Progress, db *databas
 	}
 	meanVector := compute.QuantizeVectorFloat64(dataSum)
 
+	// calculate radius
+	minSimilarity := float32(1)
+	if count == 0 {
+		minSimilarity = -1
+	}
+	target, err := compute.NewVector(meanVector)
+	if err != nil {
+		return errors.Join(errors.New("failed to decode centroid"), err)
+	}
+	err = db.WithContext(ctx).Clauses(dbresolver.Read).
+		Where("centroid_id = ?", centroid.ID).
+		Select("id", "vector").
+		FindInBatches(&embeddings, config.BATCH_SIZE_DATABASE, func(tx *gorm.DB, batch int) error {
+			if len(embeddings) == 0 {
+				return nil
+			}
+			data := make([][]uint8, len(embeddings))
+			for idx, embedding := range embeddings {
+				data[idx] = embedding.Vector
+			}
+			dataMatrix, err := calibrations.NewMatrix(data)
+			if err != nil {
+				return err
+			}
+			minSimilarity = min(minSimilarity, slices.Min(target.Clone().MatrixCosineSimilarity(dataMatrix)))
+			return nil
+		}).
+		Error
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	} else {
+		return errors.Join(errors.New("failed to read database embeddings"), err)
+	}
+
 	// update centroid vector
 	centroid.Vector = meanVector
+	centroid.MinSimilarity = minSimilarity
 	return db.WithContext(ctx).Clauses(dbresolver.Write).
 		Save(&centroid).
 		Error
 }
 
-func dropSmallCentroids(ctx context.Context, multibar *mpb.Progress, db *database.Database) (err error) {
+func dropSmallCentroids(ctx context.Context, multibar *mpb.Progress, db *database.Database, categoryID uint64, calibrations compute.Calibrations) (err error) {
 	type result struct {
 		ID     uint64
 		Vector []byte
@@ -465,6 +597,7 @@ func dropSmallCentroids(ctx context.Context, multibar *mpb.Progress, db *databas
 	err = db.WithContext(ctx).Clauses(dbresolver.Read).
 		Model(&database.Centroid{}).
 		Joins("INNER JOIN embeddings ON embeddings.centroid_id = centroids.id").
+		Where("centroids.category_id = ?", categoryID).
 		Select("centroids.id", "centroids.vector", "COUNT(*) as total").
 		Group("centroids.id").Group("centroids.vector").
 		Find(&results).
@@ -493,7 +626,10 @@ func dropSmallCentroids(ctx context.Context, multibar *mpb.Progress, db *databas
 	for idx, item := range results {
 		centroids[idx] = item.Vector
 	}
-	centroidMatrix := compute.NewMatrix(centroids)
+	centroidMatrix, err := compute.NewMatrix(centroids)
+	if err != nil {
+		return errors.Join(errors.New("failed to decode centroids"), err)
+	}
 
 	// create new cosine similarity graph
 	cosineSim, closeGraph := compute.MatrixCosineSimilarity()
@@ -531,7 +667,10 @@ func dropSmallCentroids(ctx context.Context, multibar *mpb.Progress, db *databas
 					for idx, embedding := range embeddings {
 						data[idx] = embedding.Vector
 					}
-					dataMatrix := compute.NewMatrix(data)
+					dataMatrix, err := calibrations.NewMatrix(data)
+					if err != nil {
+						return err
+					}
 					updates := make(map[uint64][]uint64, len(centroids))
 					_, centroidIds := cosineSim(centroidMatrix.Clone(), dataMatrix)
 					for embeddingIdx, centroidId := range centroidIds {
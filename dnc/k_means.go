@@ -15,19 +15,22 @@ import (
 	"github.com/vbauerster/mpb/v8/decor"
 )
 
-// assign data to k centroids
-func kMeans(multibar *mpb.Progress, id uint64, data [][]uint8, k int) [][]uint8 {
+// assign data to k centroids, data holds min/max vectors
+func kMeans(multibar *mpb.Progress, id uint64, data [][]uint8, k int) ([][]uint8, error) {
 	if k <= 0 {
-		return nil
+		return nil, nil
 	}
 	dlen := len(data)
 	if dlen == 0 || dlen <= k {
-		return data
+		return data, nil
 	}
 
 	// Step 1: Initialize utilities
 	random := rand.New(rand.NewSource(time.Now().UnixNano()))
-	chunkedDataMatrix := chunkData(data, config.BATCH_SIZE_CACHE)
+	chunkedDataMatrix, err := chunkData(data, config.BATCH_SIZE_CACHE)
+	if err != nil {
+		return nil, err
+	}
 	cosineSim, closeGraph := compute.MatrixCosineSimilarity()
 	defer closeGraph()
 
@@ -67,7 +70,11 @@ func kMeans(multibar *mpb.Progress, id uint64, data [][]uint8, k int) [][]uint8
 	for n := 0; n < config.KMEANS_ITTERATION_LIMIT && !converged; n++ {
 		bar.Increment()
 		// Create centroid matrix
-		centroidMatrix := compute.NewMatrix(centroids)
+		centroidMatrix, err := compute.NewMatrix(centroids)
+		if err != nil {
+			bar.Abort(true)
+			return nil, err
+		}
 
 		// Find nearest centroid for each data point
 		centroidIndexes := make([]int, 0, len(centroids))
@@ -78,7 +85,11 @@ func kMeans(multibar *mpb.Progress, id uint64, data [][]uint8, k int) [][]uint8
 
 		// Accumulate vectors
 		for i, centroidIdx := range centroidIndexes {
-			vec := compute.DequantizeVectorFloat32(data[i])
+			vec, err := compute.DequantizeVectorFloat32(data[i])
+			if err != nil {
+				bar.Abort(true)
+				return nil, err
+			}
 			for j, val := range vec {
 				sumVectors[centroidIdx][j] += val
 			}
@@ -157,7 +168,11 @@ func kMeans(multibar *mpb.Progress, id uint64, data [][]uint8, k int) [][]uint8
 	for n := 0; n < config.KMEANS_ITTERATION_LIMIT && !converged; n++ {
 		bar.Increment()
 		// Create centroid matrix
-		centroidMatrix := compute.NewMatrix(centroids)
+		centroidMatrix, err := compute.NewMatrix(centroids)
+		if err != nil {
+			bar.Abort(true)
+			return nil, err
+		}
 
 		// Find nearest centroid for each data point
 		centroidIndexes := make([]int, 0, len(centroids))
@@ -168,7 +183,11 @@ func kMeans(multibar *mpb.Progress, id uint64, data [][]uint8, k int) [][]uint8
 
 		// Accumulate vectors
 		for i, centroidIdx := range centroidIndexes {
-			vec := compute.DequantizeVectorFloat32(data[i])
+			vec, err := compute.DequantizeVectorFloat32(data[i])
+			if err != nil {
+				bar.Abort(true)
+				return nil, err
+			}
 			for j, val := range vec {
 				sumVectors[centroidIdx][j] += val
 			}
@@ -208,14 +227,18 @@ func kMeans(multibar *mpb.Progress, id uint64, data [][]uint8, k int) [][]uint8
 	bar.EnableTriggerComplete()
 
 	// Step 7: Return converged set
-	return centroids
+	return centroids, nil
 }
 
-func chunkData(input [][]uint8, size int) []compute.Matrix {
+func chunkData(input [][]uint8, size int) ([]compute.Matrix, error) {
 	chunks := make([]compute.Matrix, 0, (len(input)/size)+1)
 	for i := 0; i < len(input); i += size {
 		end := min(i+size, len(input))
-		chunks = append(chunks, compute.NewMatrix(input[i:end]))
+		chunk, err := compute.NewMatrix(input[i:end])
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
 	}
-	return chunks
+	return chunks, nil
 }
@@ -0,0 +1,276 @@
+package dnc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/expki/go-vectorsearch/compute"
+	"github.com/expki/go-vectorsearch/config"
+	"github.com/expki/go-vectorsearch/database"
+	"github.com/expki/go-vectorsearch/logger"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/plugin/dbresolver"
+)
+
+// trainCodebook fits a sub-quantizer to each subspace of the unit length samples with euclidean k-means
+func trainCodebook(ctx context.Context, multibar *mpb.Progress, samples [][]uint8) (codebook compute.Codebook, err error) {
+	vectors := make([][]float32, len(samples))
+	for idx, sample := range samples {
+		vector, err := compute.DequantizeVectorFloat32(sample)
+		if err != nil {
+			return codebook, err
+		}
+		vectors[idx] = compute.Normalize(vector)
+	}
+	codebook = compute.NewCodebook(len(vectors[0]), config.PQ_SUBVECTOR)
+
+	// progress bar
+	bar := multibar.AddBar(
+		int64(codebook.Subspaces()),
+		mpb.PrependDecorators(
+			decor.Name("Train codebook: "),
+			decor.CountersNoUnit("%d / %d"),
+		),
+		mpb.BarRemoveOnComplete(),
+	)
+	defer bar.EnableTriggerComplete()
+
+	var wg sync.WaitGroup
+	for subspace := range codebook.Subspaces() {
+		queue <- struct{}{}
+		if ctx.Err() != nil {
+			<-queue
+			break
+		}
+		wg.Add(1)
+		go func() {
+			from, to := codebook.Bounds(subspace)
+			subvectors := make([][]float32, len(vectors))
+			for idx, vector := range vectors {
+				subvectors[idx] = vector[from:to]
+			}
+			for centroid, mean := range subspaceKMeans(subvectors, compute.ProductCentroids) {
+				copy(codebook.Centroid(subspace, centroid), mean)
+			}
+			bar.Increment()
+			<-queue
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	return codebook, nil
+}
+
+// subspaceKMeans assigns the sub vectors to k centroids by euclidean distance
+func subspaceKMeans(data [][]float32, k int) (centroids [][]float32) {
+	k = min(k, len(data))
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, idx := range random.Perm(len(data))[:k] {
+		centroids = append(centroids, append([]float32(nil), data[idx]...))
+	}
+	width := len(data[0])
+	assignments := make([]int, len(data))
+	for n := range config.PQ_ITERATIONS {
+		// assign to nearest centroid
+		changed := false
+		for idx, vector := range data {
+			nearest, best := 0, float32(math.MaxFloat32)
+			for centroidIdx, centroid := range centroids {
+				var distance float32
+				for dim, value := range centroid {
+					diff := vector[dim] - value
+					distance += diff * diff
+				}
+				if distance < best {
+					nearest, best = centroidIdx, distance
+				}
+			}
+			if n == 0 || assignments[idx] != nearest {
+				assignments[idx] = nearest
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+
+		// move centroids to the mean of their sub vectors
+		counts := make([]int, k)
+		for _, centroid := range centroids {
+			clear(centroid)
+		}
+		for idx, vector := range data {
+			counts[assignments[idx]]++
+			for dim, value := range vector {
+				centroids[assignments[idx]][dim] += value
+			}
+		}
+		for centroidIdx, centroid := range centroids {
+			if counts[centroidIdx] == 0 {
+				// reseed empty centroids
+				copy(centroid, data[random.Intn(len(data))])
+				continue
+			}
+			for dim := range width {
+				centroid[dim] /= float32(counts[centroidIdx])
+			}
+		}
+	}
+	return centroids
+}
+
+// trainCategoryCodebook trains and saves the codebook of an ivf_pq category that has none matching its dimensions
+func trainCategoryCodebook(ctx context.Context, multibar *mpb.Progress, db *database.Database, categoryID uint64, X func() *dataset) (err error) {
+	var category database.Category
+	err = db.WithContext(ctx).Clauses(dbresolver.Read).Select("id", "index_type").Take(&category, categoryID).Error
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	} else {
+		return errors.Join(errors.New("failed to get category"), err)
+	}
+	if category.IndexType != database.IndexTypeIVFPQ {
+		return nil
+	}
+	data := X()
+	var stored database.Codebook
+	err = db.WithContext(ctx).Clauses(dbresolver.Read).Where("category_id = ?", categoryID).Limit(1).Find(&stored).Error
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	} else {
+		return errors.Join(errors.New("failed to get codebook"), err)
+	}
+	if stored.ID != 0 {
+		var codebook compute.Codebook
+		if codebook.UnmarshalBinary(stored.Data) == nil && codebook.Dims == data.vectorsize {
+			// codes stay comparable while the codebook is kept
+			return nil
+		}
+	}
+
+	// train on a sample of the category
+	logger.Sugar().Debugf("training codebook for category: %d", categoryID)
+	samples := sample(multibar, 0, data.ReadRow, int(data.total), config.PQ_SAMPLE_SIZE)
+	data.Reset()
+	codebook, err := trainCodebook(ctx, multibar, samples)
+	if err != nil {
+		return errors.Join(errors.New("failed to decode codebook samples"), err)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	encoded, err := codebook.MarshalBinary()
+	if err != nil {
+		return errors.Join(errors.New("failed to encode codebook"), err)
+	}
+	return db.WithContext(ctx).Clauses(dbresolver.Write).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "category_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"data", "last_updated"}),
+		}).Create(&database.Codebook{
+			Data:        encoded,
+			LastUpdated: time.Now(),
+			CategoryID:  categoryID,
+		}).Error
+		if err != nil {
+			return errors.Join(errors.New("failed to save codebook"), err)
+		}
+		// codes of the previous codebook are encoded again
+		err = tx.Model(&database.Embedding{}).
+			Where("document_id IN (?)", tx.Model(&database.Document{}).Select("id").Where("category_id = ?", categoryID)).
+			Update("code", nil).
+			Error
+		if err != nil {
+			return errors.Join(errors.New("failed to clear embedding codes"), err)
+		}
+		return nil
+	})
+}
+
+// encodeCategory stores the product quantization code of each embedding of the category without one
+func encodeCategory(ctx context.Context, multibar *mpb.Progress, db *database.Database, categoryID uint64, calibrations compute.Calibrations) (err error) {
+	var stored database.Codebook
+	err = db.WithContext(ctx).Clauses(dbresolver.Read).Where("category_id = ?", categoryID).Limit(1).Find(&stored).Error
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	} else {
+		return errors.Join(errors.New("failed to get codebook"), err)
+	}
+	if stored.ID == 0 {
+		return nil
+	}
+	var codebook compute.Codebook
+	err = codebook.UnmarshalBinary(stored.Data)
+	if err != nil {
+		return errors.Join(errors.New("failed to decode codebook"), err)
+	}
+
+	// progress bar
+	bar := multibar.AddBar(
+		0,
+		mpb.PrependDecorators(
+			decor.Name(fmt.Sprintf("Encode category %d: ", categoryID)),
+			decor.CountersNoUnit("%d / %d"),
+		),
+		mpb.AppendDecorators(
+			decor.EwmaETA(decor.ET_STYLE_HHMMSS, 300),
+		),
+	)
+	defer bar.EnableTriggerComplete()
+	start := time.Now()
+	var embeddings []database.Embedding
+	err = db.WithContext(ctx).Clauses(dbresolver.Read).
+		Model(&database.Embedding{}).
+		Joins("INNER JOIN documents ON documents.id = embeddings.document_id").
+		Where("documents.category_id = ? AND embeddings.code IS NULL", categoryID).
+		Select("embeddings.id as id, embeddings.vector as vector").
+		FindInBatches(&embeddings, config.BATCH_SIZE_DATABASE, func(tx *gorm.DB, batch int) error {
+			codes := make([][]uint8, len(embeddings))
+			for idx, embedding := range embeddings {
+				vector, err := calibrations.DequantizeVectorFloat32(embedding.Vector)
+				if err != nil {
+					return err
+				}
+				codes[idx] = codebook.Encode(vector)
+			}
+			err := db.WithContext(ctx).Clauses(dbresolver.Write).Transaction(func(tx *gorm.DB) error {
+				for idx, embedding := range embeddings {
+					if codes[idx] == nil {
+						// dimensions differ from the codebook
+						continue
+					}
+					err := tx.Model(&database.Embedding{}).Where("id = ?", embedding.ID).Update("code", codes[idx]).Error
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			now := time.Now()
+			bar.EwmaIncrBy(len(embeddings), now.Sub(start))
+			start = now
+			return nil
+		}).
+		Error
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	} else {
+		return errors.Join(errors.New("failed to encode embeddings"), err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package hnsw
+
+import (
+	"encoding/binary"
+	"errors"
+
+	_ "github.com/expki/go-vectorsearch/env"
+)
+
+// EncodeNeighbors serializes the neighbour ids of each layer as varints prefixed with the layer length.
+func EncodeNeighbors(neighbors [][]uint64) (raw []byte) {
+	raw = binary.AppendUvarint(raw, uint64(len(neighbors)))
+	for _, ids := range neighbors {
+		raw = binary.AppendUvarint(raw, uint64(len(ids)))
+		for _, id := range ids {
+			raw = binary.AppendUvarint(raw, id)
+		}
+	}
+	return raw
+}
+
+// DecodeNeighbors parses neighbour ids serialized by EncodeNeighbors.
+func DecodeNeighbors(raw []byte) (neighbors [][]uint64, err error) {
+	next := func() (value uint64, err error) {
+		value, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return 0, errors.New("malformed neighbour list")
+		}
+		raw = raw[n:]
+		return value, nil
+	}
+	layers, err := next()
+	if err != nil {
+		return nil, err
+	}
+	neighbors = make([][]uint64, 0, min(layers, 64))
+	for range layers {
+		count, err := next()
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]uint64, 0, min(count, uint64(len(raw))))
+		for range count {
+			id, err := next()
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		neighbors = append(neighbors, ids)
+	}
+	return neighbors, nil
+}
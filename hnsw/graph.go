@@ -0,0 +1,418 @@
+package hnsw
+
+import (
+	"cmp"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+
+	"github.com/expki/go-vectorsearch/compute"
+	_ "github.com/expki/go-vectorsearch/env"
+)
+
+// New creates an empty graph where each node keeps m neighbours per layer and 2m on the bottom layer.
+func New(m int, efConstruction int) *Graph {
+	return &Graph{
+		m:              m,
+		efConstruction: efConstruction,
+		levelMult:      1 / math.Log(float64(m)),
+		nodes:          make(map[uint64]*node),
+	}
+}
+
+// Graph is a hierarchical navigable small world graph over normalized embeddings.
+type Graph struct {
+	m              int
+	efConstruction int
+	levelMult      float64
+
+	mutex sync.RWMutex
+	nodes map[uint64]*node
+	entry *node
+	// size is the estimated memory held by the nodes in bytes
+	size int64
+}
+
+type node struct {
+	id         uint64
+	documentID uint64
+	ordinal    uint32
+	vector     []float32
+	// neighbors holds the neighbour ids of each layer the node is part of
+	neighbors [][]uint64
+}
+
+// Result is an embedding found by a graph search.
+type Result struct {
+	ID         uint64
+	DocumentID uint64
+	Ordinal    uint32
+	Similarity float32
+	Vector     []uint8
+}
+
+type candidate struct {
+	node       *node
+	similarity float32
+}
+
+// Len returns the number of nodes in the graph.
+func (g *Graph) Len() int {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return len(g.nodes)
+}
+
+// Bytes returns the estimated memory held by the nodes of the graph.
+func (g *Graph) Bytes() int64 {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return g.size
+}
+
+// Dimensions returns the vector dimensions of the graph, zero when it is empty.
+func (g *Graph) Dimensions() int {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	if g.entry == nil {
+		return 0
+	}
+	return len(g.entry.vector)
+}
+
+// Contains reports whether the embedding is part of the graph.
+func (g *Graph) Contains(id uint64) bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	_, ok := g.nodes[id]
+	return ok
+}
+
+// Neighbors returns a copy of the neighbour ids of the embedding in each layer.
+func (g *Graph) Neighbors(id uint64) (neighbors [][]uint64) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	n, ok := g.nodes[id]
+	if !ok {
+		return nil
+	}
+	neighbors = make([][]uint64, len(n.neighbors))
+	for level, ids := range n.neighbors {
+		neighbors[level] = slices.Clone(ids)
+	}
+	return neighbors
+}
+
+// Insert links the embedding into the graph and returns the ids of the nodes whose neighbours changed, including the new node.
+func (g *Graph) Insert(id uint64, documentID uint64, ordinal uint32, vector []float32) (changed []uint64) {
+	vector = compute.Normalize(slices.Clone(vector))
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if _, ok := g.nodes[id]; ok {
+		return nil
+	}
+	level := int(math.Floor(-math.Log(1-rand.Float64()) * g.levelMult))
+	n := &node{
+		id:         id,
+		documentID: documentID,
+		ordinal:    ordinal,
+		vector:     vector,
+		neighbors:  make([][]uint64, level+1),
+	}
+	g.nodes[id] = n
+	g.size += g.nodeBytes(n)
+	changed = append(changed, id)
+	if g.entry == nil {
+		g.entry = n
+		return changed
+	}
+
+	// Descend to the layer of the new node
+	top := len(g.entry.neighbors) - 1
+	entryPoints := g.descend(vector, level)
+
+	// Connect on every shared layer
+	for layer := min(level, top); layer >= 0; layer-- {
+		candidates := g.searchLayer(vector, entryPoints, g.efConstruction, layer)
+		selected := g.selectNeighbors(candidates, g.m)
+		n.neighbors[layer] = make([]uint64, len(selected))
+		for idx, neighbor := range selected {
+			n.neighbors[layer][idx] = neighbor.node.id
+			neighbor.node.neighbors[layer] = append(neighbor.node.neighbors[layer], id)
+			if len(neighbor.node.neighbors[layer]) > g.maxNeighbors(layer) {
+				g.shrink(neighbor.node, layer)
+			}
+			changed = append(changed, neighbor.node.id)
+		}
+		entryPoints = candidates
+	}
+	if level > top {
+		g.entry = n
+	}
+	slices.Sort(changed)
+	return slices.Compact(changed)
+}
+
+// Restore adds a persisted node with its neighbours without searching the graph.
+func (g *Graph) Restore(id uint64, documentID uint64, ordinal uint32, vector []float32, neighbors [][]uint64) {
+	if len(neighbors) == 0 {
+		return
+	}
+	n := &node{
+		id:         id,
+		documentID: documentID,
+		ordinal:    ordinal,
+		vector:     compute.Normalize(slices.Clone(vector)),
+		neighbors:  neighbors,
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if previous, ok := g.nodes[id]; ok {
+		g.size -= g.nodeBytes(previous)
+	}
+	g.nodes[id] = n
+	g.size += g.nodeBytes(n)
+	if g.entry == nil || len(neighbors) > len(g.entry.neighbors) {
+		g.entry = n
+	}
+}
+
+// Remove deletes the embeddings of the documents and reconnects every node that links to a node missing from the graph.
+// It returns the ids of the removed nodes and of the nodes whose neighbours changed, nodes restored with links to deleted embeddings are repaired the same way.
+func (g *Graph) Remove(documentIDs []uint64) (changed []uint64) {
+	remove := make(map[uint64]struct{}, len(documentIDs))
+	for _, id := range documentIDs {
+		remove[id] = struct{}{}
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	removed := make(map[uint64]*node)
+	for id, n := range g.nodes {
+		if _, ok := remove[n.documentID]; ok {
+			removed[id] = n
+			delete(g.nodes, id)
+			g.size -= g.nodeBytes(n)
+			changed = append(changed, id)
+		}
+	}
+	if g.entry != nil && g.nodes[g.entry.id] == nil {
+		// promote the node with the most layers
+		g.entry = nil
+		for _, n := range g.nodes {
+			if g.entry == nil || len(n.neighbors) > len(g.entry.neighbors) || (len(n.neighbors) == len(g.entry.neighbors) && n.id < g.entry.id) {
+				g.entry = n
+			}
+		}
+	}
+	for _, n := range g.nodes {
+		repaired := false
+		for layer, ids := range n.neighbors {
+			if !slices.ContainsFunc(ids, g.missing) {
+				continue
+			}
+			// candidates are the remaining neighbours and the neighbours of removed neighbours
+			seen := map[uint64]struct{}{n.id: {}}
+			candidates := make([]candidate, 0, len(ids))
+			add := func(id uint64) {
+				if _, ok := seen[id]; ok {
+					return
+				}
+				seen[id] = struct{}{}
+				if neighbor, ok := g.nodes[id]; ok {
+					candidates = append(candidates, candidate{node: neighbor, similarity: dot(n.vector, neighbor.vector)})
+				}
+			}
+			for _, id := range ids {
+				add(id)
+				if gone, ok := removed[id]; ok && layer < len(gone.neighbors) {
+					for _, second := range gone.neighbors[layer] {
+						add(second)
+					}
+				}
+			}
+			if len(candidates) < g.m {
+				// too few links are left, search the layer like an insert
+				for _, item := range g.searchLayer(n.vector, g.descend(n.vector, layer), g.efConstruction, layer) {
+					add(item.node.id)
+				}
+			}
+			slices.SortFunc(candidates, compareCandidate)
+			selected := g.selectNeighbors(candidates, g.maxNeighbors(layer))
+			n.neighbors[layer] = make([]uint64, len(selected))
+			for idx, item := range selected {
+				n.neighbors[layer][idx] = item.node.id
+			}
+			repaired = true
+		}
+		if repaired {
+			changed = append(changed, n.id)
+		}
+	}
+	slices.Sort(changed)
+	return changed
+}
+
+// Search returns up to k embeddings closest to the target, ef bounds the candidates explored on the bottom layer.
+func (g *Graph) Search(target []float32, k int, ef int) (results []Result) {
+	target = compute.Normalize(slices.Clone(target))
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	if g.entry == nil || len(g.entry.vector) != len(target) {
+		return nil
+	}
+	candidates := g.searchLayer(target, g.descend(target, 0), max(ef, k), 0)
+	results = make([]Result, 0, min(k, len(candidates)))
+	for _, item := range candidates {
+		if len(results) >= k {
+			break
+		}
+		results = append(results, Result{
+			ID:         item.node.id,
+			DocumentID: item.node.documentID,
+			Ordinal:    item.node.ordinal,
+			Similarity: item.similarity,
+			Vector:     compute.QuantizeVectorFloat32(item.node.vector),
+		})
+	}
+	return results
+}
+
+// descend walks from the entry point down to the layer and returns the closest node found above it.
+func (g *Graph) descend(target []float32, layer int) (entryPoints []candidate) {
+	entryPoints = []candidate{{node: g.entry, similarity: dot(target, g.entry.vector)}}
+	for current := len(g.entry.neighbors) - 1; current > layer; current-- {
+		entryPoints = g.searchLayer(target, entryPoints, 1, current)
+	}
+	return entryPoints
+}
+
+// missing reports whether the node is not part of the graph.
+func (g *Graph) missing(id uint64) bool {
+	_, ok := g.nodes[id]
+	return !ok
+}
+
+// searchLayer returns up to ef nodes of the layer closest to the target, ordered by descending similarity.
+func (g *Graph) searchLayer(target []float32, entryPoints []candidate, ef int, layer int) (found []candidate) {
+	visited := make(map[uint64]struct{}, ef*g.m)
+	queue := make([]candidate, 0, ef)
+	found = make([]candidate, 0, ef+1)
+	for _, entry := range entryPoints {
+		visited[entry.node.id] = struct{}{}
+		queue = insertSorted(queue, entry)
+		found = insertSorted(found, entry)
+	}
+	found = found[:min(len(found), ef)]
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if len(found) >= ef && current.similarity < found[len(found)-1].similarity {
+			break
+		}
+		if layer >= len(current.node.neighbors) {
+			continue
+		}
+		for _, id := range current.node.neighbors[layer] {
+			if _, ok := visited[id]; ok {
+				continue
+			}
+			visited[id] = struct{}{}
+			neighbor, ok := g.nodes[id]
+			if !ok {
+				// embedding was removed from the database before the graph was repaired
+				continue
+			}
+			item := candidate{node: neighbor, similarity: dot(target, neighbor.vector)}
+			if len(found) < ef || item.similarity > found[len(found)-1].similarity {
+				queue = insertSorted(queue, item)
+				found = insertSorted(found, item)
+				if len(found) > ef {
+					found = found[:ef]
+				}
+			}
+		}
+	}
+	return found
+}
+
+// selectNeighbors keeps candidates that are closer to the node than to an already selected neighbour, filling up with the closest remaining candidates.
+func (g *Graph) selectNeighbors(candidates []candidate, m int) (selected []candidate) {
+	selected = make([]candidate, 0, m)
+	pruned := make([]candidate, 0, len(candidates))
+	for _, item := range candidates {
+		if len(selected) >= m {
+			break
+		}
+		diverse := true
+		for _, existing := range selected {
+			if dot(item.node.vector, existing.node.vector) > item.similarity {
+				diverse = false
+				break
+			}
+		}
+		if diverse {
+			selected = append(selected, item)
+		} else {
+			pruned = append(pruned, item)
+		}
+	}
+	for _, item := range pruned {
+		if len(selected) >= m {
+			break
+		}
+		selected = append(selected, item)
+	}
+	return selected
+}
+
+// shrink reduces the neighbours of the node in the layer to the layer maximum.
+func (g *Graph) shrink(n *node, layer int) {
+	candidates := make([]candidate, 0, len(n.neighbors[layer]))
+	for _, id := range n.neighbors[layer] {
+		neighbor, ok := g.nodes[id]
+		if !ok {
+			continue
+		}
+		candidates = append(candidates, candidate{node: neighbor, similarity: dot(n.vector, neighbor.vector)})
+	}
+	slices.SortFunc(candidates, compareCandidate)
+	selected := g.selectNeighbors(candidates, g.maxNeighbors(layer))
+	n.neighbors[layer] = n.neighbors[layer][:0]
+	for _, item := range selected {
+		n.neighbors[layer] = append(n.neighbors[layer], item.node.id)
+	}
+}
+
+// nodeBytes estimates the memory of a node from its vector and the neighbour capacity of its layers.
+func (g *Graph) nodeBytes(n *node) int64 {
+	size := int64(64 + 4*len(n.vector))
+	for layer := range n.neighbors {
+		size += int64(8 * g.maxNeighbors(layer))
+	}
+	return size
+}
+
+func (g *Graph) maxNeighbors(layer int) int {
+	if layer == 0 {
+		return 2 * g.m
+	}
+	return g.m
+}
+
+func compareCandidate(a, b candidate) int {
+	return cmp.Or(cmp.Compare(b.similarity, a.similarity), cmp.Compare(a.node.id, b.node.id))
+}
+
+// insertSorted inserts the candidate keeping the list ordered by descending similarity.
+func insertSorted(list []candidate, item candidate) []candidate {
+	idx, _ := slices.BinarySearchFunc(list, item, compareCandidate)
+	return slices.Insert(list, idx, item)
+}
+
+func dot(a []float32, b []float32) (similarity float32) {
+	for idx, value := range a {
+		similarity += value * b[idx]
+	}
+	return similarity
+}
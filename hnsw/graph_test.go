@@ -0,0 +1,214 @@
+package hnsw
+
+import (
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+// randomVectors returns n reproducible vectors of the dimensions.
+func randomVectors(seed uint64, n int, dims int) (vectors [][]float32) {
+	random := rand.New(rand.NewPCG(seed, seed))
+	vectors = make([][]float32, n)
+	for idx := range vectors {
+		vectors[idx] = make([]float32, dims)
+		for dim := range vectors[idx] {
+			vectors[idx][dim] = random.Float32()*2 - 1
+		}
+	}
+	return vectors
+}
+
+// buildGraph inserts the vectors with ids from 1, every two embeddings share a document.
+func buildGraph(vectors [][]float32) *Graph {
+	graph := New(8, 64)
+	for idx, vector := range vectors {
+		id := uint64(idx + 1)
+		graph.Insert(id, (id+1)/2, uint32(id%2), vector)
+	}
+	return graph
+}
+
+// checkGraph verifies the links and size of the graph and that every node finds itself.
+func checkGraph(t *testing.T, graph *Graph, vectors map[uint64][]float32) {
+	t.Helper()
+	if graph.Len() != len(vectors) {
+		t.Fatalf("graph has %d nodes, want %d", graph.Len(), len(vectors))
+	}
+	if (graph.entry == nil) != (len(vectors) == 0) {
+		t.Fatalf("graph entry is %v with %d nodes", graph.entry, len(vectors))
+	}
+	var size int64
+	for id, n := range graph.nodes {
+		size += graph.nodeBytes(n)
+		for layer, ids := range n.neighbors {
+			if len(ids) > graph.maxNeighbors(layer) {
+				t.Errorf("node %d has %d neighbours on layer %d, want at most %d", id, len(ids), layer, graph.maxNeighbors(layer))
+			}
+			for _, neighbor := range ids {
+				if neighbor == id {
+					t.Errorf("node %d links to itself on layer %d", id, layer)
+				}
+				if !graph.Contains(neighbor) {
+					t.Errorf("node %d links to missing node %d on layer %d", id, neighbor, layer)
+				}
+			}
+		}
+	}
+	if graph.Bytes() != size {
+		t.Errorf("graph size is %d, want %d", graph.Bytes(), size)
+	}
+	for id, vector := range vectors {
+		results := graph.Search(vector, 1, len(vectors))
+		if len(results) != 1 || results[0].ID != id {
+			t.Errorf("search for node %d returned %+v", id, results)
+		}
+	}
+}
+
+func TestGraphInsert(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes int
+		dims  int
+	}{
+		{name: "empty", nodes: 0, dims: 8},
+		{name: "single", nodes: 1, dims: 8},
+		{name: "few", nodes: 10, dims: 8},
+		{name: "many", nodes: 150, dims: 16},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vectors := randomVectors(1, test.nodes, test.dims)
+			graph := buildGraph(vectors)
+			expected := make(map[uint64][]float32, len(vectors))
+			for idx, vector := range vectors {
+				expected[uint64(idx+1)] = vector
+			}
+			checkGraph(t, graph, expected)
+			if test.nodes > 0 {
+				if graph.Dimensions() != test.dims {
+					t.Errorf("graph has %d dimensions, want %d", graph.Dimensions(), test.dims)
+				}
+				if changed := graph.Insert(1, 1, 1, vectors[0]); changed != nil {
+					t.Errorf("inserting an existing node changed %v", changed)
+				}
+			}
+		})
+	}
+}
+
+func TestGraphRemove(t *testing.T) {
+	tests := []struct {
+		name      string
+		nodes     int
+		documents []uint64
+	}{
+		{name: "unknown document", nodes: 20, documents: []uint64{100}},
+		{name: "single document", nodes: 20, documents: []uint64{3}},
+		{name: "half of the documents", nodes: 60, documents: []uint64{1, 3, 5, 7, 9, 11, 13, 15, 17, 19, 21, 23, 25, 27, 29}},
+		{name: "every document", nodes: 10, documents: []uint64{1, 2, 3, 4, 5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vectors := randomVectors(2, test.nodes, 8)
+			graph := buildGraph(vectors)
+			expected := make(map[uint64][]float32, len(vectors))
+			var removed []uint64
+			for idx, vector := range vectors {
+				id := uint64(idx + 1)
+				if slices.Contains(test.documents, (id+1)/2) {
+					removed = append(removed, id)
+					continue
+				}
+				expected[id] = vector
+			}
+			changed := graph.Remove(test.documents)
+			for _, id := range removed {
+				if graph.Contains(id) {
+					t.Errorf("removed node %d is still in the graph", id)
+				}
+				if !slices.Contains(changed, id) {
+					t.Errorf("removed node %d is not reported as changed", id)
+				}
+			}
+			if !slices.IsSorted(changed) {
+				t.Errorf("changed nodes are not sorted: %v", changed)
+			}
+			checkGraph(t, graph, expected)
+		})
+	}
+}
+
+func TestGraphRestore(t *testing.T) {
+	tests := []struct {
+		name    string
+		nodes   int
+		removed []uint64
+	}{
+		{name: "single", nodes: 1},
+		{name: "many", nodes: 80},
+		{name: "links to deleted embeddings", nodes: 40, removed: []uint64{2, 4, 6}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vectors := randomVectors(3, test.nodes, 8)
+			graph := buildGraph(vectors)
+
+			// persist the nodes like the graph nodes of the database
+			restored := New(8, 64)
+			expected := make(map[uint64][]float32, len(vectors))
+			for idx, vector := range vectors {
+				id := uint64(idx + 1)
+				neighbors, err := DecodeNeighbors(EncodeNeighbors(graph.Neighbors(id)))
+				if err != nil {
+					t.Fatalf("decode neighbours of node %d: %v", id, err)
+				}
+				if !slices.EqualFunc(neighbors, graph.Neighbors(id), slices.Equal) {
+					t.Fatalf("node %d neighbours %v decoded as %v", id, graph.Neighbors(id), neighbors)
+				}
+				if slices.Contains(test.removed, (id+1)/2) {
+					continue
+				}
+				restored.Restore(id, (id+1)/2, uint32(id%2), vector, neighbors)
+				expected[id] = vector
+			}
+			restored.Restore(uint64(test.nodes+1), 0, 0, vectors[0], nil)
+			if restored.Contains(uint64(test.nodes + 1)) {
+				t.Errorf("node without neighbours was restored")
+			}
+			if len(test.removed) > 0 {
+				restored.Remove(test.removed)
+			} else {
+				for id := range expected {
+					if !slices.EqualFunc(restored.Neighbors(id), graph.Neighbors(id), slices.Equal) {
+						t.Errorf("node %d restored neighbours %v, want %v", id, restored.Neighbors(id), graph.Neighbors(id))
+					}
+				}
+				if restored.Bytes() != graph.Bytes() {
+					t.Errorf("restored graph size is %d, want %d", restored.Bytes(), graph.Bytes())
+				}
+			}
+			checkGraph(t, restored, expected)
+		})
+	}
+}
+
+func TestDecodeNeighbors(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+	}{
+		{name: "empty", raw: nil},
+		{name: "missing layer", raw: []byte{2, 1, 5}},
+		{name: "missing id", raw: []byte{1, 2, 5}},
+		{name: "truncated varint", raw: []byte{1, 1, 0x80}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if neighbors, err := DecodeNeighbors(test.raw); err == nil {
+				t.Errorf("decoded %v from malformed neighbours", neighbors)
+			}
+		})
+	}
+}
@@ -167,9 +167,12 @@ func main() {
 	// Routes: API
 	mux.Handle("/api/upload", middlewareHeaders(middlewareDecompression(middlewareCompression(http.HandlerFunc(srv.UploadHttp)))))
 	mux.Handle("/api/search", middlewareHeaders(middlewareDecompression(middlewareCompression(http.HandlerFunc(srv.SearchHttp)))))
+	mux.Handle("/api/search/batch", middlewareHeaders(middlewareDecompression(middlewareCompression(http.HandlerFunc(srv.BatchSearchHttp)))))
 	mux.Handle("/api/chat", middlewareHeaders(middlewareDecompression(http.HandlerFunc(srv.ChatHttp))))
+	mux.Handle("/api/ask", middlewareHeaders(middlewareDecompression(http.HandlerFunc(srv.AskHttp))))
 
 	mux.Handle("/api/categories", middlewareHeaders(middlewareDecompression(http.HandlerFunc(srv.FetchCategoryNamesHttp))))
+	mux.Handle("/api/category/configure", middlewareHeaders(middlewareDecompression(http.HandlerFunc(srv.ConfigureCategoryHttp))))
 	mux.Handle("/api/delete/owner", middlewareHeaders(middlewareDecompression(http.HandlerFunc(srv.DeleteOwnerHttp))))
 	mux.Handle("/api/delete/category", middlewareHeaders(middlewareDecompression(http.HandlerFunc(srv.DeleteCategoryHttp))))
 	mux.Handle("/api/delete/document", middlewareHeaders(middlewareDecompression(http.HandlerFunc(srv.DeleteDocumentHttp))))
@@ -253,8 +256,8 @@ func prefTest() {
 	for _, embedding := range res.Embeddings {
 		embeddings = append(embeddings, embedding.Value())
 	}
-	matrix1 := compute.NewMatrix(embeddings[:len(embeddings)/2])
-	matrix2 := compute.NewMatrix(embeddings[len(embeddings)/2:])
+	matrix1, _ := compute.NewMatrix(embeddings[:len(embeddings)/2])
+	matrix2, _ := compute.NewMatrix(embeddings[len(embeddings)/2:])
 	sim, done := compute.MatrixCosineSimilarity()
 	defer done()
 	sim(matrix1.Clone(), matrix2.Clone())
@@ -266,8 +269,8 @@ func prefTest() {
 	end := time.Since(start)
 	logger.Sugar().Infof("Performance Cosine: %s", end.String())
 
-	a := compute.DequantizeMatrixFloat32(embeddings)
-	b := compute.DequantizeMatrixFloat64(embeddings)
+	a, _ := compute.DequantizeMatrixFloat32(embeddings)
+	b, _ := compute.DequantizeMatrixFloat64(embeddings)
 	start = time.Now()
 	for range 50 {
 		compute.QuantizeMatrixFloat32(a)
@@ -0,0 +1,181 @@
+package memindex
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/expki/go-vectorsearch/compute"
+	"github.com/expki/go-vectorsearch/database"
+	_ "github.com/expki/go-vectorsearch/env"
+)
+
+// Category holds the embeddings of a category grouped by centroid.
+type Category struct {
+	ID       uint64
+	limit    int64
+	mutex    sync.RWMutex
+	size     int64
+	postings map[uint64]*postings
+	// stored is the database version of the category the embeddings reflect
+	stored atomic.Uint64
+	// checked is when the stored version was last compared with the database in unix nanoseconds
+	checked atomic.Int64
+}
+
+// postings holds the embeddings of a centroid as contiguous rows, the slices are replaced rather than modified on removal.
+type postings struct {
+	dims        int
+	ids         []uint64
+	documentIDs []uint64
+	ordinals    []uint32
+	// vectors holds the normalized rows of dims values
+	vectors []float32
+	// quantized holds the stored rows of dims+8 bytes
+	quantized []uint8
+}
+
+func newCategory(categoryID uint64, limit int64) *Category {
+	return &Category{
+		ID:       categoryID,
+		limit:    limit,
+		postings: make(map[uint64]*postings),
+	}
+}
+
+// Add stores the embeddings under their centroids while loading, failing once the category exceeds the memory budget.
+func (c *Category) Add(embeddings []database.Embedding, calibrations compute.Calibrations) error {
+	_, err := c.add(embeddings, calibrations)
+	if err != nil {
+		return err
+	}
+	if c.bytes() > c.limit {
+		return ErrOverBudget
+	}
+	return nil
+}
+
+// Scan returns the embeddings of the centroid with their cosine similarity to the normalized target.
+func (c *Category) Scan(centroidID uint64, target []float32) (embeddings []database.Embedding, similarities []float32) {
+	c.mutex.RLock()
+	posting, ok := c.postings[centroidID]
+	var p postings
+	if ok {
+		p = *posting
+	}
+	c.mutex.RUnlock()
+	if !ok || p.dims != len(target) {
+		return nil, nil
+	}
+	stride := p.dims + 8
+	embeddings = make([]database.Embedding, len(p.ids))
+	similarities = make([]float32, len(p.ids))
+	for row := range p.ids {
+		vector := p.vectors[row*p.dims : (row+1)*p.dims]
+		var dot float32
+		for idx, value := range vector {
+			dot += value * target[idx]
+		}
+		similarities[row] = dot
+		embeddings[row] = database.Embedding{
+			ID:         p.ids[row],
+			DocumentID: p.documentIDs[row],
+			CentroidID: centroidID,
+			Ordinal:    p.ordinals[row],
+			Vector:     p.quantized[row*stride : (row+1)*stride : (row+1)*stride],
+		}
+	}
+	return embeddings, similarities
+}
+
+// fresh reports whether the stored version was compared with the database within maxAge.
+func (c *Category) fresh(maxAge time.Duration) bool {
+	return time.Since(time.Unix(0, c.checked.Load())) < maxAge
+}
+
+// follow moves the stored version to a change made by this process, a version that skips a change of another process is not followed so the next check loads the category again.
+func (c *Category) follow(version uint64) {
+	c.stored.CompareAndSwap(version-1, version)
+}
+
+func (c *Category) bytes() int64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.size
+}
+
+// add stores the embeddings and returns the bytes added, embeddings after one that cannot be decoded are not stored.
+func (c *Category) add(embeddings []database.Embedding, calibrations compute.Calibrations) (size int64, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	defer func() { c.size += size }()
+	for _, embedding := range embeddings {
+		dims := len(embedding.Vector) - 8
+		if dims <= 0 {
+			continue
+		}
+		vector, err := calibrations.DequantizeVectorFloat32(embedding.Vector)
+		if err != nil {
+			return size, err
+		}
+		posting, ok := c.postings[embedding.CentroidID]
+		if !ok {
+			posting = &postings{dims: dims}
+			c.postings[embedding.CentroidID] = posting
+		} else if posting.dims != dims {
+			continue
+		}
+		posting.ids = append(posting.ids, embedding.ID)
+		posting.documentIDs = append(posting.documentIDs, embedding.DocumentID)
+		posting.ordinals = append(posting.ordinals, embedding.Ordinal)
+		posting.vectors = append(posting.vectors, compute.Normalize(vector)...)
+		posting.quantized = append(posting.quantized, embedding.Vector...)
+		size += rowSize(dims)
+	}
+	return size, nil
+}
+
+// removeDocuments drops the embeddings of the documents and returns the bytes freed.
+func (c *Category) removeDocuments(documentIDs []uint64) (size int64) {
+	remove := make(map[uint64]struct{}, len(documentIDs))
+	for _, id := range documentIDs {
+		remove[id] = struct{}{}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for centroidID, posting := range c.postings {
+		if !slices.ContainsFunc(posting.documentIDs, func(id uint64) bool {
+			_, ok := remove[id]
+			return ok
+		}) {
+			continue
+		}
+		// scans in progress keep reading the previous rows
+		stride := posting.dims + 8
+		kept := &postings{dims: posting.dims}
+		for row, documentID := range posting.documentIDs {
+			if _, ok := remove[documentID]; ok {
+				size += rowSize(posting.dims)
+				continue
+			}
+			kept.ids = append(kept.ids, posting.ids[row])
+			kept.documentIDs = append(kept.documentIDs, documentID)
+			kept.ordinals = append(kept.ordinals, posting.ordinals[row])
+			kept.vectors = append(kept.vectors, posting.vectors[row*posting.dims:(row+1)*posting.dims]...)
+			kept.quantized = append(kept.quantized, posting.quantized[row*stride:(row+1)*stride]...)
+		}
+		if len(kept.ids) == 0 {
+			delete(c.postings, centroidID)
+			continue
+		}
+		c.postings[centroidID] = kept
+	}
+	c.size -= size
+	return size
+}
+
+// rowSize is the memory held by a single embedding.
+func rowSize(dims int) int64 {
+	return int64(8 + 8 + 4 + 4*dims + dims + 8)
+}
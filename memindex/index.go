@@ -0,0 +1,232 @@
+package memindex
+
+import (
+	"container/list"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/expki/go-vectorsearch/compute"
+	"github.com/expki/go-vectorsearch/database"
+	_ "github.com/expki/go-vectorsearch/env"
+	"github.com/expki/go-vectorsearch/logger"
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrOverBudget is returned when a category does not fit in the memory budget on its own.
+var ErrOverBudget = errors.New("category exceeds index memory budget")
+
+// New creates an index that keeps categories in memory up to the budget in bytes, a budget of zero disables the index.
+func New(budget int64) *Index {
+	if budget <= 0 {
+		return nil
+	}
+	return &Index{
+		budget:     budget,
+		lru:        list.New(),
+		categories: make(map[uint64]*list.Element),
+		versions:   make(map[uint64]uint64),
+		oversized:  make(map[uint64]oversize),
+	}
+}
+
+// Index holds the embeddings of recently searched categories, every method is a no-op on a nil receiver.
+type Index struct {
+	budget int64
+	loads  singleflight.Group
+
+	mutex      sync.Mutex
+	used       int64
+	lru        *list.List
+	categories map[uint64]*list.Element
+	// versions counts the changes to each category so loads that raced a change are discarded
+	versions map[uint64]uint64
+	// oversized holds the versions at which a category was found to exceed the budget
+	oversized map[uint64]oversize
+}
+
+// oversize records when a category was found to exceed the budget.
+type oversize struct {
+	version uint64
+	stored  uint64
+	checked time.Time
+}
+
+// Get returns the category if it is loaded and marks it as recently used.
+func (i *Index) Get(categoryID uint64) *Category {
+	if i == nil {
+		return nil
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	element, ok := i.categories[categoryID]
+	if !ok {
+		return nil
+	}
+	i.lru.MoveToFront(element)
+	return element.Value.(*Category)
+}
+
+// Load returns the category, filling it with the load function when it is not loaded.
+// A category checked longer than maxAge ago is compared with the stored version of the database and loaded again when another process changed it.
+func (i *Index) Load(categoryID uint64, maxAge time.Duration, stored func() (uint64, error), load func(category *Category) error) (category *Category, err error) {
+	if i == nil {
+		return nil, nil
+	}
+	if category = i.Get(categoryID); category != nil {
+		if category.fresh(maxAge) {
+			return category, nil
+		}
+		version, err := stored()
+		if err != nil {
+			return nil, err
+		}
+		if version == category.stored.Load() {
+			category.checked.Store(time.Now().UnixNano())
+			return category, nil
+		}
+		logger.Sugar().Debugf("category %d was changed by another process", categoryID)
+		i.dropLoaded(category)
+	}
+	valueAny, err, _ := i.loads.Do(strconv.FormatUint(categoryID, 10), func() (any, error) {
+		if category := i.Get(categoryID); category != nil {
+			return category, nil
+		}
+		i.mutex.Lock()
+		version := i.versions[categoryID]
+		oversized, ok := i.oversized[categoryID]
+		i.mutex.Unlock()
+		ok = ok && oversized.version == version
+		if ok && time.Since(oversized.checked) < maxAge {
+			return nil, ErrOverBudget
+		}
+		// embeddings changed after the version was read are loaded again on the next check
+		storedVersion, err := stored()
+		if err != nil {
+			return nil, err
+		}
+		if ok && oversized.stored == storedVersion {
+			i.mutex.Lock()
+			i.oversized[categoryID] = oversize{version: version, stored: storedVersion, checked: time.Now()}
+			i.mutex.Unlock()
+			return nil, ErrOverBudget
+		}
+		category := newCategory(categoryID, i.budget)
+		category.stored.Store(storedVersion)
+		category.checked.Store(time.Now().UnixNano())
+		err = load(category)
+		if errors.Is(err, ErrOverBudget) {
+			logger.Sugar().Debugf("category %d exceeds index memory budget", categoryID)
+			i.mutex.Lock()
+			i.oversized[categoryID] = oversize{version: version, stored: storedVersion, checked: time.Now()}
+			i.mutex.Unlock()
+			return nil, err
+		} else if err != nil {
+			return nil, err
+		}
+		i.mutex.Lock()
+		defer i.mutex.Unlock()
+		if i.versions[categoryID] != version {
+			// changed while loading, the next search loads it again
+			return category, nil
+		}
+		i.used += category.bytes()
+		i.categories[categoryID] = i.lru.PushFront(category)
+		i.evict()
+		logger.Sugar().Debugf("loaded category %d into index: %d bytes", categoryID, category.bytes())
+		return category, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	category, ok := valueAny.(*Category)
+	if !ok {
+		return nil, errors.New("failed to cast singleflight response value to type")
+	}
+	return category, nil
+}
+
+// Add stores new embeddings of the category if it is loaded, version is the stored version of the category after the change.
+// The category is dropped when an embedding cannot be decoded, its next search loads it again.
+func (i *Index) Add(categoryID uint64, version uint64, embeddings []database.Embedding, calibrations compute.Calibrations) {
+	if i == nil || len(embeddings) == 0 {
+		return
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.versions[categoryID]++
+	element, ok := i.categories[categoryID]
+	if !ok {
+		return
+	}
+	category := element.Value.(*Category)
+	category.follow(version)
+	size, err := category.add(embeddings, calibrations)
+	i.used += size
+	if err != nil {
+		logger.Sugar().Errorf("failed to add embeddings to memory index of category %d: %v", categoryID, err)
+		i.remove(element)
+		return
+	}
+	i.evict()
+}
+
+// RemoveDocuments drops the embeddings of the documents from the category if it is loaded, version is the stored version of the category after the change.
+func (i *Index) RemoveDocuments(categoryID uint64, version uint64, documentIDs []uint64) {
+	if i == nil || len(documentIDs) == 0 {
+		return
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.versions[categoryID]++
+	element, ok := i.categories[categoryID]
+	if !ok {
+		return
+	}
+	category := element.Value.(*Category)
+	category.follow(version)
+	i.used -= category.removeDocuments(documentIDs)
+}
+
+// Drop unloads the category, it is loaded again on the next search.
+func (i *Index) Drop(categoryID uint64) {
+	if i == nil {
+		return
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.versions[categoryID]++
+	element, ok := i.categories[categoryID]
+	if !ok {
+		return
+	}
+	i.remove(element)
+}
+
+// dropLoaded unloads the category unless it was already replaced.
+func (i *Index) dropLoaded(category *Category) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	element, ok := i.categories[category.ID]
+	if !ok || element.Value.(*Category) != category {
+		return
+	}
+	i.versions[category.ID]++
+	i.remove(element)
+}
+
+// evict unloads the least recently used categories until the index fits in the budget.
+func (i *Index) evict() {
+	for i.used > i.budget && i.lru.Len() > 0 {
+		element := i.lru.Back()
+		logger.Sugar().Debugf("evicting category %d from index", element.Value.(*Category).ID)
+		i.remove(element)
+	}
+}
+
+func (i *Index) remove(element *list.Element) {
+	category := i.lru.Remove(element).(*Category)
+	delete(i.categories, category.ID)
+	i.used -= category.bytes()
+}
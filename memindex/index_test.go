@@ -0,0 +1,291 @@
+package memindex
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/expki/go-vectorsearch/compute"
+	"github.com/expki/go-vectorsearch/database"
+)
+
+// testEmbeddings returns embeddings of four dimensions under centroid 1, embedding i belongs to document i.
+func testEmbeddings(ids ...uint64) (embeddings []database.Embedding) {
+	for _, id := range ids {
+		embeddings = append(embeddings, database.Embedding{
+			ID:         id,
+			DocumentID: id,
+			CentroidID: 1,
+			Vector:     compute.QuantizeVectorFloat32([]float32{float32(id), 1, 0, -1}),
+		})
+	}
+	return embeddings
+}
+
+// testStore counts the calls made by the index to the database.
+type testStore struct {
+	version uint64
+	ids     []uint64
+	stores  int
+	loads   int
+}
+
+func (s *testStore) stored() (uint64, error) {
+	s.stores++
+	return s.version, nil
+}
+
+func (s *testStore) load(category *Category) error {
+	s.loads++
+	return category.Add(testEmbeddings(s.ids...), nil)
+}
+
+// scanned returns the embedding ids held for centroid 1.
+func scanned(category *Category) (ids []uint64) {
+	embeddings, _ := category.Scan(1, []float32{1, 0, 0, 0})
+	for _, embedding := range embeddings {
+		ids = append(ids, embedding.ID)
+	}
+	return ids
+}
+
+func TestIndexLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		// change is applied between the first and the second load
+		change func(index *Index, store *testStore)
+		maxAge time.Duration
+		stores int
+		loads  int
+		ids    []uint64
+	}{
+		{
+			name:   "fresh category is not checked",
+			change: func(index *Index, store *testStore) { store.version++ },
+			maxAge: time.Hour,
+			stores: 1,
+			loads:  1,
+			ids:    []uint64{1, 2},
+		},
+		{
+			name:   "unchanged category is kept",
+			change: func(index *Index, store *testStore) {},
+			stores: 2,
+			loads:  1,
+			ids:    []uint64{1, 2},
+		},
+		{
+			name: "change of another process reloads",
+			change: func(index *Index, store *testStore) {
+				store.version++
+				store.ids = append(store.ids, 3)
+			},
+			stores: 3,
+			loads:  2,
+			ids:    []uint64{1, 2, 3},
+		},
+		{
+			name: "change of this process is followed",
+			change: func(index *Index, store *testStore) {
+				store.version++
+				index.Add(7, store.version, testEmbeddings(3), nil)
+				store.ids = append(store.ids, 3)
+			},
+			stores: 2,
+			loads:  1,
+			ids:    []uint64{1, 2, 3},
+		},
+		{
+			name: "removal of this process is followed",
+			change: func(index *Index, store *testStore) {
+				store.version++
+				index.RemoveDocuments(7, store.version, []uint64{1})
+				store.ids = []uint64{2}
+			},
+			stores: 2,
+			loads:  1,
+			ids:    []uint64{2},
+		},
+		{
+			name: "change skipping a change of another process reloads",
+			change: func(index *Index, store *testStore) {
+				store.version += 2
+				store.ids = append(store.ids, 4)
+				index.Add(7, store.version, testEmbeddings(3), nil)
+				store.ids = append(store.ids, 3)
+			},
+			stores: 3,
+			loads:  2,
+			ids:    []uint64{1, 2, 4, 3},
+		},
+		{
+			name: "dropped category reloads",
+			change: func(index *Index, store *testStore) {
+				index.Drop(7)
+				store.ids = []uint64{5}
+			},
+			maxAge: time.Hour,
+			stores: 2,
+			loads:  2,
+			ids:    []uint64{5},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			index := New(1 << 20)
+			store := &testStore{version: 1, ids: []uint64{1, 2}}
+			_, err := index.Load(7, test.maxAge, store.stored, store.load)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.change(index, store)
+			category, err := index.Load(7, test.maxAge, store.stored, store.load)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if store.stores != test.stores || store.loads != test.loads {
+				t.Errorf("index read the version %d and loaded %d times, want %d and %d", store.stores, store.loads, test.stores, test.loads)
+			}
+			if ids := scanned(category); !slices.Equal(ids, test.ids) {
+				t.Errorf("category holds %v, want %v", ids, test.ids)
+			}
+			if category.bytes() != int64(len(test.ids))*rowSize(4) || index.used != category.bytes() {
+				t.Errorf("category holds %d bytes and index %d, want %d", category.bytes(), index.used, int64(len(test.ids))*rowSize(4))
+			}
+		})
+	}
+}
+
+func TestIndexLoadRace(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(index *Index)
+	}{
+		{name: "add", change: func(index *Index) { index.Add(7, 2, testEmbeddings(3), nil) }},
+		{name: "remove", change: func(index *Index) { index.RemoveDocuments(7, 2, []uint64{1}) }},
+		{name: "drop", change: func(index *Index) { index.Drop(7) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			index := New(1 << 20)
+			store := &testStore{version: 1, ids: []uint64{1, 2}}
+			category, err := index.Load(7, time.Hour, store.stored, func(category *Category) error {
+				test.change(index)
+				return store.load(category)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if category == nil {
+				t.Fatal("load that raced a change returned no category")
+			}
+			if index.Get(7) != nil || index.used != 0 {
+				t.Errorf("load that raced a change was kept")
+			}
+		})
+	}
+}
+
+func TestIndexOverBudget(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(index *Index, store *testStore)
+		maxAge time.Duration
+		stores int
+		loads  int
+		err    error
+	}{
+		{
+			name:   "recent check is trusted",
+			change: func(index *Index, store *testStore) { store.version++ },
+			maxAge: time.Hour,
+			stores: 1,
+			loads:  1,
+			err:    ErrOverBudget,
+		},
+		{
+			name:   "unchanged category is not loaded again",
+			change: func(index *Index, store *testStore) {},
+			stores: 2,
+			loads:  1,
+			err:    ErrOverBudget,
+		},
+		{
+			name: "change of another process loads again",
+			change: func(index *Index, store *testStore) {
+				store.version++
+				store.ids = []uint64{1}
+			},
+			stores: 2,
+			loads:  2,
+		},
+		{
+			name: "change of this process loads again",
+			change: func(index *Index, store *testStore) {
+				index.RemoveDocuments(7, store.version+1, []uint64{2, 3})
+				store.version++
+				store.ids = []uint64{1}
+			},
+			maxAge: time.Hour,
+			stores: 2,
+			loads:  2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			index := New(2 * rowSize(4))
+			store := &testStore{version: 1, ids: []uint64{1, 2, 3}}
+			_, err := index.Load(7, test.maxAge, store.stored, store.load)
+			if !errors.Is(err, ErrOverBudget) {
+				t.Fatalf("load error is %v, want %v", err, ErrOverBudget)
+			}
+			test.change(index, store)
+			_, err = index.Load(7, test.maxAge, store.stored, store.load)
+			if !errors.Is(err, test.err) {
+				t.Errorf("load error is %v, want %v", err, test.err)
+			}
+			if store.stores != test.stores || store.loads != test.loads {
+				t.Errorf("index read the version %d and loaded %d times, want %d and %d", store.stores, store.loads, test.stores, test.loads)
+			}
+		})
+	}
+}
+
+func TestIndexEvict(t *testing.T) {
+	tests := []struct {
+		name   string
+		budget int64
+		loaded []uint64
+	}{
+		{name: "every category fits", budget: 6 * rowSize(4), loaded: []uint64{1, 2, 3}},
+		{name: "least recently used is evicted", budget: 5 * rowSize(4), loaded: []uint64{1, 3}},
+		{name: "single category fits", budget: 2 * rowSize(4), loaded: []uint64{3}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			index := New(test.budget)
+			for _, categoryID := range []uint64{1, 2, 3} {
+				store := &testStore{ids: []uint64{1, 2}}
+				_, err := index.Load(categoryID, time.Hour, store.stored, store.load)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// category 1 is used again before category 3 is loaded
+				index.Get(1)
+			}
+			var loaded []uint64
+			for _, categoryID := range []uint64{1, 2, 3} {
+				if index.Get(categoryID) != nil {
+					loaded = append(loaded, categoryID)
+				}
+			}
+			if !slices.Equal(loaded, test.loaded) {
+				t.Errorf("loaded categories are %v, want %v", loaded, test.loaded)
+			}
+			if index.used != int64(len(loaded))*2*rowSize(4) {
+				t.Errorf("index holds %d bytes for %d categories", index.used, len(loaded))
+			}
+		})
+	}
+}
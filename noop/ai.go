@@ -14,6 +14,7 @@ import (
 
 	"github.com/expki/go-vectorsearch/ai"
 	"github.com/expki/go-vectorsearch/ai/aicomms"
+	"github.com/expki/go-vectorsearch/compute"
 	"github.com/expki/go-vectorsearch/config"
 	_ "github.com/expki/go-vectorsearch/env"
 )
@@ -58,7 +59,10 @@ func (n *noai) Embed(_ context.Context, request aicomms.EmbedRequest) (response
 		n.random.Read(raw)
 
 		copy(row[8:], raw)
-		response.Embeddings[idx] = row
+		response.Embeddings[idx], err = compute.DequantizeVectorFloat32(row)
+		if err != nil {
+			return response, err
+		}
 	}
 	return
 }
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/expki/go-vectorsearch/config"
+	"github.com/expki/go-vectorsearch/database"
+	_ "github.com/expki/go-vectorsearch/env"
+)
+
+// validateAggregation checks the aggregation mode and fills in the default parameters.
+func validateAggregation(aggregation *database.Aggregation) error {
+	switch aggregation.Mode {
+	case "":
+		aggregation.Mode = database.AggregationMax
+	case database.AggregationMax, database.AggregationMeanTopK, database.AggregationSaturatedSum, database.AggregationCountAbove:
+	default:
+		return fmt.Errorf("unknown aggregation mode: %s", aggregation.Mode)
+	}
+	if aggregation.Saturation < 0 {
+		return errors.New("aggregation saturation must not be negative")
+	}
+	if aggregation.Mode == database.AggregationMeanTopK && aggregation.TopK == 0 {
+		aggregation.TopK = config.AGGREGATE_TOP_K
+	}
+	aggregation.TopK = min(aggregation.TopK, config.AGGREGATE_CHUNKS)
+	if aggregation.Mode == database.AggregationSaturatedSum && aggregation.Saturation == 0 {
+		aggregation.Saturation = config.AGGREGATE_SATURATION
+	}
+	if aggregation.Mode == database.AggregationCountAbove && aggregation.Threshold == nil {
+		threshold := float32(config.AGGREGATE_THRESHOLD)
+		aggregation.Threshold = &threshold
+	}
+	return nil
+}
+
+// aggregates reports whether the aggregation scores documents by more than their best chunk.
+func aggregates(aggregation *database.Aggregation) bool {
+	return aggregation != nil && aggregation.Mode != "" && aggregation.Mode != database.AggregationMax
+}
+
+// aggregateChunks combines the chunk similarities, sorted best first, into the document score.
+func aggregateChunks(aggregation database.Aggregation, chunks []chunkSimilarity) (score float32) {
+	switch aggregation.Mode {
+	case database.AggregationMeanTopK:
+		top := chunks[:min(uint(len(chunks)), max(1, aggregation.TopK))]
+		for _, chunk := range top {
+			score += chunk.similarity
+		}
+		return score / float32(len(top))
+	case database.AggregationSaturatedSum:
+		var sum float32
+		for _, chunk := range chunks {
+			sum += max(0, chunk.similarity)
+		}
+		return sum / (sum + aggregation.Saturation)
+	case database.AggregationCountAbove:
+		for _, chunk := range chunks {
+			if chunk.similarity >= *aggregation.Threshold {
+				score++
+			}
+		}
+		return score
+	default:
+		return chunks[0].similarity
+	}
+}
@@ -0,0 +1,283 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/expki/go-vectorsearch/ai/aicomms"
+	"github.com/expki/go-vectorsearch/config"
+	_ "github.com/expki/go-vectorsearch/env"
+	"github.com/expki/go-vectorsearch/logger"
+)
+
+// AskCitationSeparator separates the streamed answer from the trailing citations.
+const AskCitationSeparator = '\x1e'
+
+type AskRequest struct {
+	Owner         string     `json:"owner"`
+	Category      string     `json:"category"`
+	Categories    []string   `json:"categories,omitempty"`
+	AllCategories bool       `json:"all_categories,omitempty"`
+	Prefix        string     `json:"prefix,omitempty"`
+	History       []string   `json:"history,omitempty"`
+	Text          string     `json:"text"`
+	Count         uint       `json:"count,omitempty"`
+	Chunks        uint       `json:"chunks,omitempty"`
+	Centroids     int        `json:"centroids,omitempty"`
+	Filter        *Filter    `json:"filter,omitempty"`
+	Mode          SearchMode `json:"mode,omitempty"`
+	MinSimilarity *float32   `json:"min_similarity,omitempty"`
+	ContextWindow uint32     `json:"context_window,omitempty"`
+}
+
+type AskCitations struct {
+	Citations []Citation `json:"citations"`
+}
+
+type Citation struct {
+	Reference  int          `json:"reference"`
+	DocumentID uint64       `json:"document_id"`
+	ExternalID string       `json:"external_id,omitempty"`
+	Name       string       `json:"name,omitempty"`
+	Chunks     []ChunkRange `json:"chunks,omitempty"`
+}
+
+type ChunkRange struct {
+	From uint32 `json:"from"`
+	To   uint32 `json:"to"`
+}
+
+func (s *Server) AskHttp(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	txid := index.Add(1)
+	logger.Sugar().Debugf("%d ask request started", txid)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Transfer-Encoding", "chunked")
+
+	// Ensure the ResponseWriter supports streaming
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// Ensure the request method is POST or GET
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		logger.Sugar().Debugf("%d request method denied: %s", txid, r.Method)
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, `Invalid request method`)
+		return
+	}
+
+	// Read the request body
+	logger.Sugar().Debugf("%d reading request body", txid)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Sugar().Debugf("%d request body invalid: %v", txid, err)
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `Invalid request body`)
+		return
+	}
+	defer r.Body.Close()
+
+	// Parse the JSON request body into the RequestBody struct
+	logger.Sugar().Debugf("%d unmarshing request body", txid)
+	var req AskRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		logger.Sugar().Debugf("%d request invalid: %v", txid, err)
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `Invalid request`)
+		return
+	}
+
+	// Handle the ask request
+	resStream, citations, err := s.Ask(r.Context(), req)
+	if err == nil {
+		// ask was successful
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// ask request canceled
+		logger.Sugar().Warnf("%d ask request canceled after %s", txid, time.Since(start).String())
+		w.WriteHeader(499)
+		io.WriteString(w, `Client canceled ask request`)
+		return
+	} else if errors.Is(err, ErrInvalidRequest) {
+		// ask request invalid
+		logger.Sugar().Debugf("%d ask request invalid: %s", txid, err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `Invalid ask request`)
+		return
+	} else {
+		// ask failed
+		logger.Sugar().Errorf("%d ask request failed: %s", txid, err.Error())
+		http.Error(w, "Failed to initialize ask", http.StatusInternalServerError)
+		return
+	}
+	defer resStream.Close()
+	charReader := bufio.NewReader(resStream)
+
+	// Stream the response
+	for {
+		char, _, err := charReader.ReadRune()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			logger.Sugar().Errorf("Error reading stream: %v", err)
+			http.Error(w, "Error reading stream", http.StatusInternalServerError)
+			return
+		}
+
+		_, writeErr := io.WriteString(w, string(char))
+		if writeErr != nil {
+			return
+		}
+
+		flusher.Flush()
+	}
+
+	// Write the citations
+	citationBytes, err := json.Marshal(AskCitations{Citations: citations})
+	if err != nil {
+		logger.Sugar().Errorf("%d citations marshal failed: %v", txid, err)
+		return
+	}
+	_, writeErr := w.Write(append([]byte{AskCitationSeparator}, citationBytes...))
+	if writeErr != nil {
+		return
+	}
+	flusher.Flush()
+
+	logger.Sugar().Infof("%d ask request suceeded (%dms)", txid, time.Since(start).Milliseconds())
+}
+
+// Ask searches the category for the question and answers it using the best matching chunks as context.
+func (s *Server) Ask(ctx context.Context, req AskRequest) (resStream io.ReadCloser, citations []Citation, err error) {
+	if req.Count == 0 {
+		req.Count = config.ASK_DOCUMENTS
+	}
+	if req.Chunks == 0 {
+		req.Chunks = config.ASK_CHUNKS
+	}
+
+	// Search for context
+	searchRes, err := s.Search(ctx, SearchRequest{
+		Owner:         req.Owner,
+		Category:      req.Category,
+		Categories:    req.Categories,
+		AllCategories: req.AllCategories,
+		Text:          req.Text,
+		Count:         req.Count,
+		Centroids:     req.Centroids,
+		Filter:        req.Filter,
+		Mode:          req.Mode,
+		Chunks:        req.Chunks,
+		MinSimilarity: req.MinSimilarity,
+		ContextWindow: req.ContextWindow,
+	})
+	if err == nil {
+		// success
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// request canceled
+		return nil, nil, err
+	} else {
+		// exception encountered
+		return nil, nil, errors.Join(errors.New("failed to search context"), err)
+	}
+
+	// Word budget of the chat context
+	maxWords := math.MaxInt
+	if ctxNum := s.ai.ChatCtxNum(); ctxNum > 0 {
+		maxWords = ((ctxNum * 9) / 10) / 4
+	}
+	maxWords -= len(strings.Fields(req.Prefix)) + len(strings.Fields(req.Text))
+	for _, content := range req.History {
+		maxWords -= len(strings.Fields(content))
+	}
+
+	// Pack passages in order of relevance
+	contextList := make([]string, 0, len(searchRes.Documents))
+	citations = make([]Citation, 0, len(searchRes.Documents))
+	for _, document := range searchRes.Documents {
+		citation := Citation{
+			Reference:  len(citations) + 1,
+			DocumentID: document.DocumentID,
+			ExternalID: document.ExternalID,
+			Name:       document.Name,
+		}
+		var passage []string
+		if len(document.Passages) > 0 {
+			// context windows are already merged in document order
+			for _, item := range document.Passages {
+				numWords := len(strings.Fields(item.Text))
+				if numWords > maxWords {
+					continue
+				}
+				maxWords -= numWords
+				passage = append(passage, item.Text)
+				citation.Chunks = append(citation.Chunks, item.ChunkRange)
+			}
+		} else if len(document.Chunks) == 0 {
+			// keyword matches carry no chunks, use the whole document
+			text := Flatten(document.Document)
+			numWords := len(strings.Fields(text))
+			if numWords > maxWords {
+				continue
+			}
+			maxWords -= numWords
+			passage = append(passage, text)
+		} else {
+			chunks := slices.Clone(document.Chunks)
+			slices.SortFunc(chunks, func(a, b ChunkMatch) int {
+				return int(a.Index) - int(b.Index)
+			})
+			for _, chunk := range chunks {
+				numWords := len(strings.Fields(chunk.Text))
+				if numWords > maxWords {
+					continue
+				}
+				maxWords -= numWords
+				passage = append(passage, chunk.Text)
+				if last := len(citation.Chunks) - 1; last >= 0 && citation.Chunks[last].To+1 == chunk.Index {
+					citation.Chunks[last].To = chunk.Index
+				} else {
+					citation.Chunks = append(citation.Chunks, ChunkRange{From: chunk.Index, To: chunk.Index})
+				}
+			}
+		}
+		if len(passage) == 0 {
+			continue
+		}
+		contextList = append(contextList, fmt.Sprintf("[%d] %s", citation.Reference, strings.Join(passage, "\n...\n")))
+		citations = append(citations, citation)
+	}
+
+	// Create messages
+	var instruction string
+	if len(contextList) > 0 {
+		instruction = "Answer using only these documents and cite the documents you use by their number in square brackets, for example [1]."
+	}
+	messages := chatMessages(req.History, contextList, req.Prefix, req.Text, instruction)
+
+	// Start chat
+	resStream = s.ai.ChatStream(ctx, aicomms.ChatRequest{
+		Model:    s.ai.ChatModel(),
+		Messages: messages,
+	})
+	if resStream == nil {
+		return nil, nil, errors.New("no chat provider configured")
+	}
+
+	return resStream, citations, nil
+}
@@ -0,0 +1,469 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/expki/go-vectorsearch/ai/aicomms"
+	"github.com/expki/go-vectorsearch/compute"
+	"github.com/expki/go-vectorsearch/config"
+	"github.com/expki/go-vectorsearch/database"
+	_ "github.com/expki/go-vectorsearch/env"
+	"github.com/expki/go-vectorsearch/logger"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+type BatchSearchRequest struct {
+	Owner         string        `json:"owner"`
+	Category      string        `json:"category"`
+	Queries       []BatchQuery  `json:"queries"`
+	Count         uint          `json:"count"`
+	Centroids     int           `json:"centroids,omitempty"`
+	Probe         *ProbeOptions `json:"probe,omitempty"`
+	Chunks        uint          `json:"chunks,omitempty"`
+	MinSimilarity *float32      `json:"min_similarity,omitempty"`
+}
+
+type BatchQuery struct {
+	Text   string    `json:"text,omitempty"`
+	Vector []float32 `json:"vector,omitempty"`
+}
+
+type BatchSearchResponse struct {
+	Results []SearchResponse `json:"results"`
+}
+
+func (s *Server) BatchSearchHttp(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	txid := index.Add(1)
+	logger.Sugar().Debugf("%d batch search request started", txid)
+	w.Header().Set("Content-Type", "application/json")
+
+	// Ensure the request method is POST or GET
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		logger.Sugar().Debugf("%d request method denied: %s", txid, r.Method)
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, `{"error":"Invalid request method"}`)
+		return
+	}
+
+	// Read the request body
+	logger.Sugar().Debugf("%d reading request body", txid)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Sugar().Debugf("%d request body invalid: %v", txid, err)
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":"Invalid request body"}`)
+		return
+	}
+	defer r.Body.Close()
+
+	// Parse the JSON request body into the RequestBody struct
+	logger.Sugar().Debugf("%d unmarshing request body", txid)
+	var req BatchSearchRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		logger.Sugar().Debugf("%d request invalid: %v", txid, err)
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":"Invalid request"}`)
+		return
+	}
+
+	// Handle the batch search request
+	res, err := s.BatchSearch(r.Context(), req)
+	if err == nil {
+		// batch search was successful
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// batch search request canceled
+		logger.Sugar().Warnf("%d batch search request canceled after %s", txid, time.Since(start).String())
+		w.WriteHeader(499)
+		io.WriteString(w, `{"error":"Client canceled batch search request"}`)
+		return
+	} else if errors.Is(err, ErrInvalidRequest) {
+		// batch search request invalid
+		logger.Sugar().Debugf("%d batch search request invalid: %s", txid, err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":"Invalid batch search request"}`)
+		return
+	} else {
+		// batch search failed
+		logger.Sugar().Errorf("%d batch search request failed: %s", txid, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, `{"error":"Batch search request failed"}`)
+		return
+	}
+
+	resBytes, err := json.Marshal(res)
+	if err != nil {
+		logger.Sugar().Errorf("%d database response marshal failed: %v", txid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, `{"error":"Response failed"}`)
+		return
+	}
+
+	// Set the response headers and write the JSON response
+	w.WriteHeader(http.StatusOK)
+	w.Write(resBytes)
+	logger.Sugar().Infof("%d batch search request suceeded (%dms)", txid, time.Since(start).Milliseconds())
+}
+
+// BatchSearch runs many vector searches against one category, sharing the embedding call and document fetches between queries.
+func (s *Server) BatchSearch(ctx context.Context, req BatchSearchRequest) (res BatchSearchResponse, err error) {
+	req.Count = max(1, min(req.Count, s.config.Search.GetMaxCount()))
+	req.Chunks = max(1, min(req.Chunks, config.CHUNK_LIMIT))
+	if req.Centroids < 0 {
+		req.Centroids = math.MaxInt
+	} else if req.Centroids == 0 && req.Probe == nil {
+		req.Probe = &ProbeOptions{}
+	}
+	if req.Probe != nil {
+		if req.Centroids > 0 {
+			return res, errors.Join(ErrInvalidRequest, errors.New("probe cannot be combined with a fixed centroid count"))
+		}
+		err = req.Probe.Validate(s.config.Search)
+		if err != nil {
+			return res, errors.Join(ErrInvalidRequest, err)
+		}
+	}
+	if len(req.Queries) == 0 || len(req.Queries) > config.BATCH_QUERY_LIMIT {
+		return res, errors.Join(ErrInvalidRequest, fmt.Errorf("batch must contain between 1 and %d queries", config.BATCH_QUERY_LIMIT))
+	}
+	for idx, query := range req.Queries {
+		if (query.Text == "") == (len(query.Vector) == 0) {
+			return res, errors.Join(ErrInvalidRequest, fmt.Errorf("query %d requires either text or a vector", idx))
+		}
+	}
+	res.Results = make([]SearchResponse, len(req.Queries))
+	for idx := range res.Results {
+		res.Results[idx].Documents = []DocumentSearch{}
+	}
+	logger.Sugar().Debugf("batch search request received: %d", len(req.Queries))
+
+	// Get embeddings
+	targets := make([][]uint8, len(req.Queries))
+	embedInput := make([]string, 0, len(req.Queries))
+	embedIdxList := make([]int, 0, len(req.Queries))
+	for idx, query := range req.Queries {
+		if len(query.Vector) > 0 {
+			targets[idx] = compute.QuantizeVectorFloat32(query.Vector)
+			continue
+		}
+		embedInput = append(embedInput, fmt.Sprintf("search_query: %s", query.Text))
+		embedIdxList = append(embedIdxList, idx)
+	}
+	if len(embedInput) > 0 {
+		logger.Sugar().Debugf("embedding search queries: %d", len(embedInput))
+		embedRes, err := s.ai.Embed(ctx, aicomms.EmbedRequest{
+			Model: s.ai.EmbedModel(),
+			Input: embedInput,
+		})
+		if err == nil {
+			// success
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			// request canceled
+			return res, err
+		} else {
+			// exception encountered
+			return res, errors.Join(errors.New("failed to embed search queries"), err)
+		}
+		if len(embedRes.Embeddings) < len(embedInput) {
+			return res, errors.New("embedding returned empty response")
+		}
+		for idx, embedding := range embedRes.Embeddings.Value()[:len(embedInput)] {
+			targets[embedIdxList[idx]] = embedding
+		}
+	}
+
+	// Get Category
+	categories, err := s.findCategories(ctx, req.Owner, []string{req.Category}, false, nil)
+	if err == nil {
+		// categories found
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// categories request canceled
+		return res, err
+	} else if errors.Is(err, gorm.ErrRecordNotFound) {
+		// owner not found
+		return res, nil
+	} else {
+		// categories retrieve error
+		return res, err
+	}
+	if len(categories) == 0 {
+		return res, nil
+	}
+	category := categories[0]
+
+	// Rank documents
+	query := vectorQuery{
+		centroids:     req.Centroids,
+		limit:         req.Count,
+		chunks:        req.Chunks,
+		minSimilarity: req.MinSimilarity,
+		ef:            s.config.Search.GetEF(),
+		rescore:       config.PQ_RESCORE,
+		prefilter:     config.PREFILTER_CANDIDATES,
+	}
+	if req.Probe != nil {
+		query.centroids = int(s.config.Search.GetMaxProbe())
+		query.adaptive = req.Probe
+	}
+	results, err := s.batchVectorSearch(ctx, category, targets, query)
+	if err == nil {
+		// success
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// request canceled
+		return res, err
+	} else {
+		// exception encountered
+		return res, errors.Join(errors.New("failed to rank documents"), err)
+	}
+
+	// Fetch closest documents data and matched chunks text once for all queries
+	logger.Sugar().Debug("fetching nearest documents")
+	var unique []documentSimilarity
+	seen := make(map[uint64]struct{})
+	for _, closestDocuments := range results {
+		for idx := range closestDocuments {
+			// aggregation keeps more chunks than are returned
+			closestDocuments[idx].chunks = closestDocuments[idx].chunks[:min(uint(len(closestDocuments[idx].chunks)), req.Chunks)]
+		}
+		for _, item := range closestDocuments {
+			if _, ok := seen[item.documentID]; ok {
+				continue
+			}
+			seen[item.documentID] = struct{}{}
+			unique = append(unique, item)
+		}
+	}
+	documents := make(map[uint64]database.Document, len(unique))
+	chunks := make(map[uint64]database.Embedding)
+	for batch := range slices.Chunk(unique, config.BATCH_SIZE_DATABASE) {
+		err = s.fetchDocuments(ctx, batch)
+		if err == nil {
+			// success
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			// request canceled
+			return res, err
+		} else {
+			// exception encountered
+			return res, errors.Join(errors.New("database document retrieval failed"), err)
+		}
+		for _, item := range batch {
+			documents[item.documentID] = item.document
+		}
+	}
+	matched := slices.Concat(results...)
+	for batch := range slices.Chunk(matched, max(1, config.BATCH_SIZE_DATABASE/int(req.Chunks))) {
+		batchChunks, err := s.fetchChunks(ctx, batch)
+		if err == nil {
+			// success
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			// request canceled
+			return res, err
+		} else {
+			// exception encountered
+			return res, errors.Join(errors.New("database chunk retrieval failed"), err)
+		}
+		for id, chunk := range batchChunks {
+			chunks[id] = chunk
+		}
+	}
+
+	// Create response
+	logger.Sugar().Debug("creating response")
+	for idx, closestDocuments := range results {
+		res.Results[idx].Documents = make([]DocumentSearch, len(closestDocuments))
+		for docIdx, item := range closestDocuments {
+			item.document = documents[item.documentID]
+			res.Results[idx].Documents[docIdx] = searchDocument(item, category.Name, chunks, nil)
+		}
+	}
+
+	return res, nil
+}
+
+// batchVectorSearch scores every target against the category centroids in one pass and scans each probed centroid once,
+// comparing its embeddings with all targets that probe it.
+// Adaptive probing, graph and product quantization indexes, the binary prefilter and the in-memory index search each target on its own.
+func (s *Server) batchVectorSearch(ctx context.Context, category database.Category, targets [][]uint8, query vectorQuery) (results [][]documentSimilarity, err error) {
+	results = make([][]documentSimilarity, len(targets))
+	if query.aggregation == nil {
+		query.aggregation = &category.Aggregation
+	}
+	query.calibrations, err = s.fetchCalibrations(ctx, category, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Search each target on its own when the scan cannot be shared
+	shared := query.adaptive == nil && category.IndexType == database.IndexTypeIVF && !category.BinaryPrefilter
+	if shared {
+		resident, err := s.residentCategory(ctx, category, query)
+		if err != nil {
+			return nil, err
+		}
+		shared = resident == nil
+	}
+	if !shared {
+		for idx, target := range targets {
+			targetQuery := query
+			targetQuery.target = target
+			results[idx], err = s.categoryVectorSearch(ctx, category, targetQuery)
+			if errors.Is(err, ErrInvalidRequest) {
+				return nil, errors.Join(fmt.Errorf("query %d is invalid", idx), err)
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		return results, nil
+	}
+
+	// Get Centroids
+	var centroids []database.Centroid
+	if query.minSimilarity != nil {
+		centroids, err = s.fetchCoveringCentroids(ctx, category, nil)
+	} else {
+		centroids, err = s.fetchCentroids(ctx, category, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(centroids) == 0 {
+		return results, nil
+	}
+	for idx, target := range targets {
+		if len(centroids[0].Vector) != len(target) {
+			return nil, errors.Join(ErrInvalidRequest, fmt.Errorf("query %d dimensions %d do not match category dimensions %d", idx, len(target)-8, len(centroids[0].Vector)-8))
+		}
+	}
+
+	// Find closest centroids to every target
+	matrixCentroids := make([][]uint8, len(centroids))
+	for idx, centroid := range centroids {
+		matrixCentroids[idx] = centroid.Vector
+	}
+	logger.Sugar().Debugf("calculate nearest centroids: %d x %d", len(targets), len(centroids))
+	centroidMatrix, err := compute.NewMatrix(matrixCentroids)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to decode centroids"), err)
+	}
+	targetMatrix, err := compute.NewMatrix(targets)
+	if err != nil {
+		return nil, errors.Join(ErrInvalidRequest, err)
+	}
+	centroidSimilarities, _ := centroidMatrix.MatrixCosineSimilarity(targetMatrix)
+	probes := make(map[uint64][]int)
+	for targetIdx := range targets {
+		similarities := centroidSimilarities[targetIdx*len(centroids) : (targetIdx+1)*len(centroids)]
+		order := make([]int, len(centroids))
+		for idx := range order {
+			order[idx] = idx
+		}
+		slices.SortFunc(order, func(a, b int) int {
+			return cmp.Compare(similarities[b], similarities[a])
+		})
+		for _, idx := range order[:min(query.centroids, len(order))] {
+			if query.minSimilarity != nil && similarityBound(similarities[idx], centroids[idx].MinSimilarity) < *query.minSimilarity {
+				continue
+			}
+			probes[centroids[idx].ID] = append(probes[centroids[idx].ID], targetIdx)
+		}
+	}
+	if len(probes) == 0 {
+		return results, nil
+	}
+	probedCentroidIdList := make([]uint64, 0, len(probes))
+	for id := range probes {
+		probedCentroidIdList = append(probedCentroidIdList, id)
+	}
+	logger.Sugar().Debugf("probed centroids: %d", len(probedCentroidIdList))
+
+	// Scan each probed centroid once, comparing its embeddings with the targets that probe it
+	var embeddings []database.Embedding
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Read).
+		Select("id", "document_id", "centroid_id", "ordinal", "vector").
+		Where("centroid_id IN ?", probedCentroidIdList).
+		FindInBatches(&embeddings, config.BATCH_SIZE_DATABASE, func(tx *gorm.DB, n int) error {
+			// targets probing any centroid of the batch
+			active := make([]int, 0, len(targets))
+			activeIdx := make(map[int]int)
+			for _, embedding := range embeddings {
+				for _, targetIdx := range probes[embedding.CentroidID] {
+					if _, ok := activeIdx[targetIdx]; !ok {
+						activeIdx[targetIdx] = len(active)
+						active = append(active, targetIdx)
+					}
+				}
+			}
+			matrixTargets := make([][]uint8, len(active))
+			for idx, targetIdx := range active {
+				matrixTargets[idx] = targets[targetIdx]
+			}
+			matrixEmbeddings := make([][]uint8, len(embeddings))
+			for idx, embedding := range embeddings {
+				matrixEmbeddings[idx] = embedding.Vector
+			}
+			matrix, err := query.calibrations.NewMatrix(matrixEmbeddings)
+			if err != nil {
+				return err
+			}
+			targetMatrix, err := compute.NewMatrix(matrixTargets)
+			if err != nil {
+				return err
+			}
+			similarities, _ := matrix.MatrixCosineSimilarity(targetMatrix)
+			// collect candidates per target
+			candidates := make(map[int][]documentSimilarity, len(active))
+			for idx, embedding := range embeddings {
+				for _, targetIdx := range probes[embedding.CentroidID] {
+					similarity := similarities[activeIdx[targetIdx]*len(embeddings)+idx]
+					if query.minSimilarity != nil && similarity < *query.minSimilarity {
+						continue
+					}
+					candidates[targetIdx] = append(candidates[targetIdx], documentSimilarity{
+						documentID: embedding.DocumentID,
+						similarity: similarity,
+						chunks: []chunkSimilarity{{
+							embeddingID: embedding.ID,
+							ordinal:     embedding.Ordinal,
+							similarity:  similarity,
+							vector:      embedding.Vector,
+						}},
+					})
+				}
+			}
+			for targetIdx, targetCandidates := range candidates {
+				results[targetIdx] = rankCandidates(append(results[targetIdx], targetCandidates...), query)
+			}
+			return nil
+		}).
+		Error
+	if err == nil {
+		// success
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// request canceled
+		return nil, err
+	} else {
+		// exception encountered
+		return nil, errors.Join(errors.New("database document embedding batch retrieval failed"), err)
+	}
+	for idx := range results {
+		results[idx], err = s.rankDocuments(ctx, results[idx], query)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
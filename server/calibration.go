@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"time"
+
+	"github.com/expki/go-vectorsearch/compute"
+	"github.com/expki/go-vectorsearch/config"
+	"github.com/expki/go-vectorsearch/database"
+	_ "github.com/expki/go-vectorsearch/env"
+	"github.com/expki/go-vectorsearch/logger"
+	"gorm.io/plugin/dbresolver"
+)
+
+// fetchCalibrations retrieves the calibrations of the category through the cache, stored vectors of the category are decoded with them.
+func (s *Server) fetchCalibrations(ctx context.Context, category database.Category, explain *SearchExplain) (calibrations compute.Calibrations, err error) {
+	start := time.Now()
+	fromDatabase := false
+	calibrations, err = s.cache.FetchCalibrations(category.ID, func() (compute.Calibrations, error) {
+		logger.Sugar().Debug("retrieve calibrations from database")
+		fromDatabase = true
+		var stored []database.Calibration
+		err := s.db.WithContext(ctx).Clauses(dbresolver.Read).Where("category_id = ?", category.ID).Find(&stored).Error
+		if err != nil {
+			return nil, err
+		}
+		calibrations := make(compute.Calibrations, len(stored))
+		for _, item := range stored {
+			var calibration compute.Calibration
+			err = calibration.UnmarshalBinary(item.Data)
+			if err != nil {
+				return nil, errors.Join(fmt.Errorf("failed to decode calibration %d", item.ID), err)
+			}
+			calibrations[item.ID] = calibration
+		}
+		return calibrations, nil
+	})
+	explain.cache("calibrations", category.Name, fromDatabase, start)
+	if err == nil {
+		// calibrations found
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// calibrations request canceled
+		return nil, err
+	} else {
+		// calibrations retrieve error
+		return nil, errors.Join(errors.New("failed to get calibrations"), err)
+	}
+	return calibrations, nil
+}
+
+// activeCalibration returns the calibration new vectors of the category are quantized with, ok is false while the category has none.
+// It is the latest calibration older than the cache duration, every server has it cached by then.
+func (s *Server) activeCalibration(ctx context.Context, categoryID uint64) (id uint32, ok bool, err error) {
+	var stored []database.Calibration
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Read).
+		Select("id").
+		Where("category_id = ? AND last_updated <= ?", categoryID, time.Now().Add(-config.CACHE_DURATION)).
+		Order("id DESC").
+		Limit(1).
+		Find(&stored).
+		Error
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return 0, false, err
+	} else {
+		return 0, false, errors.Join(errors.New("failed to get active calibration"), err)
+	}
+	if len(stored) == 0 {
+		return 0, false, nil
+	}
+	return stored[0].ID, true, nil
+}
+
+// quantizeEmbeddings sets the vector of new embeddings, quantized with the active calibration of calibrated categories and by their min/max otherwise.
+// Vectors that the active calibration does not fit are quantized by their min/max and migrated by the next centroid refresh.
+func (s *Server) quantizeEmbeddings(ctx context.Context, category database.Category, calibrations compute.Calibrations, embeddings []*database.Embedding, vectors [][]float32) (err error) {
+	var id uint32
+	var calibration compute.Calibration
+	active := false
+	if category.Quantization == database.QuantizationCalibrated {
+		id, active, err = s.activeCalibration(ctx, category.ID)
+		if err != nil {
+			return err
+		}
+		if active {
+			calibration, active = calibrations[id]
+		}
+	}
+	for idx, embedding := range embeddings {
+		if active && len(vectors[idx]) == len(calibration.Offset) {
+			embedding.Vector = compute.QuantizeVectorCalibrated(vectors[idx], id, calibration)
+		} else {
+			embedding.Vector = compute.QuantizeVectorFloat32(vectors[idx])
+		}
+	}
+	return nil
+}
+
+// quantizeLike quantizes the vector with the encoding of the stored vector so both can be compared byte for byte.
+func quantizeLike(stored []uint8, vector []float32, calibrations compute.Calibrations) (vectorQuantized []uint8, err error) {
+	id, ok := compute.CalibrationID(stored)
+	if !ok {
+		return compute.QuantizeVectorFloat32(vector), nil
+	}
+	calibration, ok := calibrations[id]
+	if !ok {
+		return nil, fmt.Errorf("calibration %d is not loaded", id)
+	}
+	return compute.QuantizeVectorCalibrated(vector, id, calibration), nil
+}
+
+// fetchCategoriesCalibrations merges the calibrations of the categories, calibration ids are unique across categories.
+func (s *Server) fetchCategoriesCalibrations(ctx context.Context, categories []database.Category, explain *SearchExplain) (calibrations compute.Calibrations, err error) {
+	calibrations = make(compute.Calibrations)
+	for _, category := range categories {
+		categoryCalibrations, err := s.fetchCalibrations(ctx, category, explain)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(calibrations, categoryCalibrations)
+	}
+	return calibrations, nil
+}
@@ -0,0 +1,358 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/expki/go-vectorsearch/config"
+	"github.com/expki/go-vectorsearch/database"
+	_ "github.com/expki/go-vectorsearch/env"
+	"github.com/expki/go-vectorsearch/logger"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/plugin/dbresolver"
+)
+
+type ConfigureCategoryRequest struct {
+	Owner           string                 `json:"owner"`
+	Category        string                 `json:"category"`
+	IndexedFields   *[]string              `json:"indexed_fields,omitempty"`
+	Aggregation     *database.Aggregation  `json:"aggregation,omitempty"`
+	IndexType       *database.IndexType    `json:"index_type,omitempty"`
+	BinaryPrefilter *bool                  `json:"binary_prefilter,omitempty"`
+	Quantization    *database.Quantization `json:"quantization,omitempty"`
+}
+
+type ConfigureCategoryResponse struct {
+	IndexedFields   []string              `json:"indexed_fields"`
+	Aggregation     database.Aggregation  `json:"aggregation"`
+	IndexType       database.IndexType    `json:"index_type"`
+	BinaryPrefilter bool                  `json:"binary_prefilter"`
+	Quantization    database.Quantization `json:"quantization"`
+}
+
+func (s *Server) ConfigureCategoryHttp(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	txid := index.Add(1)
+	logger.Sugar().Debugf("%d configure category started", txid)
+	w.Header().Set("Content-Type", "application/json")
+
+	// Ensure the request method is POST
+	if r.Method != http.MethodPost {
+		logger.Sugar().Debugf("%d request method denied: %s", txid, r.Method)
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, `{"error":"Invalid request method"}`)
+		return
+	}
+
+	// Read the request body
+	logger.Sugar().Debugf("%d reading request body", txid)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Sugar().Debugf("%d request body invalid: %v", txid, err)
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":"Invalid request body"}`)
+		return
+	}
+	defer r.Body.Close()
+
+	// Parse the JSON request body into the RequestBody struct
+	logger.Sugar().Debugf("%d unmarshing request body", txid)
+	var req ConfigureCategoryRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		logger.Sugar().Debugf("%d request invalid: %v", txid, err)
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":"Invalid request"}`)
+		return
+	}
+
+	// Handle the configure request
+	res, err := s.ConfigureCategory(r.Context(), req)
+	if err == nil {
+		// configure was successful
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// configure request canceled
+		logger.Sugar().Warnf("%d configure category request canceled after %s", txid, time.Since(start).String())
+		w.WriteHeader(499)
+		io.WriteString(w, `{"error":"Client canceled configure request"}`)
+		return
+	} else if errors.Is(err, ErrInvalidRequest) {
+		// configure request invalid
+		logger.Sugar().Debugf("%d configure category request invalid: %s", txid, err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":"Invalid configure request"}`)
+		return
+	} else {
+		// configure failed
+		logger.Sugar().Errorf("%d configure category request failed: %s", txid, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, `{"error":"Configure request failed"}`)
+		return
+	}
+
+	// Marshal response
+	raw, err := json.Marshal(res)
+	if err != nil {
+		logger.Sugar().Errorf("%d marshal response: %v", txid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, `{"error":"Marshal response exception"}`)
+		return
+	}
+
+	// Set the response headers and write the JSON response
+	w.WriteHeader(http.StatusOK)
+	w.Write(raw)
+	logger.Sugar().Infof("%d configure category request suceeded (%dms)", txid, time.Since(start).Milliseconds())
+}
+
+// ConfigureCategory updates the search settings of an existing category.
+// Changing the indexed fields rebuilds the attribute index of every document in the category.
+// Switching to the hnsw index type links every embedding of the category into its graph.
+// Enabling the binary prefilter stores the sign bits of every embedding of the category.
+// Changing the quantization migrates the stored vectors during the next centroid refresh.
+func (s *Server) ConfigureCategory(ctx context.Context, req ConfigureCategoryRequest) (res ConfigureCategoryResponse, err error) {
+	if req.Aggregation != nil {
+		if err = validateAggregation(req.Aggregation); err != nil {
+			return res, errors.Join(ErrInvalidRequest, err)
+		}
+	}
+	if req.IndexType != nil {
+		switch *req.IndexType {
+		case database.IndexTypeIVF, database.IndexTypeIVFPQ, database.IndexTypeHNSW:
+		default:
+			return res, errors.Join(ErrInvalidRequest, fmt.Errorf("unknown index type: %s", *req.IndexType))
+		}
+	}
+	if req.Quantization != nil {
+		switch *req.Quantization {
+		case database.QuantizationMinMax, database.QuantizationCalibrated:
+		default:
+			return res, errors.Join(ErrInvalidRequest, fmt.Errorf("unknown quantization: %s", *req.Quantization))
+		}
+	}
+
+	// Get Owner
+	var owner database.Owner
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Read).Where("name = ?", req.Owner).Take(&owner).Error
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return res, err
+	} else if errors.Is(err, gorm.ErrRecordNotFound) {
+		return res, errors.Join(ErrInvalidRequest, errors.New("owner not found"))
+	} else {
+		return res, errors.Join(errors.New("get owner exception"), err)
+	}
+
+	// Get Category
+	var category database.Category
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Write).Where("name = ? AND owner_id = ?", req.Category, owner.ID).Take(&category).Error
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return res, err
+	} else if errors.Is(err, gorm.ErrRecordNotFound) {
+		return res, errors.Join(ErrInvalidRequest, errors.New("category not found"))
+	} else {
+		return res, errors.Join(errors.New("get category exception"), err)
+	}
+
+	// Update indexed fields
+	if req.IndexedFields != nil {
+		fields := slices.Clone(*req.IndexedFields)
+		slices.Sort(fields)
+		fields = slices.Compact(fields)
+		fields = slices.DeleteFunc(fields, func(field string) bool { return field == "" })
+		if !slices.Equal(fields, category.IndexedFields) {
+			category.IndexedFields = fields
+			// switch the fields with the rebuilt index so searches never filter on a partial index
+			// the fields are updated first so uploads saving attributes finish before the rebuild and later uploads read the new fields
+			err = s.db.WithContext(ctx).Clauses(dbresolver.Write).Transaction(func(tx *gorm.DB) error {
+				err := tx.Model(&category).Select("indexed_fields").Updates(&category).Error
+				if err != nil {
+					return err
+				}
+				return rebuildAttributes(tx, category)
+			})
+			if err == nil {
+			} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+				return res, err
+			} else {
+				return res, errors.Join(errors.New("rebuild attributes exception"), err)
+			}
+			s.cache.InvalidateCategory(category.Name, owner.ID)
+		}
+	}
+
+	// Update chunk aggregation
+	if req.Aggregation != nil {
+		category.Aggregation = *req.Aggregation
+		err = s.db.WithContext(ctx).Clauses(dbresolver.Write).Model(&category).Select("aggregation").Updates(&category).Error
+		if err == nil {
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			return res, err
+		} else {
+			return res, errors.Join(errors.New("update category exception"), err)
+		}
+		s.cache.InvalidateCategory(category.Name, owner.ID)
+	}
+
+	// Update index type
+	if category.IndexType == "" {
+		category.IndexType = database.IndexTypeIVF
+	}
+	if req.IndexType != nil && *req.IndexType != category.IndexType {
+		if *req.IndexType == database.IndexTypeHNSW {
+			// build before switching so searches never see a partial graph
+			err = s.buildGraph(ctx, category)
+			if err == nil {
+			} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+				return res, err
+			} else {
+				return res, errors.Join(errors.New("build graph exception"), err)
+			}
+		}
+		category.IndexType = *req.IndexType
+		err = s.db.WithContext(ctx).Clauses(dbresolver.Write).Model(&category).Select("index_type").Updates(&category).Error
+		if err == nil {
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			return res, err
+		} else {
+			return res, errors.Join(errors.New("update category exception"), err)
+		}
+		s.cache.InvalidateCategory(category.Name, owner.ID)
+		if category.IndexType == database.IndexTypeHNSW {
+			// link embeddings uploaded while the graph was built
+			err = s.buildGraph(ctx, category)
+		} else {
+			err = s.dropGraph(ctx, category)
+		}
+		if err == nil {
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			return res, err
+		} else {
+			return res, errors.Join(errors.New("update graph exception"), err)
+		}
+		if category.IndexType != database.IndexTypeIVFPQ {
+			err = s.dropCodes(ctx, category)
+			if err == nil {
+			} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+				return res, err
+			} else {
+				return res, errors.Join(errors.New("drop codes exception"), err)
+			}
+		}
+	}
+
+	// Update binary prefilter
+	if req.BinaryPrefilter != nil && *req.BinaryPrefilter != category.BinaryPrefilter {
+		category.BinaryPrefilter = *req.BinaryPrefilter
+		err = s.db.WithContext(ctx).Clauses(dbresolver.Write).Model(&category).Select("binary_prefilter").Updates(&category).Error
+		if err == nil {
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			return res, err
+		} else {
+			return res, errors.Join(errors.New("update category exception"), err)
+		}
+		s.cache.InvalidateCategory(category.Name, owner.ID)
+		if category.BinaryPrefilter {
+			// embeddings uploaded since the switch already carry bits
+			err = s.backfillBits(ctx, category)
+		} else {
+			err = s.dropBits(ctx, category)
+		}
+		if err == nil {
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			return res, err
+		} else {
+			return res, errors.Join(errors.New("update bits exception"), err)
+		}
+	}
+
+	// Update quantization
+	if category.Quantization == "" {
+		category.Quantization = database.QuantizationMinMax
+	}
+	if req.Quantization != nil && *req.Quantization != category.Quantization {
+		category.Quantization = *req.Quantization
+		err = s.db.WithContext(ctx).Clauses(dbresolver.Write).Model(&category).Select("quantization").Updates(&category).Error
+		if err == nil {
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			return res, err
+		} else {
+			return res, errors.Join(errors.New("update category exception"), err)
+		}
+		s.cache.InvalidateCategory(category.Name, owner.ID)
+	}
+
+	// Create response
+	res.IndexType = category.IndexType
+	res.BinaryPrefilter = category.BinaryPrefilter
+	res.Quantization = category.Quantization
+	res.Aggregation = category.Aggregation
+	if res.Aggregation.Mode == "" {
+		res.Aggregation.Mode = database.AggregationMax
+	}
+	res.IndexedFields = category.IndexedFields
+	if res.IndexedFields == nil {
+		res.IndexedFields = []string{}
+	}
+	return res, nil
+}
+
+// indexedFields reads the indexed fields of the category within the transaction.
+// The category row is share locked on PostgreSQL so a field change waits for the transaction to commit.
+func indexedFields(tx *gorm.DB, provider config.DatabaseProvider, categoryID uint64) (fields []string, err error) {
+	if provider == config.DatabaseProvider_PostgreSQL {
+		tx = tx.Clauses(clause.Locking{
+			Strength: "SHARE",
+			Table:    clause.Table{Name: clause.CurrentTable},
+		})
+	}
+	var category database.Category
+	err = tx.Select("id", "indexed_fields").Take(&category, categoryID).Error
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to get indexed fields"), err)
+	}
+	return category.IndexedFields, nil
+}
+
+// rebuildAttributes replaces the attribute index of every document in the category within the transaction.
+func rebuildAttributes(tx *gorm.DB, category database.Category) (err error) {
+	logger.Sugar().Debugf("rebuilding attributes for category: %d", category.ID)
+	err = tx.
+		Where("document_id IN (?)", tx.Model(&database.Document{}).Select("id").Where("category_id = ?", category.ID)).
+		Delete(&database.Attribute{}).
+		Error
+	if err != nil {
+		return errors.Join(errors.New("failed to delete attributes"), err)
+	}
+	if len(category.IndexedFields) == 0 {
+		return nil
+	}
+	var documents []database.Document
+	return tx.
+		Select("id", "document").
+		Where("category_id = ?", category.ID).
+		FindInBatches(&documents, config.BATCH_SIZE_DATABASE, func(_ *gorm.DB, batch int) error {
+			attributes := make([]*database.Attribute, 0, len(documents))
+			for _, document := range documents {
+				for _, attribute := range buildAttributes(document.Document.JSON(), category.IndexedFields) {
+					attribute.DocumentID = document.ID
+					attributes = append(attributes, attribute)
+				}
+			}
+			if len(attributes) == 0 {
+				return nil
+			}
+			return tx.Omit(clause.Associations).CreateInBatches(&attributes, config.BATCH_SIZE_DATABASE).Error
+		}).
+		Error
+}
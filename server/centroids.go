@@ -10,6 +10,7 @@ import (
 	"github.com/expki/go-vectorsearch/database"
 	"github.com/expki/go-vectorsearch/dnc"
 	"github.com/expki/go-vectorsearch/logger"
+	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 	"gorm.io/plugin/dbresolver"
 )
@@ -58,6 +59,68 @@ func (d *Server) RefreshCentroids(appCtx context.Context) {
 			return
 		}
 
+		// Index keywords of documents uploaded before keyword search
+		err = d.backfillKeywords(appCtx, category.ID)
+		if err == nil {
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			logger.Sugar().Info("Refresh centroids cancelled")
+			if d.db.Provider == config.DatabaseProvider_PostgreSQL {
+				tx.Rollback()
+			}
+			return
+		} else {
+			logger.Sugar().Errorw("Failed to backfill keywords", "error", err)
+		}
+
+		// Store sign bits of embeddings uploaded before the binary prefilter
+		if category.BinaryPrefilter {
+			err = d.backfillBits(appCtx, category)
+			if err == nil {
+			} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+				logger.Sugar().Info("Refresh centroids cancelled")
+				if d.db.Provider == config.DatabaseProvider_PostgreSQL {
+					tx.Rollback()
+				}
+				return
+			} else {
+				logger.Sugar().Errorw("Failed to backfill bits", "error", err)
+			}
+		}
+
+		// Repair the graph and link embeddings an interrupted upload left out of it
+		if category.IndexType == database.IndexTypeHNSW {
+			err = d.buildGraph(appCtx, category)
+			if err == nil {
+			} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+				logger.Sugar().Info("Refresh centroids cancelled")
+				if d.db.Provider == config.DatabaseProvider_PostgreSQL {
+					tx.Rollback()
+				}
+				return
+			} else if errors.Is(err, errGraphOverBudget) {
+				logger.Sugar().Warnw("Graph exceeds graph memory budget", "category", category.ID)
+			} else {
+				logger.Sugar().Errorw("Failed to build graph", "error", err)
+			}
+		}
+
+		// Unload the in-memory index of every process while embeddings are reassigned to new centroids
+		err = d.changeIndex(appCtx, category.ID)
+		if err == nil {
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			logger.Sugar().Info("Refresh centroids cancelled")
+			if d.db.Provider == config.DatabaseProvider_PostgreSQL {
+				tx.Rollback()
+			}
+			return
+		} else {
+			logger.Sugar().Errorw("Failed to update index version", "error", err)
+			if d.db.Provider == config.DatabaseProvider_PostgreSQL {
+				tx.Rollback()
+			}
+			return
+		}
+
 		// Process category
 		err = dnc.KMeansDivideAndConquer(appCtx, d.db, category.ID, d.config.Database.Cache)
 		if err == nil {
@@ -74,6 +137,18 @@ func (d *Server) RefreshCentroids(appCtx context.Context) {
 			}
 			return
 		}
+		// embeddings were reassigned to new centroids
+		err = d.changeIndex(appCtx, category.ID)
+		if err == nil {
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			logger.Sugar().Info("Refresh centroids cancelled")
+			if d.db.Provider == config.DatabaseProvider_PostgreSQL {
+				tx.Rollback()
+			}
+			return
+		} else {
+			logger.Sugar().Errorw("Failed to update index version", "error", err)
+		}
 
 		// Unlock category
 		if d.db.Provider == config.DatabaseProvider_PostgreSQL {
@@ -81,3 +156,14 @@ func (d *Server) RefreshCentroids(appCtx context.Context) {
 		}
 	}
 }
+
+// changeIndex unloads the in-memory index and cached centroids of the category in this process and marks it changed for other processes.
+func (d *Server) changeIndex(ctx context.Context, categoryID uint64) (err error) {
+	d.memory.Drop(categoryID)
+	err = d.db.WithContext(ctx).Clauses(dbresolver.Write).Transaction(func(tx *gorm.DB) error {
+		_, err := bumpIndexVersion(tx, categoryID)
+		return err
+	})
+	d.cache.InvalidateCentroids(categoryID)
+	return err
+}
@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/expki/go-vectorsearch/ai/aicomms"
+	"github.com/expki/go-vectorsearch/config"
 	"github.com/expki/go-vectorsearch/database"
 	_ "github.com/expki/go-vectorsearch/env"
 	"github.com/expki/go-vectorsearch/logger"
@@ -21,11 +22,19 @@ import (
 )
 
 type ChatRequest struct {
-	Prefix      string   `json:"prefix,omitempty"`
-	History     []string `json:"history,omitempty"`
-	Text        string   `json:"text"`
-	DocumentIDs []uint64 `json:"document_ids,omitempty"`
-	Documents   []any    `json:"documents,omitempty"`
+	Prefix        string           `json:"prefix,omitempty"`
+	History       []string         `json:"history,omitempty"`
+	Text          string           `json:"text"`
+	DocumentIDs   []uint64         `json:"document_ids,omitempty"`
+	Documents     []any            `json:"documents,omitempty"`
+	Chunks        []ChunkReference `json:"chunks,omitempty"`
+	ContextWindow uint32           `json:"context_window,omitempty"`
+}
+
+// ChunkReference addresses a chunk of a stored document by its index.
+type ChunkReference struct {
+	DocumentID uint64 `json:"document_id"`
+	Index      uint32 `json:"index"`
 }
 
 func (s *Server) ChatHttp(w http.ResponseWriter, r *http.Request) {
@@ -122,9 +131,56 @@ func (s *Server) Chat(ctx context.Context, req ChatRequest) (resStream io.ReadCl
 		req.Documents = append(req.Documents, doc.Document.JSON())
 	}
 
+	// Get chunk passages
+	var passages map[uint64][]Passage
+	if len(req.Chunks) > 0 {
+		referenced := make([]documentSimilarity, 0, len(req.Chunks))
+		referencedIdx := make(map[uint64]int, len(req.Chunks))
+		for _, chunk := range req.Chunks {
+			idx, ok := referencedIdx[chunk.DocumentID]
+			if !ok {
+				idx = len(referenced)
+				referencedIdx[chunk.DocumentID] = idx
+				referenced = append(referenced, documentSimilarity{documentID: chunk.DocumentID})
+			}
+			referenced[idx].chunks = append(referenced[idx].chunks, chunkSimilarity{ordinal: chunk.Index})
+		}
+		passages, err = s.fetchPassages(ctx, referenced, min(req.ContextWindow, config.WINDOW_LIMIT))
+		if err == nil {
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, err
+		} else {
+			return nil, errors.Join(fmt.Errorf(`retrieving passages failed`), err)
+		}
+	}
+
+	// Create messages
+	contextList := make([]string, 0, len(req.Documents)+len(passages))
+	for _, doc := range req.Documents {
+		contextList = append(contextList, Flatten(doc))
+	}
+	for _, chunk := range req.Chunks {
+		for _, passage := range passages[chunk.DocumentID] {
+			contextList = append(contextList, passage.Text)
+		}
+		delete(passages, chunk.DocumentID)
+	}
+	messages := chatMessages(req.History, contextList, req.Prefix, req.Text, "")
+
+	// Start chat
+	chat := s.ai.ChatStream(ctx, aicomms.ChatRequest{
+		Model:    s.ai.ChatModel(),
+		Messages: messages,
+	})
+
+	return chat, err
+}
+
+// chatMessages builds the chat history followed by the question with the context documents.
+func chatMessages(history []string, contextList []string, prefix, text, instruction string) (messages []aicomms.ChatMessage) {
 	// Create history chat
-	messages := make([]aicomms.ChatMessage, len(req.History), len(req.History)+1)
-	for idx, content := range req.History {
+	messages = make([]aicomms.ChatMessage, len(history), len(history)+1)
+	for idx, content := range history {
 		var role string
 		if idx%2 == 0 {
 			role = "user"
@@ -139,43 +195,41 @@ func (s *Server) Chat(ctx context.Context, req ChatRequest) (resStream io.ReadCl
 
 	// Add document context
 	var query strings.Builder
-	if len(req.Documents) > 0 {
+	if len(contextList) > 0 {
 		query.WriteString("I have ")
-		query.WriteString(strconv.Itoa(len(req.Documents)))
+		query.WriteString(strconv.Itoa(len(contextList)))
 		query.WriteString(" text document that I'd like to use as context for my question. Here's the relevant part")
-		if len(req.Documents) > 1 {
+		if len(contextList) > 1 {
 			query.WriteRune('s')
 		}
 		query.WriteString(":\n\n")
-		for _, doc := range req.Documents {
+		for _, doc := range contextList {
 			query.WriteString(`"""`)
-			query.WriteString(Flatten(doc))
+			query.WriteString(doc)
 			query.WriteString(`"""`)
 			query.WriteRune('\n')
 		}
 		query.WriteRune('\n')
 	}
 
+	// Add instruction
+	if instruction != "" {
+		query.WriteString(instruction)
+		query.WriteString("\n\n")
+	}
+
 	// Construct question
 	query.WriteString("My question is: ")
 
 	// Add query
-	if req.Prefix != "" {
-		req.Text = fmt.Sprintf(`%s. %s`, req.Prefix, req.Text)
+	if prefix != "" {
+		text = fmt.Sprintf(`%s. %s`, prefix, text)
 	}
-	query.WriteString(req.Text)
+	query.WriteString(text)
 
 	// Construct message
-	messages = append(messages, aicomms.ChatMessage{
+	return append(messages, aicomms.ChatMessage{
 		Role:    "user",
 		Content: query.String(),
 	})
-
-	// Start chat
-	chat := s.ai.ChatStream(ctx, aicomms.ChatRequest{
-		Model:    s.ai.ChatModel(),
-		Messages: messages,
-	})
-
-	return chat, err
 }
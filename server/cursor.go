@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+
+	_ "github.com/expki/go-vectorsearch/env"
+)
+
+// searchCursor is the position of the last document of a page, encoded into the opaque next page cursor.
+type searchCursor struct {
+	Hash       uint64   `json:"h"`
+	Centroids  []uint64 `json:"c"`
+	Similarity float32  `json:"s"`
+	DocumentID uint64   `json:"d"`
+	Returned   uint     `json:"n"`
+}
+
+// cursorPosition is the last similarity and document id returned by the previous page.
+// Returned counts the documents ranked at or before the position.
+type cursorPosition struct {
+	similarity float32
+	documentID uint64
+	returned   uint
+}
+
+// passed reports whether a document with the similarity is ranked at or before the cursor position.
+func (p cursorPosition) passed(similarity float32, documentID uint64) bool {
+	return similarity > p.similarity || (similarity == p.similarity && documentID <= p.documentID)
+}
+
+// encode returns the cursor as an opaque url safe string.
+func (c searchCursor) encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeCursor parses a cursor returned by a previous page.
+func decodeCursor(encoded string) (cursor searchCursor, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, errors.Join(errors.New("cursor is not valid base64"), err)
+	}
+	err = json.Unmarshal(raw, &cursor)
+	if err != nil {
+		return cursor, errors.Join(errors.New("cursor is not valid"), err)
+	}
+	return cursor, nil
+}
+
+// queryHash identifies the query vector and the request options that change the ranking.
+func queryHash(target []uint8, req SearchRequest) uint64 {
+	options, _ := json.Marshal(struct {
+		Owner         string
+		Category      string
+		Categories    []string
+		AllCategories bool
+		Centroids     int
+		Probe         *ProbeOptions
+		EF            int
+		Chunks        uint
+		Filter        *Filter
+		MinSimilarity *float32
+		DocumentID    uint64
+		Positive      []QueryExample
+		Negative      []QueryExample
+	}{req.Owner, req.Category, req.Categories, req.AllCategories, req.Centroids, req.Probe, req.EF, req.Chunks, req.Filter, req.MinSimilarity, req.DocumentID, req.Positive, req.Negative})
+	hash := fnv.New64a()
+	hash.Write(target)
+	hash.Write(options)
+	return hash.Sum64()
+}
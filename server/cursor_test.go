@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/base64"
+	"slices"
+	"testing"
+)
+
+func TestCursorEncode(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor searchCursor
+	}{
+		{name: "empty", cursor: searchCursor{}},
+		{name: "first page", cursor: searchCursor{Hash: 1 << 63, Centroids: []uint64{4, 9, 2}, Similarity: 0.8125, DocumentID: 17, Returned: 10}},
+		{name: "negative similarity", cursor: searchCursor{Hash: 42, Centroids: []uint64{1}, Similarity: -0.25, DocumentID: 1 << 40, Returned: 1000}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded, err := decodeCursor(test.cursor.encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Hash != test.cursor.Hash || !slices.Equal(decoded.Centroids, test.cursor.Centroids) || decoded.Similarity != test.cursor.Similarity || decoded.DocumentID != test.cursor.DocumentID || decoded.Returned != test.cursor.Returned {
+				t.Errorf("decoded cursor %+v, want %+v", decoded, test.cursor)
+			}
+		})
+	}
+}
+
+func TestCursorDecodeInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{name: "empty", encoded: ""},
+		{name: "not base64", encoded: "not a cursor!"},
+		{name: "padded base64", encoded: base64.URLEncoding.EncodeToString([]byte(`{"h":1}`))},
+		{name: "not json", encoded: base64.RawURLEncoding.EncodeToString([]byte("cursor"))},
+		{name: "wrong types", encoded: base64.RawURLEncoding.EncodeToString([]byte(`{"h":"1","c":[1]}`))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if cursor, err := decodeCursor(test.encoded); err == nil {
+				t.Errorf("decoded invalid cursor as %+v", cursor)
+			}
+		})
+	}
+}
+
+func TestCursorPassed(t *testing.T) {
+	position := cursorPosition{similarity: 0.5, documentID: 10, returned: 3}
+	tests := []struct {
+		name       string
+		similarity float32
+		documentID uint64
+		passed     bool
+	}{
+		{name: "higher similarity", similarity: 0.6, documentID: 99, passed: true},
+		{name: "lower similarity", similarity: 0.4, documentID: 1, passed: false},
+		{name: "same document", similarity: 0.5, documentID: 10, passed: true},
+		{name: "tie with lower id", similarity: 0.5, documentID: 9, passed: true},
+		{name: "tie with higher id", similarity: 0.5, documentID: 11, passed: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if passed := position.passed(test.similarity, test.documentID); passed != test.passed {
+				t.Errorf("passed is %v, want %v", passed, test.passed)
+			}
+		})
+	}
+}
+
+func TestCursorPages(t *testing.T) {
+	documents := []documentSimilarity{
+		{documentID: 5, similarity: 0.9},
+		{documentID: 3, similarity: 0.7},
+		{documentID: 8, similarity: 0.7},
+		{documentID: 1, similarity: 0.7},
+		{documentID: 2, similarity: 0.2},
+		{documentID: 7, similarity: -0.1},
+		{documentID: 4, similarity: 0.7},
+	}
+	tests := []struct {
+		name  string
+		limit int
+	}{
+		{name: "single document pages", limit: 1},
+		{name: "pages splitting ties", limit: 2},
+		{name: "pages larger than ties", limit: 5},
+		{name: "single page", limit: 10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ranked := slices.Clone(documents)
+			slices.SortFunc(ranked, compareSimilarity)
+
+			// every page skips the documents passed by the cursor of the previous page
+			var paged []uint64
+			var after *cursorPosition
+			for range len(documents) {
+				page := slices.DeleteFunc(slices.Clone(ranked), func(document documentSimilarity) bool {
+					return after != nil && after.passed(document.similarity, document.documentID)
+				})
+				page = page[:min(test.limit, len(page))]
+				if len(page) == 0 {
+					break
+				}
+				for _, document := range page {
+					paged = append(paged, document.documentID)
+				}
+				last := page[len(page)-1]
+				after = &cursorPosition{similarity: last.similarity, documentID: last.documentID}
+			}
+			want := make([]uint64, len(ranked))
+			for idx, document := range ranked {
+				want[idx] = document.documentID
+			}
+			if !slices.Equal(paged, want) {
+				t.Errorf("pages returned %v, want %v", paged, want)
+			}
+		})
+	}
+}
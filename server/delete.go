@@ -212,6 +212,18 @@ func (s *Server) DeleteDocumentHttp(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) DeleteOwner(ctx context.Context, owner string) (err error) {
+	var categoryIDs []uint64
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Read).
+		Model(&database.Category{}).
+		Where("owner_id IN (?)", s.db.Model(&database.Owner{}).Select("id").Where("name = ?", owner)).
+		Pluck("id", &categoryIDs).
+		Error
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	} else {
+		return errors.Join(errors.New("get owner categories exception"), err)
+	}
 	err = s.db.WithContext(ctx).Clauses(dbresolver.Write).Where("name = ?", owner).Delete(&database.Owner{}).Error
 	if err == nil {
 	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
@@ -221,6 +233,10 @@ func (s *Server) DeleteOwner(ctx context.Context, owner string) (err error) {
 	} else {
 		return errors.Join(errors.New("delete owner exception"), err)
 	}
+	for _, categoryID := range categoryIDs {
+		s.memory.Drop(categoryID)
+		s.graphs.forget(categoryID)
+	}
 	return nil
 }
 
@@ -237,7 +253,17 @@ func (s *Server) DeleteCategory(ctx context.Context, ownerName, categoryName str
 	} else {
 		return errors.Join(errors.New("get owner exception"), err)
 	}
-	err = s.db.WithContext(ctx).Clauses(dbresolver.Write).Where("owner_id = ? AND name = ?", ownerDetails.ID, categoryName).Delete(&database.Category{}).Error
+	var categoryDetails database.Category
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Read).Where("owner_id = ? AND name = ?", ownerDetails.ID, categoryName).Select("id").Take(&categoryDetails).Error
+	if err == nil {
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	} else if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	} else {
+		return errors.Join(errors.New("get category exception"), err)
+	}
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Write).Delete(&database.Category{}, categoryDetails.ID).Error
 	if err == nil {
 	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
 		return err
@@ -246,6 +272,8 @@ func (s *Server) DeleteCategory(ctx context.Context, ownerName, categoryName str
 	} else {
 		return errors.Join(errors.New("delete category exception"), err)
 	}
+	s.memory.Drop(categoryDetails.ID)
+	s.graphs.forget(categoryDetails.ID)
 	return nil
 }
 
@@ -266,7 +294,7 @@ func (s *Server) DeleteDocument(ctx context.Context, ownerName, categoryName str
 		logger.Sugar().Debug("retrieve category from database")
 		return category, s.db.WithContext(ctx).Clauses(dbresolver.Read).Where("name = ? AND owner_id = ?", categoryName, ownerDetails.ID).Take(&category).Error
 	})
-	err = s.db.WithContext(ctx).Clauses(dbresolver.Read).Where("owner_id = ? AND name = ?", ownerDetails.ID, categoryName).Select("id").Take(&categoryDetails).Error
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Read).Where("owner_id = ? AND name = ?", ownerDetails.ID, categoryName).Select("id", "index_type").Take(&categoryDetails).Error
 	if err == nil {
 	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
 		return err
@@ -275,7 +303,16 @@ func (s *Server) DeleteDocument(ctx context.Context, ownerName, categoryName str
 	} else {
 		return errors.Join(errors.New("get category exception"), err)
 	}
-	err = s.db.WithContext(ctx).Clauses(dbresolver.Write).Where("category_id = ?", categoryDetails.ID).Delete(&database.Document{}, documentID).Error
+	var version uint64
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Write).Transaction(func(tx *gorm.DB) (err error) {
+		result := tx.Where("category_id = ?", categoryDetails.ID).Delete(&database.Document{}, documentID)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		// other processes load their in-memory index again
+		version, err = bumpIndexVersion(tx, categoryDetails.ID)
+		return err
+	})
 	if err == nil {
 	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
 		return err
@@ -284,5 +321,15 @@ func (s *Server) DeleteDocument(ctx context.Context, ownerName, categoryName str
 	} else {
 		return errors.Join(errors.New("delete document exception"), err)
 	}
+	s.memory.RemoveDocuments(categoryDetails.ID, version, []uint64{documentID})
+	if categoryDetails.IndexType == database.IndexTypeHNSW {
+		err = s.removeGraph(ctx, categoryDetails, []uint64{documentID})
+		if err == nil {
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		} else {
+			return errors.Join(errors.New("update graph exception"), err)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/expki/go-vectorsearch/compute"
+	"github.com/expki/go-vectorsearch/config"
+	_ "github.com/expki/go-vectorsearch/env"
+	"gorm.io/gorm"
+)
+
+// QueryExample is a text or stored document that pulls the query vector towards or away from it.
+type QueryExample struct {
+	Text       string  `json:"text,omitempty"`
+	DocumentID uint64  `json:"document_id,omitempty"`
+	Weight     float32 `json:"weight,omitempty"`
+}
+
+// exampleVector combines the query with the positive and negative examples Rocchio style,
+// adding the mean of the positive examples and subtracting the mean of the negative examples.
+// Text examples are taken in order from textEmbeddings, document examples are pooled and returned for exclusion.
+func (s *Server) exampleVector(ctx context.Context, categoryIDs []uint64, base []uint8, positive []QueryExample, negative []QueryExample, textEmbeddings [][]uint8, pooling Pooling) (target []uint8, documentIDs []uint64, err error) {
+	var vectors [][]uint8
+	var weights []float32
+	if base != nil {
+		vectors = append(vectors, base)
+		weights = append(weights, 1)
+	}
+	addExamples := func(examples []QueryExample, defaultWeight float32, sign float32) error {
+		for _, example := range examples {
+			var vector []uint8
+			if example.Text != "" {
+				vector, textEmbeddings = textEmbeddings[0], textEmbeddings[1:]
+			} else {
+				vector, err = s.documentVector(ctx, categoryIDs, example.DocumentID, pooling)
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return errors.Join(ErrInvalidRequest, fmt.Errorf("example document not found: %d", example.DocumentID))
+				} else if err != nil {
+					return err
+				}
+				documentIDs = append(documentIDs, example.DocumentID)
+			}
+			weight := example.Weight
+			if weight == 0 {
+				weight = defaultWeight
+			}
+			vectors = append(vectors, vector)
+			weights = append(weights, sign*weight/float32(len(examples)))
+		}
+		return nil
+	}
+	if err = addExamples(positive, config.POSITIVE_WEIGHT, 1); err != nil {
+		return nil, nil, err
+	}
+	if err = addExamples(negative, config.NEGATIVE_WEIGHT, -1); err != nil {
+		return nil, nil, err
+	}
+	for _, vector := range vectors[1:] {
+		if len(vector) != len(vectors[0]) {
+			return nil, nil, errors.Join(ErrInvalidRequest, fmt.Errorf("example dimensions %d do not match query dimensions %d", len(vector)-8, len(vectors[0])-8))
+		}
+	}
+	matrix, err := compute.DequantizeMatrixFloat32(vectors)
+	if err != nil {
+		return nil, nil, errors.Join(ErrInvalidRequest, err)
+	}
+	return compute.WeightedVector(matrix, weights), documentIDs, nil
+}
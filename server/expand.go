@@ -0,0 +1,137 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/expki/go-vectorsearch/ai/aicomms"
+	"github.com/expki/go-vectorsearch/config"
+	"github.com/expki/go-vectorsearch/database"
+	_ "github.com/expki/go-vectorsearch/env"
+	"github.com/expki/go-vectorsearch/logger"
+)
+
+type ExpansionMode string
+
+const (
+	ExpansionModeHyde       ExpansionMode = "hyde"
+	ExpansionModeMultiQuery ExpansionMode = "multi_query"
+)
+
+type ExpandOptions struct {
+	Mode    ExpansionMode `json:"mode"`
+	Queries uint          `json:"queries,omitempty"`
+	Model   string        `json:"model,omitempty"`
+}
+
+// expandQuery uses the generate model to write a hypothetical answer or paraphrased queries for the search text.
+// The embed inputs are returned alongside the generated text, nothing is returned if the model fails.
+func (s *Server) expandQuery(ctx context.Context, text string, options ExpandOptions) (expansions []string, inputs []string, err error) {
+	model := options.Model
+	if model == "" {
+		model = s.ai.GenerateModel()
+	}
+	var request aicomms.GenerateRequest
+	switch options.Mode {
+	case ExpansionModeHyde:
+		request = aicomms.GenerateRequest{
+			Model:  model,
+			Prompt: fmt.Sprintf("Write a short passage that answers the question below. Respond only with the passage.\n\nQuestion: %s", text),
+		}
+	case ExpansionModeMultiQuery:
+		request = aicomms.GenerateRequest{
+			Model:  model,
+			Prompt: fmt.Sprintf(`Write %d different search queries that rephrase the query below. Respond only with JSON in the form {"queries": [...]}.`+"\n\nQuery: %s", options.Queries, text),
+			Format: "json",
+		}
+	}
+	generateCtx, cancel := context.WithTimeout(ctx, config.EXPAND_TIMEOUT)
+	defer cancel()
+	generateRes, err := s.ai.Generate(generateCtx, request)
+	if err == nil {
+		// success
+	} else if ctx.Err() != nil {
+		// request canceled
+		return nil, nil, ctx.Err()
+	} else if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// budget exceeded
+		logger.Sugar().Warn("query expansion exceeded latency budget, searching original query only")
+		return nil, nil, nil
+	} else {
+		// exception encountered
+		logger.Sugar().Warnf("query expansion failed, searching original query only: %v", err)
+		return nil, nil, nil
+	}
+
+	// Parse expansions
+	switch options.Mode {
+	case ExpansionModeHyde:
+		passage := strings.TrimSpace(generateRes.Response)
+		if passage == "" {
+			return nil, nil, nil
+		}
+		return []string{passage}, []string{fmt.Sprintf("search_document: %s", passage)}, nil
+	default:
+		var queries struct {
+			Queries []string `json:"queries"`
+		}
+		response := generateRes.Response
+		if start, end := strings.Index(response, "{"), strings.LastIndex(response, "}"); start >= 0 && end > start {
+			response = response[start : end+1]
+		}
+		if err := json.Unmarshal([]byte(response), &queries); err != nil {
+			logger.Sugar().Warnf("query expansion returned invalid queries, searching original query only: %s", generateRes.Response)
+			return nil, nil, nil
+		}
+		for _, query := range queries.Queries[:min(uint(len(queries.Queries)), options.Queries)] {
+			query = strings.TrimSpace(query)
+			if query == "" {
+				continue
+			}
+			expansions = append(expansions, query)
+			inputs = append(inputs, fmt.Sprintf("search_query: %s", query))
+		}
+		return expansions, inputs, nil
+	}
+}
+
+// expandedVectorSearch searches the original query and each expansion then fuses the rankings with reciprocal rank fusion.
+func (s *Server) expandedVectorSearch(ctx context.Context, categories []database.Category, query vectorQuery) (closestDocuments []documentSimilarity, err error) {
+	targets := append([][]uint8{query.target}, query.expansions...)
+	fused := make(map[uint64]int)
+	scores := make(map[uint64]float32)
+	for _, target := range targets {
+		variant := query
+		variant.target = target
+		variant.expansions = nil
+		variantDocuments, err := s.vectorSearch(ctx, categories, variant)
+		if err != nil {
+			return nil, err
+		}
+		for rank, item := range variantDocuments {
+			scores[item.documentID] += 1 / float32(config.RRF_K+rank+1)
+			idx, ok := fused[item.documentID]
+			if !ok {
+				fused[item.documentID] = len(closestDocuments)
+				closestDocuments = append(closestDocuments, item)
+				continue
+			}
+			existing := &closestDocuments[idx]
+			if item.similarity > existing.similarity {
+				existing.similarity = item.similarity
+			}
+			existing.chunks = append(existing.chunks, item.chunks...)
+		}
+	}
+	closestDocuments = mergeDocumentChunks(closestDocuments, query.chunks, nil)
+	slices.SortStableFunc(closestDocuments, func(a, b documentSimilarity) int {
+		return cmp.Compare(scores[b.documentID], scores[a.documentID])
+	})
+	return closestDocuments[:min(query.limit, uint(len(closestDocuments)))], nil
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/expki/go-vectorsearch/database"
+	_ "github.com/expki/go-vectorsearch/env"
+)
+
+// SearchExplain reports how a search was executed, every method is a no-op on a nil receiver.
+type SearchExplain struct {
+	Stages    []StageTiming     `json:"stages"`
+	Cache     []CacheLookup     `json:"cache"`
+	Centroids []CentroidProbe   `json:"centroids"`
+	Prefilter []PrefilterRecall `json:"prefilter,omitempty"`
+	mutex     sync.Mutex
+}
+
+type StageTiming struct {
+	Stage        string  `json:"stage"`
+	Milliseconds float64 `json:"ms"`
+	Count        int     `json:"count"`
+}
+
+type CacheLookup struct {
+	Kind         string  `json:"kind"`
+	Key          string  `json:"key"`
+	Source       string  `json:"source"`
+	Milliseconds float64 `json:"ms"`
+}
+
+type CentroidProbe struct {
+	Category   string   `json:"category"`
+	CentroidID uint64   `json:"centroid_id"`
+	Similarity *float32 `json:"similarity,omitempty"`
+	Embeddings int      `json:"embeddings"`
+}
+
+// PrefilterRecall is the share of the exact closest embeddings kept by the binary prefilter of a category.
+type PrefilterRecall struct {
+	Category   string  `json:"category"`
+	Scanned    int     `json:"scanned"`
+	Candidates int     `json:"candidates"`
+	Recall     float32 `json:"recall"`
+	hits       int
+	wanted     int
+}
+
+// stage adds the time since start to the named stage.
+func (e *SearchExplain) stage(name string, start time.Time) {
+	if e == nil {
+		return
+	}
+	elapsed := float64(time.Since(start).Microseconds()) / 1000
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for idx := range e.Stages {
+		if e.Stages[idx].Stage == name {
+			e.Stages[idx].Milliseconds += elapsed
+			e.Stages[idx].Count++
+			return
+		}
+	}
+	e.Stages = append(e.Stages, StageTiming{Stage: name, Milliseconds: elapsed, Count: 1})
+}
+
+// cache records whether a cached value was served from the cache or loaded from the database.
+func (e *SearchExplain) cache(kind string, key string, fromDatabase bool, start time.Time) {
+	if e == nil {
+		return
+	}
+	source := "cache"
+	if fromDatabase {
+		source = "database"
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.Cache = append(e.Cache, CacheLookup{
+		Kind:         kind,
+		Key:          key,
+		Source:       source,
+		Milliseconds: float64(time.Since(start).Microseconds()) / 1000,
+	})
+}
+
+// probe records a centroid selected for scanning.
+func (e *SearchExplain) probe(category string, centroidID uint64, similarity *float32) {
+	if e == nil {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for idx := range e.Centroids {
+		if e.Centroids[idx].Category == category && e.Centroids[idx].CentroidID == centroidID {
+			// centroid pinned before the scan
+			if similarity != nil {
+				e.Centroids[idx].Similarity = similarity
+			}
+			return
+		}
+	}
+	e.Centroids = append(e.Centroids, CentroidProbe{
+		Category:   category,
+		CentroidID: centroidID,
+		Similarity: similarity,
+	})
+}
+
+// scanned adds to the embeddings scanned from the latest probe of the centroid.
+func (e *SearchExplain) scanned(centroidID uint64, count int) {
+	if e == nil {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for idx := len(e.Centroids) - 1; idx >= 0; idx-- {
+		if e.Centroids[idx].CentroidID == centroidID {
+			e.Centroids[idx].Embeddings += count
+			return
+		}
+	}
+}
+
+// scannedBatch adds the embeddings of a database batch to the latest probe of their centroids.
+func (e *SearchExplain) scannedBatch(embeddings []database.Embedding) {
+	if e == nil {
+		return
+	}
+	scanned := make(map[uint64]int)
+	for _, embedding := range embeddings {
+		scanned[embedding.CentroidID]++
+	}
+	for centroidID, count := range scanned {
+		e.scanned(centroidID, count)
+	}
+}
+
+// prefilter adds the embeddings scanned and rescored by the binary prefilter of the category and how many of the exact closest embeddings it kept.
+func (e *SearchExplain) prefilter(category string, scanned int, candidates int, hits int, wanted int) {
+	if e == nil {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	idx := slices.IndexFunc(e.Prefilter, func(item PrefilterRecall) bool {
+		return item.Category == category
+	})
+	if idx < 0 {
+		idx = len(e.Prefilter)
+		e.Prefilter = append(e.Prefilter, PrefilterRecall{Category: category, Recall: 1})
+	}
+	item := &e.Prefilter[idx]
+	item.Scanned += scanned
+	item.Candidates += candidates
+	item.hits += hits
+	item.wanted += wanted
+	if item.wanted > 0 {
+		item.Recall = float32(item.hits) / float32(item.wanted)
+	}
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/expki/go-vectorsearch/config"
+	"github.com/expki/go-vectorsearch/database"
+	_ "github.com/expki/go-vectorsearch/env"
+	"gorm.io/plugin/dbresolver"
+)
+
+// Filter is a predicate over the stored document JSON.
+// Conditions set on the same filter must all match, fields use dot notation to address nested objects.
+type Filter struct {
+	And    []Filter `json:"and,omitempty"`
+	Or     []Filter `json:"or,omitempty"`
+	Not    *Filter  `json:"not,omitempty"`
+	Field  string   `json:"field,omitempty"`
+	Eq     any      `json:"eq,omitempty"`
+	Ne     any      `json:"ne,omitempty"`
+	Gt     any      `json:"gt,omitempty"`
+	Gte    any      `json:"gte,omitempty"`
+	Lt     any      `json:"lt,omitempty"`
+	Lte    any      `json:"lte,omitempty"`
+	In     []any    `json:"in,omitempty"`
+	Exists *bool    `json:"exists,omitempty"`
+}
+
+// Validate checks that every condition is usable.
+func (f Filter) Validate() error {
+	hasCondition := f.Eq != nil || f.Ne != nil || f.Gt != nil || f.Gte != nil || f.Lt != nil || f.Lte != nil || f.In != nil || f.Exists != nil
+	if hasCondition && f.Field == "" {
+		return errors.New("filter condition without field")
+	}
+	if !hasCondition && f.Field != "" {
+		return fmt.Errorf("filter field without condition: %s", f.Field)
+	}
+	for _, bound := range []any{f.Gt, f.Gte, f.Lt, f.Lte} {
+		switch bound.(type) {
+		case nil, float64, string:
+		default:
+			return fmt.Errorf("filter range on %q must be a number or string", f.Field)
+		}
+	}
+	for _, item := range slices.Concat(f.And, f.Or) {
+		if err := item.Validate(); err != nil {
+			return err
+		}
+	}
+	if f.Not != nil {
+		return f.Not.Validate()
+	}
+	return nil
+}
+
+// Fields returns the document fields referenced by the filter.
+func (f Filter) Fields() (fields []string) {
+	if f.Field != "" {
+		fields = append(fields, f.Field)
+	}
+	for _, item := range slices.Concat(f.And, f.Or) {
+		fields = append(fields, item.Fields()...)
+	}
+	if f.Not != nil {
+		fields = append(fields, f.Not.Fields()...)
+	}
+	slices.Sort(fields)
+	return slices.Compact(fields)
+}
+
+// Match evaluates the filter using lookup to resolve document fields.
+func (f Filter) Match(lookup func(field string) (value any, ok bool)) bool {
+	if f.Field != "" && !f.matchField(lookup) {
+		return false
+	}
+	for _, item := range f.And {
+		if !item.Match(lookup) {
+			return false
+		}
+	}
+	if len(f.Or) > 0 && !slices.ContainsFunc(f.Or, func(item Filter) bool { return item.Match(lookup) }) {
+		return false
+	}
+	if f.Not != nil && f.Not.Match(lookup) {
+		return false
+	}
+	return true
+}
+
+func (f Filter) matchField(lookup func(field string) (value any, ok bool)) bool {
+	value, ok := lookup(f.Field)
+	if f.Exists != nil && *f.Exists != ok {
+		return false
+	}
+	if !ok {
+		// only negative conditions can hold for a missing field
+		return f.Eq == nil && f.Gt == nil && f.Gte == nil && f.Lt == nil && f.Lte == nil && f.In == nil
+	}
+	if f.Eq != nil && !matchAny(value, func(item any) bool { return equalValue(item, f.Eq) }) {
+		return false
+	}
+	if f.Ne != nil && matchAny(value, func(item any) bool { return equalValue(item, f.Ne) }) {
+		return false
+	}
+	if f.Gt != nil && !matchAny(value, func(item any) bool { c, ok := compareValue(item, f.Gt); return ok && c > 0 }) {
+		return false
+	}
+	if f.Gte != nil && !matchAny(value, func(item any) bool { c, ok := compareValue(item, f.Gte); return ok && c >= 0 }) {
+		return false
+	}
+	if f.Lt != nil && !matchAny(value, func(item any) bool { c, ok := compareValue(item, f.Lt); return ok && c < 0 }) {
+		return false
+	}
+	if f.Lte != nil && !matchAny(value, func(item any) bool { c, ok := compareValue(item, f.Lte); return ok && c <= 0 }) {
+		return false
+	}
+	if f.In != nil && !matchAny(value, func(item any) bool {
+		return slices.ContainsFunc(f.In, func(option any) bool { return equalValue(item, option) })
+	}) {
+		return false
+	}
+	return true
+}
+
+// matchAny applies the predicate to the value, or to each item when the value is an array.
+func matchAny(value any, predicate func(item any) bool) bool {
+	if list, ok := value.([]any); ok {
+		return predicate(value) || slices.ContainsFunc(list, predicate)
+	}
+	return predicate(value)
+}
+
+func equalValue(a, b any) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+func compareValue(a, b any) (c int, ok bool) {
+	switch av := a.(type) {
+	case float64:
+		bv, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		if av < bv {
+			return -1, true
+		} else if av > bv {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(av, bv), true
+	default:
+		return 0, false
+	}
+}
+
+// lookupField resolves a dot separated field path in a decoded JSON document.
+func lookupField(document any, field string) (value any, ok bool) {
+	value = document
+	for key := range strings.SplitSeq(field, ".") {
+		object, isObject := value.(map[string]any)
+		if !isObject {
+			return nil, false
+		}
+		value, ok = object[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// buildAttributes extracts the indexed fields of a document.
+func buildAttributes(document any, fields []string) (attributes []*database.Attribute) {
+	for _, field := range fields {
+		value, ok := lookupField(document, field)
+		if !ok {
+			continue
+		}
+		raw, err := json.Marshal(value)
+		if err != nil {
+			continue
+		}
+		attributes = append(attributes, &database.Attribute{
+			Field: field,
+			Value: raw,
+		})
+	}
+	return attributes
+}
+
+// filterDocuments evaluates the filter for every document not yet present in results.
+// Indexed attributes are used when the category indexes every field in the filter, otherwise the documents are decompressed.
+func (s *Server) filterDocuments(ctx context.Context, category database.Category, filter *Filter, documentIDs []uint64, results map[uint64]bool) (err error) {
+	pending := make([]uint64, 0, len(documentIDs))
+	for _, documentID := range documentIDs {
+		if _, ok := results[documentID]; !ok {
+			pending = append(pending, documentID)
+		}
+	}
+	slices.Sort(pending)
+	pending = slices.Compact(pending)
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// Evaluate with indexed attributes
+	fields := filter.Fields()
+	indexed := !slices.ContainsFunc(fields, func(field string) bool { return !slices.Contains(category.IndexedFields, field) })
+	if indexed {
+		for batch := range slices.Chunk(pending, config.BATCH_SIZE_DATABASE) {
+			var attributes []database.Attribute
+			err = s.db.WithContext(ctx).Clauses(dbresolver.Read).
+				Where("document_id IN ? AND field IN ?", batch, fields).
+				Find(&attributes).
+				Error
+			if err != nil {
+				return err
+			}
+			values := make(map[uint64]map[string]any, len(batch))
+			for _, attribute := range attributes {
+				var value any
+				if json.Unmarshal(attribute.Value, &value) != nil {
+					continue
+				}
+				documentValues, ok := values[attribute.DocumentID]
+				if !ok {
+					documentValues = make(map[string]any, len(fields))
+					values[attribute.DocumentID] = documentValues
+				}
+				documentValues[attribute.Field] = value
+			}
+			for _, documentID := range batch {
+				documentValues := values[documentID]
+				results[documentID] = filter.Match(func(field string) (any, bool) {
+					value, ok := documentValues[field]
+					return value, ok
+				})
+			}
+		}
+		return nil
+	}
+
+	// Evaluate with decompressed documents
+	for batch := range slices.Chunk(pending, config.BATCH_SIZE_DATABASE) {
+		var documents []database.Document
+		err = s.db.WithContext(ctx).Clauses(dbresolver.Read).
+			Select("id", "document").
+			Find(&documents, batch).
+			Error
+		if err != nil {
+			return err
+		}
+		for _, documentID := range batch {
+			results[documentID] = false
+		}
+		for _, document := range documents {
+			value := document.Document.JSON()
+			results[document.ID] = filter.Match(func(field string) (any, bool) {
+				return lookupField(value, field)
+			})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+const filterDocument = `{
+	"title": "Go in practice",
+	"year": 2016,
+	"price": 39.5,
+	"tags": ["go", "programming"],
+	"author": {"name": "Matt", "country": "US"},
+	"draft": false,
+	"isbn": null
+}`
+
+func decodeFilter(t *testing.T, raw string) (filter Filter) {
+	t.Helper()
+	err := json.Unmarshal([]byte(raw), &filter)
+	if err != nil {
+		t.Fatalf("decode filter %s: %v", raw, err)
+	}
+	return filter
+}
+
+func TestFilterMatch(t *testing.T) {
+	var document any
+	err := json.Unmarshal([]byte(filterDocument), &document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		filter string
+		match  bool
+	}{
+		{name: "empty", filter: `{}`, match: true},
+		{name: "eq string", filter: `{"field": "title", "eq": "Go in practice"}`, match: true},
+		{name: "eq number", filter: `{"field": "year", "eq": 2016}`, match: true},
+		{name: "eq mismatch", filter: `{"field": "year", "eq": 2017}`, match: false},
+		{name: "eq type mismatch", filter: `{"field": "year", "eq": "2016"}`, match: false},
+		{name: "eq bool", filter: `{"field": "draft", "eq": false}`, match: true},
+		{name: "ne", filter: `{"field": "year", "ne": 2017}`, match: true},
+		{name: "ne missing field", filter: `{"field": "publisher", "ne": "x"}`, match: true},
+		{name: "nested field", filter: `{"field": "author.country", "eq": "US"}`, match: true},
+		{name: "nested missing", filter: `{"field": "author.city", "eq": "Boston"}`, match: false},
+		{name: "path through value", filter: `{"field": "title.length", "exists": true}`, match: false},
+		{name: "array element", filter: `{"field": "tags", "eq": "go"}`, match: true},
+		{name: "array whole", filter: `{"field": "tags", "eq": ["go", "programming"]}`, match: true},
+		{name: "array ne element", filter: `{"field": "tags", "ne": "go"}`, match: false},
+		{name: "range", filter: `{"field": "price", "gte": 30, "lt": 40}`, match: true},
+		{name: "range exclusive bound", filter: `{"field": "year", "gt": 2016}`, match: false},
+		{name: "range inclusive bound", filter: `{"field": "year", "lte": 2016}`, match: true},
+		{name: "range string", filter: `{"field": "title", "gt": "A", "lt": "H"}`, match: true},
+		{name: "range type mismatch", filter: `{"field": "title", "gt": 1}`, match: false},
+		{name: "range missing field", filter: `{"field": "pages", "lt": 100}`, match: false},
+		{name: "in", filter: `{"field": "author.name", "in": ["Anna", "Matt"]}`, match: true},
+		{name: "in array element", filter: `{"field": "tags", "in": ["rust", "programming"]}`, match: true},
+		{name: "in mismatch", filter: `{"field": "author.name", "in": ["Anna"]}`, match: false},
+		{name: "exists", filter: `{"field": "isbn", "exists": true}`, match: true},
+		{name: "not exists", filter: `{"field": "pages", "exists": false}`, match: true},
+		{name: "exists mismatch", filter: `{"field": "title", "exists": false}`, match: false},
+		{name: "and", filter: `{"and": [{"field": "year", "eq": 2016}, {"field": "tags", "eq": "go"}]}`, match: true},
+		{name: "and mismatch", filter: `{"and": [{"field": "year", "eq": 2016}, {"field": "tags", "eq": "rust"}]}`, match: false},
+		{name: "or", filter: `{"or": [{"field": "year", "eq": 2017}, {"field": "tags", "eq": "go"}]}`, match: true},
+		{name: "or mismatch", filter: `{"or": [{"field": "year", "eq": 2017}, {"field": "tags", "eq": "rust"}]}`, match: false},
+		{name: "not", filter: `{"not": {"field": "draft", "eq": true}}`, match: true},
+		{name: "not mismatch", filter: `{"not": {"field": "draft", "eq": false}}`, match: false},
+		{name: "field with combinators", filter: `{"field": "year", "eq": 2016, "or": [{"field": "price", "gt": 50}]}`, match: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter := decodeFilter(t, test.filter)
+			if err := filter.Validate(); err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			direct := filter.Match(func(field string) (any, bool) { return lookupField(document, field) })
+			if direct != test.match {
+				t.Errorf("document match is %v, want %v", direct, test.match)
+			}
+
+			// the indexed attributes evaluate like the document
+			values := make(map[string]any)
+			for _, attribute := range buildAttributes(document, filter.Fields()) {
+				var value any
+				err := json.Unmarshal(attribute.Value, &value)
+				if err != nil {
+					t.Fatalf("decode attribute %s: %v", attribute.Field, err)
+				}
+				values[attribute.Field] = value
+			}
+			indexed := filter.Match(func(field string) (any, bool) {
+				value, ok := values[field]
+				return value, ok
+			})
+			if indexed != test.match {
+				t.Errorf("attribute match is %v, want %v", indexed, test.match)
+			}
+		})
+	}
+}
+
+func TestFilterValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+		valid  bool
+	}{
+		{name: "condition", filter: `{"field": "year", "eq": 2016}`, valid: true},
+		{name: "condition without field", filter: `{"eq": 2016}`, valid: false},
+		{name: "field without condition", filter: `{"field": "year"}`, valid: false},
+		{name: "range bool", filter: `{"field": "draft", "gt": true}`, valid: false},
+		{name: "range object", filter: `{"field": "year", "lt": {"a": 1}}`, valid: false},
+		{name: "nested invalid and", filter: `{"and": [{"field": "year"}]}`, valid: false},
+		{name: "nested invalid or", filter: `{"or": [{"field": "year", "eq": 1}, {"eq": 1}]}`, valid: false},
+		{name: "nested invalid not", filter: `{"not": {"gt": 1}}`, valid: false},
+		{name: "nested valid", filter: `{"not": {"or": [{"field": "a", "exists": true}, {"field": "b", "in": [1, 2]}]}}`, valid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := decodeFilter(t, test.filter).Validate()
+			if (err == nil) != test.valid {
+				t.Errorf("validate returned %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestFilterFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+		fields []string
+	}{
+		{name: "empty", filter: `{}`, fields: nil},
+		{name: "single", filter: `{"field": "year", "eq": 1}`, fields: []string{"year"}},
+		{name: "nested and repeated", filter: `{"field": "b", "eq": 1, "and": [{"field": "a", "eq": 1}], "or": [{"field": "b", "gt": 1}], "not": {"field": "c.d", "exists": true}}`, fields: []string{"a", "b", "c.d"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fields := decodeFilter(t, test.filter).Fields()
+			if !slices.Equal(fields, test.fields) {
+				t.Errorf("fields are %v, want %v", fields, test.fields)
+			}
+		})
+	}
+}
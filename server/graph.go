@@ -0,0 +1,470 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/expki/go-vectorsearch/compute"
+	"github.com/expki/go-vectorsearch/config"
+	"github.com/expki/go-vectorsearch/database"
+	_ "github.com/expki/go-vectorsearch/env"
+	"github.com/expki/go-vectorsearch/hnsw"
+	"github.com/expki/go-vectorsearch/logger"
+	"golang.org/x/sync/singleflight"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/plugin/dbresolver"
+)
+
+// graphIndex holds the HNSW graphs of categories loaded by this process.
+type graphIndex struct {
+	budget int64
+	mutex  sync.Mutex
+	graphs map[uint64]*categoryGraph
+	loads  singleflight.Group
+	// oversized holds the graph version at which a category was found to exceed the budget
+	oversized map[uint64]graphOversize
+}
+
+// graphOversize records when the graph of a category was found to exceed the budget.
+type graphOversize struct {
+	version uint64
+	checked time.Time
+}
+
+type categoryGraph struct {
+	*hnsw.Graph
+	// write serializes changes with saving their neighbours
+	write sync.Mutex
+	// version is the graph version of the category the graph was restored at or last saved as
+	version uint64
+	// checked is when the version was last compared with the database
+	checked atomic.Int64
+	// used is when the graph was last used, the least recently used graphs are unloaded first
+	used atomic.Int64
+}
+
+// errGraphChanged is returned when another process saved the graph of the category since it was loaded.
+var errGraphChanged = errors.New("graph was changed by another process")
+
+// errGraphOverBudget is returned when the graph of a category does not fit in the graph memory budget on its own.
+var errGraphOverBudget = errors.New("graph exceeds graph memory budget")
+
+func newGraphIndex(budget int64) *graphIndex {
+	return &graphIndex{
+		budget:    budget,
+		graphs:    make(map[uint64]*categoryGraph),
+		oversized: make(map[uint64]graphOversize),
+	}
+}
+
+// forget unloads the graph of the category, it is loaded again on next use.
+func (g *graphIndex) forget(categoryID uint64) {
+	g.mutex.Lock()
+	delete(g.graphs, categoryID)
+	g.mutex.Unlock()
+}
+
+// loaded returns the graph of the category if it is loaded and marks it as recently used.
+func (g *graphIndex) loaded(categoryID uint64) *categoryGraph {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	graph := g.graphs[categoryID]
+	if graph != nil {
+		graph.used.Store(time.Now().UnixNano())
+	}
+	return graph
+}
+
+// evict unloads the least recently used graphs until the loaded graphs fit in the budget.
+// A graph that exceeds the budget on its own is marked oversized at its version.
+func (g *graphIndex) evict() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	var used int64
+	for _, graph := range g.graphs {
+		used += graph.Bytes()
+	}
+	for used > g.budget && len(g.graphs) > 0 {
+		var oldestID uint64
+		var oldest *categoryGraph
+		for categoryID, graph := range g.graphs {
+			if oldest == nil || graph.used.Load() < oldest.used.Load() {
+				oldestID, oldest = categoryID, graph
+			}
+		}
+		size := oldest.Bytes()
+		if size > g.budget {
+			g.oversized[oldestID] = graphOversize{version: oldest.version, checked: time.Now()}
+		}
+		logger.Sugar().Debugf("evicting graph of category %d: %d bytes", oldestID, size)
+		delete(g.graphs, oldestID)
+		used -= size
+	}
+}
+
+// overBudget reports whether the graph of the category was found to exceed the budget at the graph version.
+func (g *graphIndex) overBudget(categoryID uint64, maxAge time.Duration, version func() (uint64, error)) (oversized bool, err error) {
+	g.mutex.Lock()
+	entry, ok := g.oversized[categoryID]
+	g.mutex.Unlock()
+	if !ok {
+		return false, nil
+	}
+	if time.Since(entry.checked) < maxAge {
+		return true, nil
+	}
+	current, err := version()
+	if err != nil {
+		return false, err
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if current != entry.version {
+		delete(g.oversized, categoryID)
+		return false, nil
+	}
+	g.oversized[categoryID] = graphOversize{version: current, checked: time.Now()}
+	return true, nil
+}
+
+// categoryGraph returns the HNSW graph of the category, restoring it from the database on first use.
+// A loaded graph older than maxAge is compared with the graph version of the category and restored again when another process saved it.
+func (s *Server) categoryGraph(ctx context.Context, category database.Category, explain *SearchExplain, maxAge time.Duration) (graph *categoryGraph, err error) {
+	start := time.Now()
+	if graph = s.graphs.loaded(category.ID); graph != nil {
+		if time.Since(time.Unix(0, graph.checked.Load())) < maxAge {
+			explain.cache("graph", category.Name, false, start)
+			return graph, nil
+		}
+		version, err := s.graphVersion(ctx, category)
+		if err != nil {
+			return nil, err
+		}
+		if version == graph.version {
+			graph.checked.Store(time.Now().UnixNano())
+			explain.cache("graph", category.Name, false, start)
+			return graph, nil
+		}
+		s.graphs.forget(category.ID)
+	}
+	oversized, err := s.graphs.overBudget(category.ID, maxAge, func() (uint64, error) {
+		return s.graphVersion(ctx, category)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if oversized {
+		return nil, errGraphOverBudget
+	}
+	calibrations, err := s.fetchCalibrations(ctx, category, explain)
+	if err != nil {
+		return nil, err
+	}
+	valueAny, err, _ := s.graphs.loads.Do(strconv.FormatUint(category.ID, 10), func() (any, error) {
+		if graph := s.graphs.loaded(category.ID); graph != nil {
+			return graph, nil
+		}
+		logger.Sugar().Debugf("restoring graph of category: %d", category.ID)
+		graph := &categoryGraph{Graph: hnsw.New(config.HNSW_M, config.HNSW_EF_CONSTRUCTION)}
+		// nodes saved after the version was read are restored again on the next check
+		version, err := s.graphVersion(ctx, category)
+		if err != nil {
+			return nil, err
+		}
+		graph.version = version
+		graph.checked.Store(time.Now().UnixNano())
+		type storedNode struct {
+			EmbeddingID uint64
+			Neighbors   []byte
+			DocumentID  uint64
+			Ordinal     uint32
+			Vector      []byte
+		}
+		var nodes []storedNode
+		err = s.db.WithContext(ctx).Clauses(dbresolver.Read).
+			Model(&database.GraphNode{}).
+			Joins("INNER JOIN embeddings ON embeddings.id = graph_nodes.embedding_id").
+			Where("graph_nodes.category_id = ?", category.ID).
+			Select("graph_nodes.embedding_id as embedding_id, graph_nodes.neighbors as neighbors, embeddings.document_id as document_id, embeddings.ordinal as ordinal, embeddings.vector as vector").
+			FindInBatches(&nodes, config.BATCH_SIZE_DATABASE, func(tx *gorm.DB, batch int) error {
+				for _, node := range nodes {
+					neighbors, err := hnsw.DecodeNeighbors(node.Neighbors)
+					if err != nil {
+						return errors.Join(errors.New("failed to decode graph node"), err)
+					}
+					vector, err := calibrations.DequantizeVectorFloat32(node.Vector)
+					if err != nil {
+						return errors.Join(errors.New("failed to decode graph node vector"), err)
+					}
+					graph.Restore(node.EmbeddingID, node.DocumentID, node.Ordinal, vector, neighbors)
+				}
+				if graph.Bytes() > s.graphs.budget {
+					return errGraphOverBudget
+				}
+				return nil
+			}).
+			Error
+		if errors.Is(err, errGraphOverBudget) {
+			logger.Sugar().Warnf("graph of category %d exceeds graph memory budget, searching its centroids instead", category.ID)
+			s.graphs.mutex.Lock()
+			s.graphs.oversized[category.ID] = graphOversize{version: version, checked: time.Now()}
+			s.graphs.mutex.Unlock()
+			return nil, err
+		} else if err != nil {
+			return nil, err
+		}
+		graph.used.Store(time.Now().UnixNano())
+		s.graphs.mutex.Lock()
+		s.graphs.graphs[category.ID] = graph
+		s.graphs.mutex.Unlock()
+		s.graphs.evict()
+		return graph, nil
+	})
+	explain.cache("graph", category.Name, true, start)
+	if err == nil {
+		// graph restored
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// restore request canceled
+		return nil, err
+	} else if errors.Is(err, errGraphOverBudget) {
+		// graph does not fit in memory
+		return nil, err
+	} else {
+		// restore error
+		return nil, errors.Join(errors.New("failed to restore graph"), err)
+	}
+	graph, ok := valueAny.(*categoryGraph)
+	if !ok {
+		return nil, errors.New("failed to cast singleflight response value to type")
+	}
+	return graph, nil
+}
+
+// graphVersion returns the graph version of the category from the database.
+func (s *Server) graphVersion(ctx context.Context, category database.Category) (version uint64, err error) {
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Write).Model(&database.GraphVersion{}).Where("category_id = ?", category.ID).Pluck("version", &version).Error
+	if err == nil {
+		// version found
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// version request canceled
+		return 0, err
+	} else {
+		// version retrieve error
+		return 0, errors.Join(errors.New("failed to get graph version"), err)
+	}
+	return version, nil
+}
+
+// insertGraph links the embeddings into the graph of the category and saves the changed neighbours.
+func (s *Server) insertGraph(ctx context.Context, category database.Category, embeddings []*database.Embedding) (err error) {
+	if len(embeddings) == 0 {
+		return nil
+	}
+	calibrations, err := s.fetchCalibrations(ctx, category, nil)
+	if err != nil {
+		return err
+	}
+	vectors := make([][]float32, len(embeddings))
+	for idx, embedding := range embeddings {
+		vectors[idx], err = calibrations.DequantizeVectorFloat32(embedding.Vector)
+		if err != nil {
+			return errors.Join(errors.New("failed to decode embedding"), err)
+		}
+	}
+	return s.updateGraph(ctx, category, func(graph *hnsw.Graph) (changed []uint64) {
+		for idx, embedding := range embeddings {
+			changed = append(changed, graph.Insert(embedding.ID, embedding.DocumentID, embedding.Ordinal, vectors[idx])...)
+		}
+		return changed
+	})
+}
+
+// removeGraph removes the embeddings of the documents from the graph of the category and saves the reconnected neighbours.
+func (s *Server) removeGraph(ctx context.Context, category database.Category, documentIDs []uint64) (err error) {
+	if len(documentIDs) == 0 {
+		return nil
+	}
+	return s.updateGraph(ctx, category, func(graph *hnsw.Graph) (changed []uint64) {
+		return graph.Remove(documentIDs)
+	})
+}
+
+// updateGraph applies the change to the current graph of the category and saves the neighbours it changed.
+// The change is applied again on the restored graph when another process saved the graph in between.
+func (s *Server) updateGraph(ctx context.Context, category database.Category, change func(graph *hnsw.Graph) (changed []uint64)) (err error) {
+	for attempt := 1; ; attempt++ {
+		graph, err := s.categoryGraph(ctx, category, nil, 0)
+		if err != nil {
+			return err
+		}
+		err = s.saveGraph(ctx, category, graph, change)
+		if err == nil {
+			// inserts grow the graph
+			s.graphs.evict()
+			return nil
+		}
+		// the saved graph no longer matches memory
+		s.graphs.forget(category.ID)
+		if !errors.Is(err, errGraphChanged) || attempt >= config.HNSW_WRITE_ATTEMPTS {
+			return err
+		}
+		logger.Sugar().Debugf("graph of category %d changed by another process, retrying", category.ID)
+	}
+}
+
+// saveGraph applies the change and saves the changed neighbours if the graph version of the category still matches the graph.
+func (s *Server) saveGraph(ctx context.Context, category database.Category, graph *categoryGraph, change func(graph *hnsw.Graph) (changed []uint64)) (err error) {
+	graph.write.Lock()
+	defer graph.write.Unlock()
+	changed := change(graph.Graph)
+	slices.Sort(changed)
+	changed = slices.Compact(changed)
+	nodes := make([]*database.GraphNode, 0, len(changed))
+	for _, id := range changed {
+		if !graph.Contains(id) {
+			continue
+		}
+		nodes = append(nodes, &database.GraphNode{
+			EmbeddingID: id,
+			Neighbors:   hnsw.EncodeNeighbors(graph.Neighbors(id)),
+			CategoryID:  category.ID,
+		})
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Write).Transaction(func(tx *gorm.DB) error {
+		var result *gorm.DB
+		if graph.version == 0 {
+			// the first save creates the version
+			result = tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "category_id"}},
+				DoNothing: true,
+			}).Create(&database.GraphVersion{
+				Version:    1,
+				CategoryID: category.ID,
+			})
+		} else {
+			result = tx.Model(&database.GraphVersion{}).
+				Where("category_id = ? AND version = ?", category.ID, graph.version).
+				UpdateColumn("version", gorm.Expr("version + 1"))
+		}
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errGraphChanged
+		}
+		if len(nodes) == 0 {
+			return nil
+		}
+		return tx.Omit(clause.Associations).
+			Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "embedding_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"neighbors"}),
+			}).
+			CreateInBatches(&nodes, config.BATCH_SIZE_DATABASE).
+			Error
+	})
+	if err == nil {
+		// graph saved
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// save request canceled
+		return err
+	} else if errors.Is(err, errGraphChanged) {
+		// graph saved by another process
+		return err
+	} else {
+		// save error
+		return errors.Join(errors.New("failed to save graph nodes"), err)
+	}
+	graph.version++
+	graph.checked.Store(time.Now().UnixNano())
+	return nil
+}
+
+// buildGraph repairs links to removed embeddings and links every embedding of the category that is not yet part of its graph.
+func (s *Server) buildGraph(ctx context.Context, category database.Category) (err error) {
+	logger.Sugar().Debugf("building graph for category: %d", category.ID)
+	err = s.updateGraph(ctx, category, func(graph *hnsw.Graph) (changed []uint64) {
+		return graph.Remove(nil)
+	})
+	if err != nil {
+		return err
+	}
+	var embeddings []*database.Embedding
+	return s.db.WithContext(ctx).Clauses(dbresolver.Read).
+		Model(&database.Embedding{}).
+		Joins("INNER JOIN documents ON documents.id = embeddings.document_id").
+		Joins("LEFT JOIN graph_nodes ON graph_nodes.embedding_id = embeddings.id").
+		Where("documents.category_id = ? AND graph_nodes.embedding_id IS NULL", category.ID).
+		Select("embeddings.id as id, embeddings.document_id as document_id, embeddings.ordinal as ordinal, embeddings.vector as vector").
+		FindInBatches(&embeddings, config.BATCH_SIZE_DATABASE, func(tx *gorm.DB, batch int) error {
+			return s.insertGraph(ctx, category, embeddings)
+		}).
+		Error
+}
+
+// dropGraph removes the saved graph of the category.
+func (s *Server) dropGraph(ctx context.Context, category database.Category) (err error) {
+	s.graphs.forget(category.ID)
+	return s.db.WithContext(ctx).Clauses(dbresolver.Write).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("category_id = ?", category.ID).Delete(&database.GraphNode{}).Error
+		if err != nil {
+			return err
+		}
+		// other processes restore the empty graph
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "category_id"}},
+			DoUpdates: clause.Assignments(map[string]any{"version": gorm.Expr("graph_versions.version + 1")}),
+		}).Create(&database.GraphVersion{
+			Version:    1,
+			CategoryID: category.ID,
+		}).Error
+	})
+}
+
+// graphVectorSearch returns the embeddings closest to the query found by searching the graph of the category.
+// Searched is false when the graph is empty or exceeds the graph memory budget so the search falls back to the centroids.
+func (s *Server) graphVectorSearch(ctx context.Context, category database.Category, query vectorQuery) (embeddings []database.Embedding, similarities []float32, searched bool, err error) {
+	graph, err := s.categoryGraph(ctx, category, query.explain, config.CACHE_DURATION)
+	if errors.Is(err, errGraphOverBudget) {
+		// search the centroids instead
+		return nil, nil, false, nil
+	} else if err != nil {
+		return nil, nil, false, err
+	}
+	if graph.Len() == 0 {
+		return nil, nil, false, nil
+	}
+	if dimensions := graph.Dimensions(); dimensions != len(query.target)-8 {
+		return nil, nil, false, errors.Join(ErrInvalidRequest, fmt.Errorf("query dimensions %d do not match category dimensions %d", len(query.target)-8, dimensions))
+	}
+	defer query.explain.stage("graph_search", time.Now())
+	ef := max(query.ef, int(query.limit))
+	target, err := compute.DequantizeVectorFloat32(query.target)
+	if err != nil {
+		return nil, nil, false, errors.Join(ErrInvalidRequest, err)
+	}
+	results := graph.Search(target, ef, ef)
+	embeddings = make([]database.Embedding, len(results))
+	similarities = make([]float32, len(results))
+	for idx, result := range results {
+		embeddings[idx] = database.Embedding{
+			ID:         result.ID,
+			DocumentID: result.DocumentID,
+			Ordinal:    result.Ordinal,
+			Vector:     result.Vector,
+		}
+		similarities[idx] = result.Similarity
+	}
+	return embeddings, similarities, true, nil
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/expki/go-vectorsearch/config"
+	"github.com/expki/go-vectorsearch/database"
+	_ "github.com/expki/go-vectorsearch/env"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/plugin/dbresolver"
+)
+
+// Tokenize splits text into lowercase letter and digit terms.
+func Tokenize(text string) (terms []string) {
+	for term := range strings.FieldsFuncSeq(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(term) > config.KEYWORD_MAX_LENGTH {
+			continue
+		}
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// buildKeywords creates the keyword index entries of a document and returns the document length in terms.
+func buildKeywords(name string, document any) (keywords []*database.Keyword, length uint32) {
+	terms := Tokenize(name + "\n" + Flatten(document))
+	frequencies := make(map[string]uint32, len(terms))
+	for _, term := range terms {
+		frequencies[term]++
+	}
+	keywords = make([]*database.Keyword, 0, len(frequencies))
+	for term, frequency := range frequencies {
+		keywords = append(keywords, &database.Keyword{
+			Term:      term,
+			Frequency: frequency,
+		})
+	}
+	return keywords, uint32(len(terms))
+}
+
+type keywordScore struct {
+	documentID uint64
+	categoryID uint64
+	score      float32
+}
+
+// keywordSearch ranks the documents of the categories by BM25 over the query terms.
+func (s *Server) keywordSearch(ctx context.Context, categoryIDs []uint64, text string) (scores []keywordScore, err error) {
+	terms := Tokenize(text)
+	slices.Sort(terms)
+	terms = slices.Compact(terms)
+	if len(terms) == 0 {
+		return scores, nil
+	}
+
+	// Collection statistics
+	var stats struct {
+		Total  int64
+		Length float64
+	}
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Read).
+		Model(&database.Document{}).
+		Select("COUNT(*) as total, COALESCE(AVG(length), 0) as length").
+		Where("category_id IN ? AND length > 0", categoryIDs).
+		Scan(&stats).
+		Error
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to get keyword statistics"), err)
+	}
+	if stats.Total == 0 || stats.Length == 0 {
+		return scores, nil
+	}
+
+	// Document frequency
+	var frequencies []struct {
+		Term  string
+		Total int64
+	}
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Read).
+		Model(&database.Keyword{}).
+		Select("term, COUNT(*) as total").
+		Where("category_id IN ? AND term IN ?", categoryIDs, terms).
+		Group("term").
+		Scan(&frequencies).
+		Error
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to get keyword frequencies"), err)
+	}
+	idf := make(map[string]float64, len(frequencies))
+	for _, frequency := range frequencies {
+		df := float64(frequency.Total)
+		idf[frequency.Term] = math.Log(1 + (float64(stats.Total)-df+0.5)/(df+0.5))
+	}
+
+	// Score postings
+	type posting struct {
+		ID         uint64
+		DocumentID uint64
+		CategoryID uint64
+		Term       string
+		Frequency  uint32
+		Length     uint32
+	}
+	k1, b := s.config.Search.GetBM25()
+	documentScores := make(map[uint64]float64)
+	documentCategories := make(map[uint64]uint64)
+	var postings []posting
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Read).
+		Model(&database.Keyword{}).
+		Joins("INNER JOIN documents ON documents.id = keywords.document_id").
+		Select("keywords.id as id, keywords.document_id as document_id, keywords.category_id as category_id, keywords.term as term, keywords.frequency as frequency, documents.length as length").
+		Where("keywords.category_id IN ? AND keywords.term IN ?", categoryIDs, terms).
+		FindInBatches(&postings, config.BATCH_SIZE_DATABASE, func(tx *gorm.DB, batch int) error {
+			for _, item := range postings {
+				tf := float64(item.Frequency)
+				norm := k1 * (1 - b + b*float64(item.Length)/stats.Length)
+				documentScores[item.DocumentID] += idf[item.Term] * tf * (k1 + 1) / (tf + norm)
+				documentCategories[item.DocumentID] = item.CategoryID
+			}
+			return nil
+		}).
+		Error
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to score keywords"), err)
+	}
+
+	// Rank documents
+	scores = make([]keywordScore, 0, len(documentScores))
+	for documentID, score := range documentScores {
+		scores = append(scores, keywordScore{
+			documentID: documentID,
+			categoryID: documentCategories[documentID],
+			score:      float32(score),
+		})
+	}
+	slices.SortFunc(scores, func(a, b keywordScore) int {
+		if c := cmp.Compare(b.score, a.score); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.documentID, b.documentID)
+	})
+	return scores, nil
+}
+
+// backfillKeywords indexes the documents of a category that were uploaded before keyword search existed.
+func (s *Server) backfillKeywords(ctx context.Context, categoryID uint64) (err error) {
+	var documents []database.Document
+	return s.db.WithContext(ctx).Clauses(dbresolver.Read).
+		Select("id", "name", "document").
+		Where("category_id = ? AND length = 0", categoryID).
+		FindInBatches(&documents, config.BATCH_SIZE_DATABASE, func(tx *gorm.DB, batch int) error {
+			keywords := make([]*database.Keyword, 0, len(documents))
+			lengths := make(map[uint64]uint32, len(documents))
+			for _, document := range documents {
+				documentKeywords, length := buildKeywords(document.Name, document.Document.JSON())
+				if length == 0 {
+					continue
+				}
+				for _, keyword := range documentKeywords {
+					keyword.CategoryID = categoryID
+					keyword.DocumentID = document.ID
+					keywords = append(keywords, keyword)
+				}
+				lengths[document.ID] = length
+			}
+			if len(lengths) == 0 {
+				return nil
+			}
+			// a document is only marked indexed together with its keywords
+			return s.db.WithContext(ctx).Clauses(dbresolver.Write).Transaction(func(tx *gorm.DB) error {
+				indexed := make(map[uint64]struct{}, len(lengths))
+				for documentID, length := range lengths {
+					// documents indexed since they were read keep the keywords of that upload or refresh
+					result := tx.Model(&database.Document{}).Where("id = ? AND length = 0", documentID).Update("length", length)
+					if result.Error != nil {
+						return result.Error
+					}
+					if result.RowsAffected == 1 {
+						indexed[documentID] = struct{}{}
+					}
+				}
+				keywords = slices.DeleteFunc(keywords, func(keyword *database.Keyword) bool {
+					_, ok := indexed[keyword.DocumentID]
+					return !ok
+				})
+				if len(keywords) == 0 {
+					return nil
+				}
+				return tx.Omit(clause.Associations).CreateInBatches(&keywords, config.BATCH_SIZE_DATABASE).Error
+			})
+		}).
+		Error
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/expki/go-vectorsearch/config"
+	"github.com/expki/go-vectorsearch/database"
+	_ "github.com/expki/go-vectorsearch/env"
+	"gorm.io/plugin/dbresolver"
+)
+
+// Passage is a matched chunk merged with its neighbouring chunks.
+type Passage struct {
+	ChunkRange
+	Text string `json:"text"`
+}
+
+// passageRanges merges the windows around the matched chunks into disjoint ordinal ranges.
+func passageRanges(chunks []chunkSimilarity, window uint32) (ranges []ChunkRange) {
+	ranges = make([]ChunkRange, len(chunks))
+	for idx, chunk := range chunks {
+		ranges[idx] = ChunkRange{From: chunk.ordinal - min(chunk.ordinal, window), To: chunk.ordinal + window}
+	}
+	slices.SortFunc(ranges, func(a, b ChunkRange) int {
+		return cmp.Compare(a.From, b.From)
+	})
+	merged := ranges[:0]
+	for _, item := range ranges {
+		if last := len(merged) - 1; last >= 0 && item.From <= merged[last].To+1 {
+			merged[last].To = max(merged[last].To, item.To)
+			continue
+		}
+		merged = append(merged, item)
+	}
+	return merged
+}
+
+// fetchPassages loads the matched chunks of each document together with up to window neighbouring chunks on either side.
+func (s *Server) fetchPassages(ctx context.Context, closestDocuments []documentSimilarity, window uint32) (passages map[uint64][]Passage, err error) {
+	passages = make(map[uint64][]Passage, len(closestDocuments))
+	for batch := range slices.Chunk(closestDocuments, max(1, config.BATCH_SIZE_DATABASE/(3*config.CHUNK_LIMIT))) {
+		// load the chunks within the merged windows
+		ranges := make(map[uint64][]ChunkRange, len(batch))
+		conditions := make([]string, 0, len(batch))
+		args := make([]any, 0, 3*len(batch))
+		for _, item := range batch {
+			if len(item.chunks) == 0 {
+				continue
+			}
+			ranges[item.documentID] = passageRanges(item.chunks, window)
+			for _, ordinals := range ranges[item.documentID] {
+				conditions = append(conditions, "(document_id = ? AND ordinal BETWEEN ? AND ?)")
+				args = append(args, item.documentID, ordinals.From, ordinals.To)
+			}
+		}
+		if len(conditions) == 0 {
+			continue
+		}
+		var embeddings []database.Embedding
+		err = s.db.WithContext(ctx).Clauses(dbresolver.Read).
+			Select("document_id", "ordinal", "text").
+			Where(strings.Join(conditions, " OR "), args...).
+			Order("document_id").
+			Order("ordinal").
+			Find(&embeddings).
+			Error
+		if err != nil {
+			return nil, err
+		}
+		chunks := make(map[uint64][]database.Embedding, len(ranges))
+		for _, embedding := range embeddings {
+			chunks[embedding.DocumentID] = append(chunks[embedding.DocumentID], embedding)
+		}
+
+		// join the chunk texts of each window
+		for documentID, documentRanges := range ranges {
+			for _, ordinals := range documentRanges {
+				var passage Passage
+				var text []string
+				for _, embedding := range chunks[documentID] {
+					if embedding.Ordinal < ordinals.From || embedding.Ordinal > ordinals.To {
+						continue
+					}
+					if len(text) == 0 {
+						passage.From = embedding.Ordinal
+					}
+					passage.To = embedding.Ordinal
+					text = append(text, string(embedding.Text))
+				}
+				if len(text) == 0 {
+					continue
+				}
+				passage.Text = strings.Join(text, "\n")
+				passages[documentID] = append(passages[documentID], passage)
+			}
+		}
+	}
+	return passages, nil
+}
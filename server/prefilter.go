@@ -0,0 +1,229 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/expki/go-vectorsearch/compute"
+	"github.com/expki/go-vectorsearch/config"
+	"github.com/expki/go-vectorsearch/database"
+	_ "github.com/expki/go-vectorsearch/env"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+type prefilterCandidate struct {
+	embedding  database.Embedding
+	distance   int
+	similarity float32
+}
+
+// prefilterScan ranks the embeddings of the centroids by the hamming distance of their sign bits and rescores the closest with their full vectors.
+// Embeddings without bits are scored with their full vectors directly.
+func (s *Server) prefilterScan(ctx context.Context, category database.Category, query vectorQuery, centroidIDs []uint64, consider func([]database.Embedding, []float32) error) (err error) {
+	target, err := compute.NewVector(query.target)
+	if err != nil {
+		return errors.Join(ErrInvalidRequest, err)
+	}
+	targetVector, err := compute.DequantizeVectorFloat32(query.target)
+	if err != nil {
+		return errors.Join(ErrInvalidRequest, err)
+	}
+	targetBits := compute.BinaryQuantize(targetVector)
+	keep := max(query.prefilter, query.limit)
+	candidates := make([]prefilterCandidate, 0, 2*keep)
+	var exact []prefilterCandidate
+	var scanned int
+
+	// Rank embeddings by hamming distance
+	columns := []string{"id", "document_id", "centroid_id", "ordinal", "bits", "CASE WHEN bits IS NULL THEN vector END AS vector"}
+	if query.explain != nil {
+		// full vectors measure the recall of the prefilter
+		columns = []string{"id", "document_id", "centroid_id", "ordinal", "bits", "vector"}
+	}
+	var embeddings []database.Embedding
+	batchStart := time.Now()
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Read).
+		Select(columns).
+		Where("centroid_id IN ?", centroidIDs).
+		FindInBatches(&embeddings, config.BATCH_SIZE_DATABASE, func(tx *gorm.DB, n int) error {
+			query.explain.stage("db_batch", batchStart)
+			defer func() { batchStart = time.Now() }()
+			query.explain.scannedBatch(embeddings)
+			hammingStart := time.Now()
+			uncoded := make([]database.Embedding, 0)
+			coded := make([]database.Embedding, 0, len(embeddings))
+			for _, embedding := range embeddings {
+				if len(embedding.Bits) == 0 {
+					uncoded = append(uncoded, embedding)
+					continue
+				}
+				coded = append(coded, embedding)
+				candidates = append(candidates, prefilterCandidate{
+					embedding: embedding,
+					distance:  compute.HammingDistance(targetBits, embedding.Bits),
+				})
+				if uint(len(candidates)) >= 2*keep {
+					candidates = closestCandidates(candidates, keep, compareDistance)
+				}
+			}
+			scanned += len(coded)
+			query.explain.stage("hamming_scoring", hammingStart)
+			if query.explain != nil && len(coded) > 0 {
+				matrix, err := query.calibrations.NewMatrix(embeddingVectors(coded))
+				if err != nil {
+					return err
+				}
+				for idx, similarity := range target.Clone().MatrixCosineSimilarity(matrix) {
+					exact = append(exact, prefilterCandidate{embedding: coded[idx], similarity: similarity})
+				}
+				exact = closestCandidates(exact, query.limit, compareCandidateSimilarity)
+			}
+			if len(uncoded) == 0 {
+				return nil
+			}
+			defer query.explain.stage("embedding_scoring", time.Now())
+			matrix, err := query.calibrations.NewMatrix(embeddingVectors(uncoded))
+			if err != nil {
+				return err
+			}
+			return consider(uncoded, target.Clone().MatrixCosineSimilarity(matrix))
+		}).
+		Error
+	if err != nil {
+		return err
+	}
+	candidates = closestCandidates(candidates, keep, compareDistance)
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// Rescore the closest candidates with their full vectors
+	rescoreStart := time.Now()
+	missing := make([]uint64, 0, len(candidates))
+	for _, candidate := range candidates {
+		if len(candidate.embedding.Vector) == 0 {
+			missing = append(missing, candidate.embedding.ID)
+		}
+	}
+	vectors := make(map[uint64][]uint8, len(missing))
+	for batch := range slices.Chunk(missing, config.BATCH_SIZE_DATABASE) {
+		var stored []database.Embedding
+		err = s.db.WithContext(ctx).Clauses(dbresolver.Read).Select("id", "vector").Find(&stored, batch).Error
+		if err != nil {
+			return errors.Join(errors.New("failed to get candidate vectors"), err)
+		}
+		for _, embedding := range stored {
+			vectors[embedding.ID] = embedding.Vector
+		}
+	}
+	rescored := make([]database.Embedding, 0, len(candidates))
+	for _, candidate := range candidates {
+		if len(candidate.embedding.Vector) == 0 {
+			candidate.embedding.Vector = vectors[candidate.embedding.ID]
+		}
+		if len(candidate.embedding.Vector) == 0 {
+			// embedding was removed after the scan
+			continue
+		}
+		rescored = append(rescored, candidate.embedding)
+	}
+	if query.explain != nil {
+		kept := make(map[uint64]struct{}, len(rescored))
+		for _, embedding := range rescored {
+			kept[embedding.ID] = struct{}{}
+		}
+		hits := 0
+		for _, item := range exact {
+			if _, ok := kept[item.embedding.ID]; ok {
+				hits++
+			}
+		}
+		query.explain.prefilter(category.Name, scanned, len(rescored), hits, len(exact))
+	}
+	if len(rescored) == 0 {
+		return nil
+	}
+	matrix, err := query.calibrations.NewMatrix(embeddingVectors(rescored))
+	if err != nil {
+		return errors.Join(errors.New("failed to decode candidate vectors"), err)
+	}
+	similarities := target.Clone().MatrixCosineSimilarity(matrix)
+	query.explain.stage("prefilter_rescore", rescoreStart)
+	return consider(rescored, similarities)
+}
+
+// closestCandidates sorts the candidates and keeps the first n.
+func closestCandidates(candidates []prefilterCandidate, n uint, compare func(a, b prefilterCandidate) int) []prefilterCandidate {
+	slices.SortFunc(candidates, compare)
+	return candidates[:min(n, uint(len(candidates)))]
+}
+
+func compareDistance(a, b prefilterCandidate) int {
+	return cmp.Or(cmp.Compare(a.distance, b.distance), cmp.Compare(a.embedding.ID, b.embedding.ID))
+}
+
+func compareCandidateSimilarity(a, b prefilterCandidate) int {
+	return cmp.Or(cmp.Compare(b.similarity, a.similarity), cmp.Compare(a.embedding.ID, b.embedding.ID))
+}
+
+func embeddingVectors(embeddings []database.Embedding) (matrix [][]uint8) {
+	matrix = make([][]uint8, len(embeddings))
+	for idx, embedding := range embeddings {
+		matrix[idx] = embedding.Vector
+	}
+	return matrix
+}
+
+// encodeBits sets the sign bits of new embeddings when the category uses the binary prefilter.
+func encodeBits(category database.Category, embeddings []*database.Embedding, vectors [][]float32) {
+	if !category.BinaryPrefilter {
+		return
+	}
+	for idx, embedding := range embeddings {
+		embedding.Bits = compute.BinaryQuantize(vectors[idx])
+	}
+}
+
+// backfillBits stores the sign bits of embeddings of the category uploaded before the binary prefilter was enabled.
+func (s *Server) backfillBits(ctx context.Context, category database.Category) (err error) {
+	calibrations, err := s.fetchCalibrations(ctx, category, nil)
+	if err != nil {
+		return err
+	}
+	var embeddings []database.Embedding
+	return s.db.WithContext(ctx).Clauses(dbresolver.Read).
+		Model(&database.Embedding{}).
+		Joins("INNER JOIN documents ON documents.id = embeddings.document_id").
+		Where("documents.category_id = ? AND embeddings.bits IS NULL", category.ID).
+		Select("embeddings.id as id, embeddings.vector as vector").
+		FindInBatches(&embeddings, config.BATCH_SIZE_DATABASE, func(tx *gorm.DB, batch int) error {
+			return s.db.WithContext(ctx).Clauses(dbresolver.Write).Transaction(func(tx *gorm.DB) error {
+				for _, embedding := range embeddings {
+					vector, err := calibrations.DequantizeVectorFloat32(embedding.Vector)
+					if err != nil {
+						return errors.Join(errors.New("failed to decode embedding"), err)
+					}
+					err = tx.Model(&database.Embedding{}).Where("id = ?", embedding.ID).Update("bits", compute.BinaryQuantize(vector)).Error
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}).
+		Error
+}
+
+// dropBits removes the sign bits of the embeddings of the category.
+func (s *Server) dropBits(ctx context.Context, category database.Category) (err error) {
+	return s.db.WithContext(ctx).Clauses(dbresolver.Write).
+		Model(&database.Embedding{}).
+		Where("document_id IN (?)", s.db.Model(&database.Document{}).Select("id").Where("category_id = ?", category.ID)).
+		Where("bits IS NOT NULL").
+		Update("bits", nil).
+		Error
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/expki/go-vectorsearch/database"
+)
+
+func TestClosestCandidates(t *testing.T) {
+	candidate := func(id uint64, distance int) prefilterCandidate {
+		return prefilterCandidate{embedding: database.Embedding{ID: id}, distance: distance}
+	}
+	tests := []struct {
+		name       string
+		candidates []prefilterCandidate
+		n          uint
+		ids        []uint64
+	}{
+		{name: "empty", candidates: nil, n: 3, ids: []uint64{}},
+		{name: "fewer than kept", candidates: []prefilterCandidate{candidate(2, 5), candidate(1, 7)}, n: 3, ids: []uint64{2, 1}},
+		{name: "closest kept", candidates: []prefilterCandidate{candidate(1, 9), candidate(2, 1), candidate(3, 4), candidate(4, 2)}, n: 2, ids: []uint64{2, 4}},
+		{name: "ties by id", candidates: []prefilterCandidate{candidate(5, 3), candidate(2, 3), candidate(9, 3), candidate(1, 8)}, n: 2, ids: []uint64{2, 5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kept := closestCandidates(test.candidates, test.n, compareDistance)
+			ids := make([]uint64, len(kept))
+			for idx, item := range kept {
+				ids[idx] = item.embedding.ID
+			}
+			if !slices.Equal(ids, test.ids) {
+				t.Errorf("kept %v, want %v", ids, test.ids)
+			}
+		})
+	}
+}
+
+func TestEncodeBits(t *testing.T) {
+	tests := []struct {
+		name      string
+		prefilter bool
+		bits      [][]uint8
+	}{
+		{name: "prefilter disabled", prefilter: false, bits: [][]uint8{nil, nil}},
+		{name: "prefilter enabled", prefilter: true, bits: [][]uint8{{0b01}, {0b10}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			embeddings := []*database.Embedding{{}, {}}
+			encodeBits(database.Category{BinaryPrefilter: test.prefilter}, embeddings, [][]float32{{1, -1}, {-1, 1}})
+			for idx, embedding := range embeddings {
+				if !slices.Equal(embedding.Bits, test.bits[idx]) {
+					t.Errorf("embedding %d bits are %08b, want %08b", idx, embedding.Bits, test.bits[idx])
+				}
+			}
+		})
+	}
+}
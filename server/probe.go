@@ -0,0 +1,28 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/expki/go-vectorsearch/config"
+	_ "github.com/expki/go-vectorsearch/env"
+)
+
+// ProbeOptions tunes adaptive probing, which scans centroids in order of similarity until enough candidates are found.
+type ProbeOptions struct {
+	Candidates uint     `json:"candidates,omitempty"`
+	Margin     *float32 `json:"margin,omitempty"`
+}
+
+// Validate checks the probe options and fills in the defaults of the search configuration.
+func (o *ProbeOptions) Validate(search config.Search) error {
+	if o.Candidates == 0 {
+		o.Candidates = search.GetProbeCandidates()
+	}
+	if o.Margin == nil {
+		margin := search.GetProbeMargin()
+		o.Margin = &margin
+	} else if *o.Margin < 0 || *o.Margin > 2 {
+		return errors.New("probe margin must be between 0 and 2")
+	}
+	return nil
+}
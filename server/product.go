@@ -0,0 +1,181 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/expki/go-vectorsearch/compute"
+	"github.com/expki/go-vectorsearch/config"
+	"github.com/expki/go-vectorsearch/database"
+	_ "github.com/expki/go-vectorsearch/env"
+	"github.com/expki/go-vectorsearch/logger"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+// fetchCodebook retrieves the product quantization codebook of the category through the cache, nil when it has not been trained.
+func (s *Server) fetchCodebook(ctx context.Context, category database.Category, explain *SearchExplain) (codebook *compute.Codebook, err error) {
+	start := time.Now()
+	fromDatabase := false
+	codebook, err = s.cache.FetchCodebook(category.ID, func() (*compute.Codebook, error) {
+		logger.Sugar().Debug("retrieve codebook from database")
+		fromDatabase = true
+		var stored database.Codebook
+		err := s.db.WithContext(ctx).Clauses(dbresolver.Read).Where("category_id = ?", category.ID).Limit(1).Find(&stored).Error
+		if err != nil || stored.ID == 0 {
+			return nil, err
+		}
+		codebook := &compute.Codebook{}
+		return codebook, codebook.UnmarshalBinary(stored.Data)
+	})
+	explain.cache("codebook", category.Name, fromDatabase, start)
+	if err == nil {
+		// codebook found
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// codebook request canceled
+		return nil, err
+	} else {
+		// codebook retrieve error
+		return nil, errors.Join(errors.New("failed to get codebook"), err)
+	}
+	return codebook, nil
+}
+
+// encodeEmbeddings sets the product quantization code of new embeddings when the category has a codebook.
+func (s *Server) encodeEmbeddings(ctx context.Context, category database.Category, embeddings []*database.Embedding, vectors [][]float32) (err error) {
+	if category.IndexType != database.IndexTypeIVFPQ {
+		return nil
+	}
+	codebook, err := s.fetchCodebook(ctx, category, nil)
+	if err != nil || codebook == nil {
+		// embeddings are encoded by the next centroid refresh
+		return err
+	}
+	for idx, embedding := range embeddings {
+		embedding.Code = codebook.Encode(vectors[idx])
+	}
+	return nil
+}
+
+// dropCodes removes the codebook and product quantization codes of the category.
+func (s *Server) dropCodes(ctx context.Context, category database.Category) (err error) {
+	defer s.cache.InvalidateCodebook(category.ID)
+	return s.db.WithContext(ctx).Clauses(dbresolver.Write).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("category_id = ?", category.ID).Delete(&database.Codebook{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&database.Embedding{}).
+			Where("document_id IN (?)", tx.Model(&database.Document{}).Select("id").Where("category_id = ?", category.ID)).
+			Where("code IS NOT NULL").
+			Update("code", nil).
+			Error
+	})
+}
+
+// scoreCodes returns the approximate similarity of embeddings with a code and the cosine similarity of those without one.
+func scoreCodes(table []float32, target compute.Vector, embeddings []database.Embedding, calibrations compute.Calibrations) (similarities []float32, err error) {
+	similarities = make([]float32, len(embeddings))
+	uncoded := make([]int, 0)
+	for idx, embedding := range embeddings {
+		if len(embedding.Code) == 0 {
+			uncoded = append(uncoded, idx)
+			continue
+		}
+		similarities[idx] = compute.ProductSimilarity(table, embedding.Code)
+	}
+	if len(uncoded) == 0 {
+		return similarities, nil
+	}
+	matrixEmbeddings := make([][]uint8, len(uncoded))
+	for idx, embeddingIdx := range uncoded {
+		matrixEmbeddings[idx] = embeddings[embeddingIdx].Vector
+	}
+	matrix, err := calibrations.NewMatrix(matrixEmbeddings)
+	if err != nil {
+		return nil, err
+	}
+	for idx, similarity := range target.Clone().MatrixCosineSimilarity(matrix) {
+		similarities[uncoded[idx]] = similarity
+	}
+	return similarities, nil
+}
+
+// rescoreCandidates scores the chunks of the best candidates again with their full vectors and loads the vectors of the remaining chunks scored by code.
+func (s *Server) rescoreCandidates(ctx context.Context, closestDocuments []documentSimilarity, query vectorQuery, limit uint) (rescored []documentSimilarity, err error) {
+	defer query.explain.stage("rescore", time.Now())
+
+	// Load the vectors of chunks scored by code
+	embeddingIDs := make([]uint64, 0, len(closestDocuments))
+	for _, document := range closestDocuments {
+		for _, chunk := range document.chunks {
+			if len(chunk.vector) == 0 {
+				embeddingIDs = append(embeddingIDs, chunk.embeddingID)
+			}
+		}
+	}
+	vectors := make(map[uint64][]uint8, len(embeddingIDs))
+	for batch := range slices.Chunk(embeddingIDs, config.BATCH_SIZE_DATABASE) {
+		var embeddings []database.Embedding
+		err = s.db.WithContext(ctx).Clauses(dbresolver.Read).Select("id", "vector").Find(&embeddings, batch).Error
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to get candidate vectors"), err)
+		}
+		for _, embedding := range embeddings {
+			vectors[embedding.ID] = embedding.Vector
+		}
+	}
+
+	// Score the best candidates with their full vectors
+	type position struct {
+		document int
+		chunk    int
+	}
+	positions := make([]position, 0, len(embeddingIDs))
+	matrixVectors := make([][]uint8, 0, len(embeddingIDs))
+	for documentIdx := range closestDocuments {
+		chunks := closestDocuments[documentIdx].chunks
+		for chunkIdx := range chunks {
+			if len(chunks[chunkIdx].vector) > 0 {
+				continue
+			}
+			chunks[chunkIdx].vector = vectors[chunks[chunkIdx].embeddingID]
+			if uint(documentIdx) < query.rescore && len(chunks[chunkIdx].vector) > 0 {
+				positions = append(positions, position{document: documentIdx, chunk: chunkIdx})
+				matrixVectors = append(matrixVectors, chunks[chunkIdx].vector)
+			}
+		}
+	}
+	if len(matrixVectors) > 0 {
+		matrix, err := query.calibrations.NewMatrix(matrixVectors)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to decode candidate vectors"), err)
+		}
+		target, err := compute.NewVector(query.target)
+		if err != nil {
+			return nil, errors.Join(ErrInvalidRequest, err)
+		}
+		for idx, similarity := range target.MatrixCosineSimilarity(matrix) {
+			closestDocuments[positions[idx].document].chunks[positions[idx].chunk].similarity = similarity
+		}
+		for documentIdx := range closestDocuments[:min(query.rescore, uint(len(closestDocuments)))] {
+			document := &closestDocuments[documentIdx]
+			document.similarity = slices.MaxFunc(document.chunks, func(a, b chunkSimilarity) int {
+				return cmp.Compare(a.similarity, b.similarity)
+			}).similarity
+		}
+	}
+	if query.minSimilarity != nil {
+		closestDocuments = slices.DeleteFunc(closestDocuments, func(document documentSimilarity) bool {
+			return document.similarity < *query.minSimilarity
+		})
+	}
+
+	// Rank again by the rescored similarities, aggregated queries score their documents again from all chunks
+	query.limit = limit
+	return s.rankDocuments(ctx, rankCandidates(closestDocuments, query), query)
+}
@@ -0,0 +1,998 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/expki/go-vectorsearch/compute"
+	"github.com/expki/go-vectorsearch/config"
+	"github.com/expki/go-vectorsearch/database"
+	_ "github.com/expki/go-vectorsearch/env"
+	"github.com/expki/go-vectorsearch/logger"
+	"github.com/expki/go-vectorsearch/memindex"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/plugin/dbresolver"
+)
+
+type documentSimilarity struct {
+	documentID uint64
+	document   database.Document
+	similarity float32
+	// aggregateScore combines the chunk similarities when the query aggregates chunks, documents are ranked by it instead of their similarity
+	aggregateScore *float32
+	keywordScore   float32
+	hybridScore    float32
+	rerankScore    *float32
+	score          *float32
+	chunks         []chunkSimilarity
+}
+
+type chunkSimilarity struct {
+	embeddingID uint64
+	ordinal     uint32
+	similarity  float32
+	vector      []uint8
+}
+
+type centroidSimilarity struct {
+	centroid   database.Centroid
+	similarity float32
+}
+
+// vectorQuery describes a nearest neighbour search within a category.
+type vectorQuery struct {
+	target    []uint8
+	centroids int
+	limit     uint
+	chunks    uint
+	filter    *Filter
+	// exclude lists documents the query was built from, they are never returned
+	exclude []uint64
+	// expansions are additional query vectors whose rankings are fused with the target ranking
+	expansions [][]uint8
+	// minSimilarity drops embeddings below the cutoff and skips centroids that cannot reach it
+	minSimilarity *float32
+	// probe scans these centroids instead of the closest centroids when set
+	probe []uint64
+	// scanned collects the centroids the search scanned when set, they are pinned by the next page cursor
+	scanned *[]uint64
+	// adaptive stops probing the closest centroids once enough candidates are found, centroids is the probe limit
+	adaptive *ProbeOptions
+	// ef is the candidate list size of graph searches
+	ef int
+	// rescore is the number of candidates scored by product quantization codes that are scored again with their full vectors
+	rescore uint
+	// prefilter is the number of embeddings closest by sign bits that are scored with their full vectors
+	prefilter uint
+	// after skips documents ranked at or before the cursor position
+	after *cursorPosition
+	// aggregation combines the chunk similarities of a document, the category setting is used when unset
+	aggregation *database.Aggregation
+	// explain collects the execution details of the search when requested
+	explain *SearchExplain
+	// calibrations decode the stored vectors of the category being searched
+	calibrations compute.Calibrations
+}
+
+// vectorSearch probes each category and merges the most similar documents.
+func (s *Server) vectorSearch(ctx context.Context, categories []database.Category, query vectorQuery) (closestDocuments []documentSimilarity, err error) {
+	if len(query.expansions) > 0 {
+		return s.expandedVectorSearch(ctx, categories, query)
+	}
+	for _, category := range categories {
+		categoryDocuments, err := s.categoryVectorSearch(ctx, category, query)
+		if err != nil {
+			return nil, err
+		}
+		closestDocuments = append(closestDocuments, categoryDocuments...)
+	}
+	slices.SortFunc(closestDocuments, compareSimilarity)
+	return closestDocuments[:min(query.limit, uint(len(closestDocuments)))], nil
+}
+
+// categoryVectorSearch probes the closest centroids or searches the graph of the category and returns the most similar documents.
+func (s *Server) categoryVectorSearch(ctx context.Context, category database.Category, query vectorQuery) (closestDocuments []documentSimilarity, err error) {
+	target, err := compute.NewVector(query.target)
+	if err != nil {
+		return nil, errors.Join(ErrInvalidRequest, err)
+	}
+	if query.aggregation == nil {
+		query.aggregation = &category.Aggregation
+	}
+	query.calibrations, err = s.fetchCalibrations(ctx, category, query.explain)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect the closest documents to the embedding
+	closestDocuments = make([]documentSimilarity, 0, query.limit+config.BATCH_SIZE_DATABASE)
+	filtered := make(map[uint64]bool)
+	passed := make(map[uint64]struct{})
+	var candidates uint
+	retain := func() uint {
+		if query.after == nil || query.after.returned <= uint(len(passed)) {
+			return query.limit
+		}
+		// documents of earlier pages found by a lower chunk are removed once their best chunk is scanned
+		return query.limit + query.after.returned - uint(len(passed))
+	}
+	consider := func(embeddings []database.Embedding, similarities []float32) error {
+		// evaluate filter for candidates that can still enter the result
+		if query.filter != nil {
+			cutoff := float32(-math.MaxFloat32)
+			ranked := query
+			ranked.limit = retain()
+			if uint(len(closestDocuments)) >= candidateLimit(ranked) {
+				cutoff = closestDocuments[len(closestDocuments)-1].similarity
+			}
+			candidateIDs := make([]uint64, 0, len(embeddings))
+			for idx, similarity := range similarities {
+				if similarity > cutoff {
+					candidateIDs = append(candidateIDs, embeddings[idx].DocumentID)
+				}
+			}
+			err := s.filterDocuments(ctx, category, query.filter, candidateIDs, filtered)
+			if err != nil {
+				return errors.Join(errors.New("failed to filter documents"), err)
+			}
+		}
+		for idx, similarity := range similarities {
+			if query.filter != nil && !filtered[embeddings[idx].DocumentID] {
+				continue
+			}
+			if slices.Contains(query.exclude, embeddings[idx].DocumentID) {
+				continue
+			}
+			if query.minSimilarity != nil && similarity < *query.minSimilarity {
+				continue
+			}
+			if query.after != nil && query.after.passed(similarity, embeddings[idx].DocumentID) {
+				// document was returned on an earlier page
+				passed[embeddings[idx].DocumentID] = struct{}{}
+				continue
+			}
+			candidates++
+			closestDocuments = append(closestDocuments, documentSimilarity{
+				documentID: embeddings[idx].DocumentID,
+				similarity: similarity,
+				chunks: []chunkSimilarity{{
+					embeddingID: embeddings[idx].ID,
+					ordinal:     embeddings[idx].Ordinal,
+					similarity:  similarity,
+					vector:      embeddings[idx].Vector,
+				}},
+			})
+		}
+		if len(passed) > 0 {
+			closestDocuments = slices.DeleteFunc(closestDocuments, func(item documentSimilarity) bool {
+				_, ok := passed[item.documentID]
+				return ok
+			})
+		}
+		ranked := query
+		ranked.limit = retain()
+		closestDocuments = rankCandidates(closestDocuments, ranked)
+		return nil
+	}
+
+	// Search the graph of categories indexed with HNSW
+	if category.IndexType == database.IndexTypeHNSW {
+		embeddings, similarities, searched, err := s.graphVectorSearch(ctx, category, query)
+		if err != nil {
+			return nil, err
+		}
+		if searched {
+			err = consider(embeddings, similarities)
+			if err != nil {
+				return nil, err
+			}
+			return s.rankDocuments(ctx, closestDocuments, query)
+		}
+	}
+
+	// Find closest centroids to embedding
+	closestCentroids, err := s.rankCentroids(ctx, category, query)
+	if err != nil {
+		return nil, err
+	}
+	if len(closestCentroids) == 0 {
+		return nil, nil
+	}
+
+	// Use the in-memory index when the category fits
+	resident, err := s.residentCategory(ctx, category, query)
+	if err != nil {
+		return nil, err
+	}
+	var residentTarget []float32
+	if resident != nil {
+		residentTarget, err = compute.DequantizeVectorFloat32(query.target)
+		if err != nil {
+			return nil, errors.Join(ErrInvalidRequest, err)
+		}
+		residentTarget = compute.Normalize(residentTarget)
+	}
+
+	// Score product quantization codes of ivf_pq categories
+	var table []float32
+	limit := query.limit
+	if resident == nil && category.IndexType == database.IndexTypeIVFPQ {
+		codebook, err := s.fetchCodebook(ctx, category, query.explain)
+		if err != nil {
+			return nil, err
+		}
+		if codebook != nil {
+			table, err = codebook.Table(query.target)
+			if err != nil {
+				return nil, errors.Join(ErrInvalidRequest, err)
+			}
+		}
+		if table != nil {
+			// collect enough candidates to rescore
+			query.limit = max(query.limit, query.rescore)
+		}
+	}
+	prefilter := resident == nil && table == nil && category.BinaryPrefilter
+
+	// create new cosine similarity graph
+	cosineSimilarity, closeGraph := compute.VectorMatrixCosineSimilarity()
+	defer closeGraph()
+
+	scan := func(centroidIDs []uint64) error {
+		if resident != nil {
+			// score the embeddings held in memory
+			for _, centroidID := range centroidIDs {
+				scoringStart := time.Now()
+				embeddings, similarities := resident.Scan(centroidID, residentTarget)
+				query.explain.stage("memory_scoring", scoringStart)
+				query.explain.scanned(centroidID, len(embeddings))
+				for batch := range slices.Chunk(embeddings, config.BATCH_SIZE_CACHE) {
+					err := consider(batch, similarities[:len(batch)])
+					if err != nil {
+						return err
+					}
+					similarities = similarities[len(batch):]
+				}
+			}
+			return nil
+		}
+		if prefilter {
+			return s.prefilterScan(ctx, category, query, centroidIDs, consider)
+		}
+		columns := []string{"id", "document_id", "centroid_id", "ordinal", "vector"}
+		if table != nil {
+			// read full vectors only for embeddings not yet encoded
+			columns = []string{"id", "document_id", "centroid_id", "ordinal", "code", "CASE WHEN code IS NULL THEN vector END AS vector"}
+		}
+		var embeddings []database.Embedding
+		batchStart := time.Now()
+		return s.db.WithContext(ctx).Clauses(dbresolver.Read).
+			Select(columns).
+			Where("centroid_id IN ?", centroidIDs).
+			FindInBatches(&embeddings, config.BATCH_SIZE_DATABASE, func(tx *gorm.DB, n int) error {
+				query.explain.stage("db_batch", batchStart)
+				defer func() { batchStart = time.Now() }()
+				defer query.explain.stage("embedding_scoring", time.Now())
+				query.explain.scannedBatch(embeddings)
+				if table != nil {
+					similarities, err := scoreCodes(table, target, embeddings, query.calibrations)
+					if err != nil {
+						return err
+					}
+					return consider(embeddings, similarities)
+				}
+				// find nearest embedding to the query
+				matrixEmbeddings := make([][]uint8, len(embeddings))
+				for idx, embedding := range embeddings {
+					matrixEmbeddings[idx] = embedding.Vector
+				}
+				matrix, err := query.calibrations.NewMatrix(matrixEmbeddings)
+				if err != nil {
+					return err
+				}
+				return consider(embeddings, cosineSimilarity(target.Clone(), matrix))
+			}).
+			Error
+	}
+	if query.adaptive == nil || query.probe != nil {
+		centroidIDs := make([]uint64, len(closestCentroids))
+		for idx, centroid := range closestCentroids {
+			centroidIDs[idx] = centroid.centroid.ID
+			if query.probe == nil {
+				query.explain.probe(category.Name, centroid.centroid.ID, &closestCentroids[idx].similarity)
+			}
+		}
+		err = scan(centroidIDs)
+		if err == nil && query.scanned != nil {
+			*query.scanned = append(*query.scanned, centroidIDs...)
+		}
+	} else {
+		// probe the closest centroids one at a time until enough candidates are found
+		wanted := max(query.adaptive.Candidates, query.limit)
+		for idx, centroid := range closestCentroids {
+			if idx > 0 && candidates >= wanted {
+				logger.Sugar().Debugf("adaptive probing reached candidates after %d centroids", idx)
+				break
+			}
+			if uint(len(closestDocuments)) >= candidateLimit(query) && query.after == nil && query.scanned == nil {
+				// the centroid cannot change the top candidates, later pages may still rank its documents
+				if similarityBound(centroid.similarity, centroid.centroid.MinSimilarity) < closestDocuments[len(closestDocuments)-1].similarity {
+					continue
+				}
+			}
+			query.explain.probe(category.Name, centroid.centroid.ID, &closestCentroids[idx].similarity)
+			err = scan([]uint64{centroid.centroid.ID})
+			if err != nil {
+				break
+			}
+			if query.scanned != nil {
+				*query.scanned = append(*query.scanned, centroid.centroid.ID)
+			}
+		}
+	}
+	if err == nil {
+		// success
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// request canceled
+		return nil, err
+	} else {
+		// exception encountered
+		return nil, errors.Join(errors.New("database document embedding batch retrieval failed"), err)
+	}
+
+	// Rescore candidates found by code
+	if table != nil {
+		return s.rescoreCandidates(ctx, closestDocuments, query, limit)
+	}
+	return s.rankDocuments(ctx, closestDocuments, query)
+}
+
+// rankCentroids returns the closest centroids of the category to the target in order of similarity, or the centroids of the category listed in the probe when it is set.
+func (s *Server) rankCentroids(ctx context.Context, category database.Category, query vectorQuery) (closestCentroids []centroidSimilarity, err error) {
+	// Get Centroids
+	var centroids []database.Centroid
+	if query.minSimilarity != nil || query.adaptive != nil {
+		centroids, err = s.fetchCoveringCentroids(ctx, category, query.explain)
+	} else {
+		centroids, err = s.fetchCentroids(ctx, category, query.explain)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(centroids) == 0 {
+		return nil, nil
+	}
+	if len(centroids[0].Vector) != len(query.target) {
+		return nil, errors.Join(ErrInvalidRequest, fmt.Errorf("query dimensions %d do not match category dimensions %d", len(query.target)-8, len(centroids[0].Vector)-8))
+	}
+	if query.probe != nil {
+		probe := make(map[uint64]struct{}, len(query.probe))
+		for _, id := range query.probe {
+			probe[id] = struct{}{}
+		}
+		for _, centroid := range centroids {
+			if _, ok := probe[centroid.ID]; ok {
+				closestCentroids = append(closestCentroids, centroidSimilarity{centroid: centroid})
+				query.explain.probe(category.Name, centroid.ID, nil)
+			}
+		}
+		return closestCentroids, nil
+	}
+
+	// Find closest centroids to embedding
+	defer query.explain.stage("centroid_scoring", time.Now())
+	target, err := compute.NewVector(query.target)
+	if err != nil {
+		return nil, errors.Join(ErrInvalidRequest, err)
+	}
+	closestCentroids = make([]centroidSimilarity, len(centroids))
+	// Convert centroids to matrix format for cosine similarity calculation
+	matrixCentroids := make([][]uint8, len(centroids))
+	for idx, centroid := range centroids {
+		matrixCentroids[idx] = centroid.Vector
+	}
+	centroidMatrix, err := compute.NewMatrix(matrixCentroids)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to decode centroids"), err)
+	}
+	logger.Sugar().Debugf("calculate nearest centroids: %d", min(query.centroids, len(closestCentroids)))
+	for idx, similarity := range target.Clone().MatrixCosineSimilarity(centroidMatrix) {
+		closestCentroids[idx] = centroidSimilarity{
+			centroid:   centroids[idx],
+			similarity: similarity,
+		}
+	}
+	slices.SortFunc(closestCentroids, func(a, b centroidSimilarity) int {
+		return cmp.Compare(b.similarity, a.similarity)
+	})
+	closestCentroids = closestCentroids[:min(query.centroids, len(closestCentroids))]
+	if query.adaptive != nil {
+		// centroids far below the closest one rarely hold the nearest documents
+		cutoff := closestCentroids[0].similarity - *query.adaptive.Margin
+		closestCentroids = slices.DeleteFunc(closestCentroids, func(item centroidSimilarity) bool {
+			return item.similarity < cutoff
+		})
+	}
+	if query.minSimilarity != nil {
+		closestCentroids = slices.DeleteFunc(closestCentroids, func(item centroidSimilarity) bool {
+			return similarityBound(item.similarity, item.centroid.MinSimilarity) < *query.minSimilarity
+		})
+		logger.Sugar().Debugf("centroids within similarity bound: %d", len(closestCentroids))
+	}
+	return closestCentroids, nil
+}
+
+// fetchCentroids retrieves the centroids of the category through the cache.
+func (s *Server) fetchCentroids(ctx context.Context, category database.Category, explain *SearchExplain) (centroids []database.Centroid, err error) {
+	logger.Sugar().Debug("retrieving centroids")
+	start := time.Now()
+	fromDatabase := false
+	centroids, err = s.cache.FetchCentroids(category.ID, func() (centroids []database.Centroid, err error) {
+		logger.Sugar().Debug("retrieve centroids from database")
+		fromDatabase = true
+		version, err := s.indexVersion(ctx, category)
+		if err != nil {
+			return nil, err
+		}
+		err = s.db.WithContext(ctx).Clauses(dbresolver.Read).Where("category_id = ?", category.ID).Find(&centroids).Error
+		if err == nil {
+			s.centroidVersions.Store(category.ID, version)
+		}
+		return centroids, err
+	})
+	explain.cache("centroids", category.Name, fromDatabase, start)
+	if err == nil {
+		// centroids found
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// centroids request canceled
+		return nil, err
+	} else {
+		// centroids retrieve error
+		return nil, errors.Join(errors.New("failed to get centroids"), err)
+	}
+	return centroids, nil
+}
+
+// fetchCoveringCentroids retrieves the centroids of the category with a radius covering every embedding, centroids are pruned by their radius.
+// Uploads of any process widen the radius together with the index version, centroids cached before the current index version are fetched again.
+func (s *Server) fetchCoveringCentroids(ctx context.Context, category database.Category, explain *SearchExplain) (centroids []database.Centroid, err error) {
+	version, err := s.indexVersion(ctx, category)
+	if err != nil {
+		return nil, err
+	}
+	centroids, err = s.fetchCentroids(ctx, category, explain)
+	if err != nil {
+		return nil, err
+	}
+	if cached, ok := s.centroidVersions.Load(category.ID); ok && cached.(uint64) >= version {
+		return centroids, nil
+	}
+	logger.Sugar().Debugf("centroids of category %d predate the index version", category.ID)
+	s.cache.InvalidateCentroids(category.ID)
+	return s.fetchCentroids(ctx, category, explain)
+}
+
+// residentCategory returns the category from the in-memory index, loading it on first use.
+// Nil is returned when the index is disabled or the category does not fit in the memory budget.
+func (s *Server) residentCategory(ctx context.Context, category database.Category, query vectorQuery) (resident *memindex.Category, err error) {
+	if s.memory == nil {
+		return nil, nil
+	}
+	start := time.Now()
+	fromDatabase := false
+	stored := func() (uint64, error) {
+		return s.indexVersion(ctx, category)
+	}
+	resident, err = s.memory.Load(category.ID, config.CACHE_DURATION, stored, func(resident *memindex.Category) error {
+		logger.Sugar().Debug("load category embeddings into index")
+		fromDatabase = true
+		var embeddings []database.Embedding
+		return s.db.WithContext(ctx).Clauses(dbresolver.Read).
+			Select("id", "document_id", "centroid_id", "ordinal", "vector").
+			Where("centroid_id IN (?)", s.db.Model(&database.Centroid{}).Select("id").Where("category_id = ?", category.ID)).
+			FindInBatches(&embeddings, config.BATCH_SIZE_DATABASE, func(tx *gorm.DB, n int) error {
+				return resident.Add(embeddings, query.calibrations)
+			}).
+			Error
+	})
+	query.explain.cache("index", category.Name, fromDatabase, start)
+	if err == nil {
+		// category loaded
+	} else if errors.Is(err, memindex.ErrOverBudget) {
+		// scan the database instead
+		return nil, nil
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// load request canceled
+		return nil, err
+	} else {
+		// load error
+		return nil, errors.Join(errors.New("failed to load category index"), err)
+	}
+	return resident, nil
+}
+
+// indexVersion returns the index version of the category from the database.
+func (s *Server) indexVersion(ctx context.Context, category database.Category) (version uint64, err error) {
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Write).Model(&database.IndexVersion{}).Where("category_id = ?", category.ID).Pluck("version", &version).Error
+	if err == nil {
+		// version found
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// version request canceled
+		return 0, err
+	} else {
+		// version retrieve error
+		return 0, errors.Join(errors.New("failed to get index version"), err)
+	}
+	return version, nil
+}
+
+// bumpIndexVersion marks a change to the embeddings of the category within the transaction and returns the new version.
+func bumpIndexVersion(tx *gorm.DB, categoryID uint64) (version uint64, err error) {
+	err = tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "category_id"}},
+		DoUpdates: clause.Assignments(map[string]any{"version": gorm.Expr("index_versions.version + 1")}),
+	}).Create(&database.IndexVersion{
+		Version:    1,
+		CategoryID: categoryID,
+	}).Error
+	if err != nil {
+		return 0, errors.Join(errors.New("failed to update index version"), err)
+	}
+	err = tx.Model(&database.IndexVersion{}).Where("category_id = ?", categoryID).Pluck("version", &version).Error
+	if err != nil {
+		return 0, errors.Join(errors.New("failed to get index version"), err)
+	}
+	return version, nil
+}
+
+// rankCandidates sorts candidates by similarity, merges duplicate documents and truncates the list to the candidate limit.
+func rankCandidates(closestDocuments []documentSimilarity, query vectorQuery) []documentSimilarity {
+	// sort by nearest
+	slices.SortFunc(closestDocuments, compareSimilarity)
+	// merge duplicates keeping their best chunks
+	closestDocuments = mergeDocumentChunks(closestDocuments, query.chunks, nil)
+	// truncate list
+	return closestDocuments[:min(candidateLimit(query), uint(len(closestDocuments)))]
+}
+
+// candidateLimit is the number of documents kept while scanning, aggregated queries gather a wider pool ranked by the best chunk.
+func candidateLimit(query vectorQuery) uint {
+	if aggregates(query.aggregation) {
+		return max(query.limit, config.AGGREGATE_CANDIDATES)
+	}
+	return query.limit
+}
+
+// rankDocuments aggregates all chunks of the candidates when the query aggregates chunks, ranks them by their aggregate score and truncates the list to the query limit.
+func (s *Server) rankDocuments(ctx context.Context, closestDocuments []documentSimilarity, query vectorQuery) ([]documentSimilarity, error) {
+	if aggregates(query.aggregation) && len(closestDocuments) > 0 {
+		// chunks kept while scanning depend on the scan order
+		documentIDs := make([]uint64, len(closestDocuments))
+		for idx, document := range closestDocuments {
+			documentIDs[idx] = document.documentID
+		}
+		similarities, err := s.documentSimilarities(ctx, query.target, query.calibrations, documentIDs, max(query.chunks, config.AGGREGATE_CHUNKS))
+		if err != nil {
+			return nil, err
+		}
+		for idx := range closestDocuments {
+			if similarity, ok := similarities[closestDocuments[idx].documentID]; ok {
+				closestDocuments[idx].similarity = similarity.similarity
+				closestDocuments[idx].chunks = similarity.chunks
+			}
+			if query.minSimilarity != nil {
+				closestDocuments[idx].chunks = slices.DeleteFunc(closestDocuments[idx].chunks, func(chunk chunkSimilarity) bool {
+					return chunk.similarity < *query.minSimilarity
+				})
+			}
+		}
+		closestDocuments = mergeDocumentChunks(closestDocuments, query.chunks, query.aggregation)
+		slices.SortFunc(closestDocuments, compareSimilarity)
+	}
+	return closestDocuments[:min(query.limit, uint(len(closestDocuments)))], nil
+}
+
+// compareSimilarity orders documents by descending rank score and ascending document id.
+func compareSimilarity(a, b documentSimilarity) int {
+	return cmp.Or(cmp.Compare(b.rankScore(), a.rankScore()), cmp.Compare(a.documentID, b.documentID))
+}
+
+// rankScore is the aggregate score of the document when set, otherwise its similarity.
+func (d documentSimilarity) rankScore() float32 {
+	if d.aggregateScore != nil {
+		return *d.aggregateScore
+	}
+	return d.similarity
+}
+
+// similarityBound returns the highest similarity an embedding within the centroid radius can have to the query.
+func similarityBound(centroidSimilarity float32, centroidMinSimilarity float32) float32 {
+	queryAngle := math.Acos(max(-1, min(1, float64(centroidSimilarity))))
+	radiusAngle := math.Acos(max(-1, min(1, float64(centroidMinSimilarity))))
+	return float32(math.Cos(max(0, queryAngle-radiusAngle))) + config.PRUNE_MARGIN
+}
+
+// mergeDocumentChunks merges entries of the same document into the first occurrence and keeps its best chunks.
+// The aggregate score is set from the kept chunks when an aggregation other than max is given, the similarity stays the best chunk similarity.
+func mergeDocumentChunks(documents []documentSimilarity, chunkLimit uint, aggregation *database.Aggregation) (unique []documentSimilarity) {
+	if aggregates(aggregation) {
+		// aggregation needs more than the returned chunks
+		chunkLimit = max(chunkLimit, config.AGGREGATE_CHUNKS)
+	}
+	seen := make(map[uint64]int, len(documents))
+	unique = make([]documentSimilarity, 0, len(documents))
+	for _, document := range documents {
+		if idx, ok := seen[document.documentID]; ok {
+			unique[idx].chunks = append(unique[idx].chunks, document.chunks...)
+			continue
+		}
+		seen[document.documentID] = len(unique)
+		unique = append(unique, document)
+	}
+	for idx := range unique {
+		chunks := unique[idx].chunks
+		slices.SortFunc(chunks, func(a, b chunkSimilarity) int {
+			return cmp.Compare(b.similarity, a.similarity)
+		})
+		seenChunks := make(map[uint64]struct{}, len(chunks))
+		chunks = slices.DeleteFunc(chunks, func(chunk chunkSimilarity) bool {
+			_, ok := seenChunks[chunk.embeddingID]
+			seenChunks[chunk.embeddingID] = struct{}{}
+			return ok
+		})
+		unique[idx].chunks = chunks[:min(uint(len(chunks)), max(1, chunkLimit))]
+		if aggregates(aggregation) && len(chunks) > 0 {
+			score := aggregateChunks(*aggregation, unique[idx].chunks)
+			unique[idx].aggregateScore = &score
+			unique[idx].similarity = chunks[0].similarity
+		}
+	}
+	return unique
+}
+
+// keywordRank returns the documents with the highest BM25 score that pass the filter.
+func (s *Server) keywordRank(ctx context.Context, categories []database.Category, scores []keywordScore, limit uint, filter *Filter) (closestDocuments []documentSimilarity, err error) {
+	closestDocuments = make([]documentSimilarity, 0, limit)
+	filtered := make(map[uint64]bool)
+	for batch := range slices.Chunk(scores, config.BATCH_SIZE_DATABASE) {
+		if filter != nil {
+			documentIDs := make(map[uint64][]uint64, len(categories))
+			for _, item := range batch {
+				documentIDs[item.categoryID] = append(documentIDs[item.categoryID], item.documentID)
+			}
+			for _, category := range categories {
+				if len(documentIDs[category.ID]) == 0 {
+					continue
+				}
+				err = s.filterDocuments(ctx, category, filter, documentIDs[category.ID], filtered)
+				if err != nil {
+					return nil, errors.Join(errors.New("failed to filter documents"), err)
+				}
+			}
+		}
+		for _, item := range batch {
+			if uint(len(closestDocuments)) >= limit {
+				return closestDocuments, nil
+			}
+			if filter != nil && !filtered[item.documentID] {
+				continue
+			}
+			closestDocuments = append(closestDocuments, documentSimilarity{
+				documentID:   item.documentID,
+				keywordScore: item.score,
+			})
+		}
+	}
+	return closestDocuments, nil
+}
+
+// hybridSearch merges the vector and keyword rankings with reciprocal rank fusion.
+func (s *Server) hybridSearch(ctx context.Context, categories []database.Category, query vectorQuery, text string) (closestDocuments []documentSimilarity, err error) {
+	limit := query.limit
+	query.limit = max(limit, config.FUSION_CANDIDATES)
+	vectorDocuments, err := s.vectorSearch(ctx, categories, query)
+	if err != nil {
+		return nil, err
+	}
+	categoryIDs := make([]uint64, len(categories))
+	for idx, category := range categories {
+		categoryIDs[idx] = category.ID
+	}
+	keywordStart := time.Now()
+	scores, err := s.keywordSearch(ctx, categoryIDs, text)
+	if err != nil {
+		return nil, err
+	}
+	keywordDocuments, err := s.keywordRank(ctx, categories, scores, query.limit, query.filter)
+	if err != nil {
+		return nil, err
+	}
+	query.explain.stage("keyword", keywordStart)
+
+	// Fuse rankings
+	// capacity fits both rankings so the fused pointers stay valid while appending
+	fused := make(map[uint64]*documentSimilarity, len(vectorDocuments)+len(keywordDocuments))
+	closestDocuments = make([]documentSimilarity, 0, len(vectorDocuments)+len(keywordDocuments))
+	for rank, item := range vectorDocuments {
+		item.hybridScore = 1 / float32(config.RRF_K+rank+1)
+		closestDocuments = append(closestDocuments, item)
+	}
+	for idx := range closestDocuments {
+		fused[closestDocuments[idx].documentID] = &closestDocuments[idx]
+	}
+	var missingIDs []uint64
+	keywordDocuments = slices.DeleteFunc(keywordDocuments, func(item documentSimilarity) bool {
+		return slices.Contains(query.exclude, item.documentID)
+	})
+	for rank, item := range keywordDocuments {
+		if existing, ok := fused[item.documentID]; ok {
+			existing.keywordScore = item.keywordScore
+			existing.hybridScore += 1 / float32(config.RRF_K+rank+1)
+			continue
+		}
+		item.hybridScore = 1 / float32(config.RRF_K+rank+1)
+		closestDocuments = append(closestDocuments, item)
+		missingIDs = append(missingIDs, item.documentID)
+	}
+
+	// Keyword scores for documents only found by vector
+	for _, item := range scores {
+		if existing, ok := fused[item.documentID]; ok {
+			existing.keywordScore = item.score
+		}
+	}
+
+	// Vector similarity for documents only found by keyword
+	if len(missingIDs) > 0 {
+		calibrations, err := s.fetchCategoriesCalibrations(ctx, categories, query.explain)
+		if err != nil {
+			return nil, err
+		}
+		similarities, err := s.documentSimilarities(ctx, query.target, calibrations, missingIDs, query.chunks)
+		if err != nil {
+			return nil, err
+		}
+		for idx := range closestDocuments[len(vectorDocuments):] {
+			item := &closestDocuments[len(vectorDocuments)+idx]
+			item.similarity = similarities[item.documentID].similarity
+			item.chunks = similarities[item.documentID].chunks
+		}
+	}
+
+	if query.minSimilarity != nil {
+		closestDocuments = slices.DeleteFunc(closestDocuments, func(item documentSimilarity) bool {
+			return item.similarity < *query.minSimilarity
+		})
+	}
+	slices.SortStableFunc(closestDocuments, func(a, b documentSimilarity) int {
+		return cmp.Compare(b.hybridScore, a.hybridScore)
+	})
+	return closestDocuments[:min(limit, uint(len(closestDocuments)))], nil
+}
+
+// documentSimilarities returns the best chunk similarities of each document to the target.
+func (s *Server) documentSimilarities(ctx context.Context, targetQuantized []uint8, calibrations compute.Calibrations, documentIDs []uint64, chunkLimit uint) (similarities map[uint64]documentSimilarity, err error) {
+	target, err := compute.NewVector(targetQuantized)
+	if err != nil {
+		return nil, errors.Join(ErrInvalidRequest, err)
+	}
+	similarities = make(map[uint64]documentSimilarity, len(documentIDs))
+	for batch := range slices.Chunk(documentIDs, config.BATCH_SIZE_DATABASE) {
+		var embeddings []database.Embedding
+		err = s.db.WithContext(ctx).Clauses(dbresolver.Read).
+			Select("id", "document_id", "ordinal", "vector").
+			Where("document_id IN ?", batch).
+			Find(&embeddings).
+			Error
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to get document embeddings"), err)
+		}
+		if len(embeddings) == 0 {
+			continue
+		}
+		matrixEmbeddings := make([][]uint8, len(embeddings))
+		for idx, embedding := range embeddings {
+			matrixEmbeddings[idx] = embedding.Vector
+		}
+		matrix, err := calibrations.NewMatrix(matrixEmbeddings)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to decode document embeddings"), err)
+		}
+		documents := make([]documentSimilarity, len(embeddings))
+		for idx, similarity := range target.Clone().MatrixCosineSimilarity(matrix) {
+			documents[idx] = documentSimilarity{
+				documentID: embeddings[idx].DocumentID,
+				similarity: similarity,
+				chunks: []chunkSimilarity{{
+					embeddingID: embeddings[idx].ID,
+					ordinal:     embeddings[idx].Ordinal,
+					similarity:  similarity,
+					vector:      embeddings[idx].Vector,
+				}},
+			}
+		}
+		slices.SortFunc(documents, func(a, b documentSimilarity) int {
+			return cmp.Compare(b.similarity, a.similarity)
+		})
+		for _, document := range mergeDocumentChunks(documents, chunkLimit, nil) {
+			similarities[document.documentID] = document
+		}
+	}
+	return similarities, nil
+}
+
+// diversify reorders the documents with maximal marginal relevance using the vector of their best chunk.
+// Lambda weighs relevance against the similarity to documents already selected, documents without a chunk vector have no redundancy.
+func diversify(closestDocuments []documentSimilarity, relevance func(documentSimilarity) float32, lambda float32, limit uint, calibrations compute.Calibrations) (selected []documentSimilarity, err error) {
+	candidates := closestDocuments
+	if len(candidates) == 0 {
+		return closestDocuments, nil
+	}
+
+	// Normalize relevance to the cosine range
+	relevances := make([]float32, len(candidates))
+	var maxRelevance float32
+	for idx, item := range candidates {
+		relevances[idx] = relevance(item)
+		maxRelevance = max(maxRelevance, relevances[idx])
+	}
+	if maxRelevance > 0 {
+		for idx := range relevances {
+			relevances[idx] /= maxRelevance
+		}
+	}
+
+	// Collect the best chunk vectors, keyword only hits have none
+	rows := make([]int, len(candidates))
+	matrixCandidates := make([][]uint8, 0, len(candidates))
+	for idx, item := range candidates {
+		rows[idx] = -1
+		if len(item.chunks) > 0 && len(item.chunks[0].vector) > 0 {
+			rows[idx] = len(matrixCandidates)
+			matrixCandidates = append(matrixCandidates, item.chunks[0].vector)
+		}
+	}
+	var matrix compute.Matrix
+	if len(matrixCandidates) > 0 {
+		matrix, err = calibrations.NewMatrix(matrixCandidates)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to decode chunk vectors"), err)
+		}
+	}
+
+	// Select greedily
+	redundancy := make([]float32, len(matrixCandidates))
+	seeded := false
+	picked := make([]bool, len(candidates))
+	selected = make([]documentSimilarity, 0, min(limit, uint(len(candidates))))
+	for uint(len(selected)) < limit && len(selected) < len(candidates) {
+		best := -1
+		var bestScore float32
+		for idx := range candidates {
+			if picked[idx] {
+				continue
+			}
+			score := lambda * relevances[idx]
+			if rows[idx] >= 0 {
+				score -= (1 - lambda) * redundancy[rows[idx]]
+			}
+			if best < 0 || score > bestScore {
+				best, bestScore = idx, score
+			}
+		}
+		picked[best] = true
+		selected = append(selected, candidates[best])
+		if rows[best] < 0 {
+			continue
+		}
+		vector, err := calibrations.NewVector(matrixCandidates[rows[best]])
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to decode chunk vector"), err)
+		}
+		similarities := vector.MatrixCosineSimilarity(matrix.Clone())
+		if !seeded {
+			copy(redundancy, similarities)
+			seeded = true
+			continue
+		}
+		for idx, similarity := range similarities {
+			redundancy[idx] = max(redundancy[idx], similarity)
+		}
+	}
+	return selected, nil
+}
+
+// documentVector pools the stored embeddings of a document in the categories into a single query vector.
+func (s *Server) documentVector(ctx context.Context, categoryIDs []uint64, documentID uint64, pooling Pooling) (vector []uint8, err error) {
+	var document database.Document
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Read).Select("id", "category_id").Where("category_id IN ?", categoryIDs).Take(&document, documentID).Error
+	if err != nil {
+		return nil, err
+	}
+	calibrations, err := s.fetchCalibrations(ctx, database.Category{ID: document.CategoryID}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var embeddings []database.Embedding
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Read).Select("vector").Where("document_id = ?", documentID).Find(&embeddings).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddings) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	matrixQuantized := make([][]uint8, len(embeddings))
+	for idx, embedding := range embeddings {
+		matrixQuantized[idx] = embedding.Vector
+	}
+	matrix, err := calibrations.DequantizeMatrixFloat32(matrixQuantized)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to decode document embeddings"), err)
+	}
+	switch pooling {
+	case PoolingMax:
+		return compute.MaxVector(matrix), nil
+	default:
+		return compute.MeanVector(matrix), nil
+	}
+}
+
+// fetchDocuments loads the document rows of the ranked documents.
+func (s *Server) fetchDocuments(ctx context.Context, closestDocuments []documentSimilarity) (err error) {
+	if len(closestDocuments) == 0 {
+		return nil
+	}
+	ids := make([]uint64, 0, len(closestDocuments))
+	for _, item := range closestDocuments {
+		if item.document.ID != item.documentID {
+			ids = append(ids, item.documentID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	var documents []database.Document
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Read).Find(&documents, ids).Error
+	if err != nil {
+		return err
+	}
+	for _, document := range documents {
+		for idx, item := range closestDocuments {
+			if item.documentID == document.ID {
+				closestDocuments[idx].document = document
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// fetchChunks loads the text of the matched chunks.
+func (s *Server) fetchChunks(ctx context.Context, closestDocuments []documentSimilarity) (chunks map[uint64]database.Embedding, err error) {
+	ids := make([]uint64, 0, len(closestDocuments))
+	for _, item := range closestDocuments {
+		for _, chunk := range item.chunks {
+			ids = append(ids, chunk.embeddingID)
+		}
+	}
+	chunks = make(map[uint64]database.Embedding, len(ids))
+	if len(ids) == 0 {
+		return chunks, nil
+	}
+	var embeddings []database.Embedding
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Read).Select("id", "document_id", "ordinal", "text").Find(&embeddings, ids).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, embedding := range embeddings {
+		chunks[embedding.ID] = embedding
+	}
+	return chunks, nil
+}
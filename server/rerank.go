@@ -0,0 +1,107 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/expki/go-vectorsearch/ai/aicomms"
+	"github.com/expki/go-vectorsearch/config"
+	_ "github.com/expki/go-vectorsearch/env"
+	"github.com/expki/go-vectorsearch/logger"
+)
+
+type RerankOptions struct {
+	TopN  uint   `json:"top_n,omitempty"`
+	Model string `json:"model,omitempty"`
+}
+
+// rerank scores the top documents with the generate model and reorders them by that score.
+// The original order is kept if the model fails or exceeds the latency budget.
+func (s *Server) rerank(ctx context.Context, text string, closestDocuments []documentSimilarity, options RerankOptions) (err error) {
+	candidates := closestDocuments[:min(options.TopN, uint(len(closestDocuments)))]
+	if len(candidates) <= 1 {
+		return nil
+	}
+
+	// Load candidate passages
+	err = s.fetchDocuments(ctx, candidates)
+	if err != nil {
+		return errors.Join(errors.New("failed to fetch rerank documents"), err)
+	}
+	chunks, err := s.fetchChunks(ctx, candidates)
+	if err != nil {
+		return errors.Join(errors.New("failed to fetch rerank chunks"), err)
+	}
+
+	// Create prompt
+	var prompt strings.Builder
+	prompt.WriteString("Query: ")
+	prompt.WriteString(text)
+	prompt.WriteString("\n\nRate how relevant each passage is to the query from 0 (unrelated) to 10 (fully answers it). ")
+	prompt.WriteString(`Respond only with JSON in the form {"scores": [...]} containing one score per passage in the given order.`)
+	prompt.WriteString("\n\n")
+	for idx, item := range candidates {
+		var passage string
+		if len(item.chunks) > 0 {
+			passage = string(chunks[item.chunks[0].embeddingID].Text)
+		} else {
+			passage = Flatten(item.document.Document.JSON())
+		}
+		words := strings.Fields(passage)
+		passage = strings.Join(words[:min(len(words), config.RERANK_PASSAGE_WORDS)], " ")
+		prompt.WriteString(fmt.Sprintf("[%d] %s\n", idx+1, passage))
+	}
+
+	// Score with the generate model
+	model := options.Model
+	if model == "" {
+		model = s.ai.GenerateModel()
+	}
+	generateCtx, cancel := context.WithTimeout(ctx, config.RERANK_TIMEOUT)
+	defer cancel()
+	generateRes, err := s.ai.Generate(generateCtx, aicomms.GenerateRequest{
+		Model:  model,
+		Prompt: prompt.String(),
+		Format: "json",
+	})
+	if err == nil {
+		// success
+	} else if ctx.Err() != nil {
+		// request canceled
+		return ctx.Err()
+	} else if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// budget exceeded
+		logger.Sugar().Warnf("rerank exceeded latency budget, keeping original order")
+		return nil
+	} else {
+		// exception encountered
+		logger.Sugar().Warnf("rerank failed, keeping original order: %v", err)
+		return nil
+	}
+	var scores struct {
+		Scores []float32 `json:"scores"`
+	}
+	response := generateRes.Response
+	if start, end := strings.Index(response, "{"), strings.LastIndex(response, "}"); start >= 0 && end > start {
+		response = response[start : end+1]
+	}
+	if err := json.Unmarshal([]byte(response), &scores); err != nil || len(scores.Scores) != len(candidates) {
+		logger.Sugar().Warnf("rerank returned invalid scores, keeping original order: %s", generateRes.Response)
+		return nil
+	}
+
+	// Reorder candidates
+	for idx := range candidates {
+		candidates[idx].rerankScore = &scores.Scores[idx]
+	}
+	slices.SortStableFunc(candidates, func(a, b documentSimilarity) int {
+		return cmp.Compare(*b.rerankScore, *a.rerankScore)
+	})
+	return nil
+}
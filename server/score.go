@@ -0,0 +1,119 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/expki/go-vectorsearch/database"
+	_ "github.com/expki/go-vectorsearch/env"
+)
+
+type BoostModifier string
+
+const (
+	BoostModifierNone  BoostModifier = "none"
+	BoostModifierLog1p BoostModifier = "log1p"
+	BoostModifierSqrt  BoostModifier = "sqrt"
+)
+
+// ScoreOptions multiplies the relevance of each document by a recency decay and numeric field boosts.
+type ScoreOptions struct {
+	Decay  *DecayOptions `json:"decay,omitempty"`
+	Boosts []FieldBoost  `json:"boosts,omitempty"`
+}
+
+// DecayOptions halves the score every half life since the document was last updated.
+type DecayOptions struct {
+	HalfLife string  `json:"half_life"`
+	Floor    float32 `json:"floor,omitempty"`
+	halfLife time.Duration
+}
+
+// FieldBoost multiplies the score by 1 + factor * modifier(value) of a numeric document field.
+type FieldBoost struct {
+	Field    string        `json:"field"`
+	Factor   float32       `json:"factor"`
+	Modifier BoostModifier `json:"modifier,omitempty"`
+	Missing  *float64      `json:"missing,omitempty"`
+}
+
+// Validate checks the scoring functions and parses the decay half life.
+func (o *ScoreOptions) Validate() (err error) {
+	if o.Decay != nil {
+		o.Decay.halfLife, err = time.ParseDuration(o.Decay.HalfLife)
+		if err != nil || o.Decay.halfLife <= 0 {
+			return fmt.Errorf("decay half life must be a positive duration: %q", o.Decay.HalfLife)
+		}
+		if o.Decay.Floor < 0 || o.Decay.Floor > 1 {
+			return errors.New("decay floor must be between 0 and 1")
+		}
+	}
+	for idx, boost := range o.Boosts {
+		if boost.Field == "" {
+			return errors.New("boost requires a field")
+		}
+		switch boost.Modifier {
+		case "":
+			o.Boosts[idx].Modifier = BoostModifierNone
+		case BoostModifierNone, BoostModifierLog1p, BoostModifierSqrt:
+		default:
+			return fmt.Errorf("unknown boost modifier: %s", boost.Modifier)
+		}
+	}
+	return nil
+}
+
+// apply returns the relevance multiplied by the decay and boosts of the document.
+func (o ScoreOptions) apply(now time.Time, relevance float32, document database.Document) (score float32) {
+	score = relevance
+	if o.Decay != nil {
+		age := max(0, now.Sub(document.LastUpdated))
+		decay := float32(math.Exp2(-float64(age) / float64(o.Decay.halfLife)))
+		score *= o.Decay.Floor + (1-o.Decay.Floor)*decay
+	}
+	if len(o.Boosts) == 0 {
+		return score
+	}
+	value := document.Document.JSON()
+	for _, boost := range o.Boosts {
+		field, _ := lookupField(value, boost.Field)
+		number, ok := field.(float64)
+		if !ok {
+			if boost.Missing == nil {
+				// documents without the field are not boosted
+				continue
+			}
+			number = *boost.Missing
+		}
+		switch boost.Modifier {
+		case BoostModifierLog1p:
+			number = math.Log1p(max(0, number))
+		case BoostModifierSqrt:
+			number = math.Sqrt(max(0, number))
+		}
+		score *= 1 + boost.Factor*float32(number)
+	}
+	return score
+}
+
+// score applies the scoring functions to the candidates and reorders them by the final score.
+func (s *Server) score(ctx context.Context, closestDocuments []documentSimilarity, relevance func(documentSimilarity) float32, options ScoreOptions) (err error) {
+	err = s.fetchDocuments(ctx, closestDocuments)
+	if err != nil {
+		return errors.Join(errors.New("failed to fetch scored documents"), err)
+	}
+	now := time.Now()
+	for idx, item := range closestDocuments {
+		score := options.apply(now, relevance(item), item.document)
+		closestDocuments[idx].score = &score
+	}
+	slices.SortStableFunc(closestDocuments, func(a, b documentSimilarity) int {
+		return cmp.Compare(*b.score, *a.score)
+	})
+	return nil
+}
@@ -1,7 +1,6 @@
 package server
 
 import (
-	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
@@ -23,23 +22,80 @@ import (
 	"gorm.io/plugin/dbresolver"
 )
 
+type SearchMode string
+
+const (
+	SearchModeVector  SearchMode = "vector"
+	SearchModeKeyword SearchMode = "keyword"
+	SearchModeHybrid  SearchMode = "hybrid"
+)
+
+type Pooling string
+
+const (
+	PoolingMean Pooling = "mean"
+	PoolingMax  Pooling = "max"
+)
+
 type SearchRequest struct {
-	Owner     string `json:"owner"`
-	Category  string `json:"category"`
-	Text      string `json:"text"`
-	Count     uint   `json:"count"`
-	Offset    uint   `json:"offset,omitempty"`
-	Centroids int    `json:"centroids,omitempty"`
+	Owner         string                `json:"owner"`
+	Category      string                `json:"category"`
+	Categories    []string              `json:"categories,omitempty"`
+	AllCategories bool                  `json:"all_categories,omitempty"`
+	Text          string                `json:"text"`
+	Vector        []float32             `json:"vector,omitempty"`
+	DocumentID    uint64                `json:"document_id,omitempty"`
+	Pooling       Pooling               `json:"pooling,omitempty"`
+	Count         uint                  `json:"count"`
+	Offset        uint                  `json:"offset,omitempty"`
+	Centroids     int                   `json:"centroids,omitempty"`
+	Probe         *ProbeOptions         `json:"probe,omitempty"`
+	EF            int                   `json:"ef,omitempty"`
+	Rescore       *uint                 `json:"rescore,omitempty"`
+	Prefilter     uint                  `json:"prefilter,omitempty"`
+	Filter        *Filter               `json:"filter,omitempty"`
+	Mode          SearchMode            `json:"mode,omitempty"`
+	Chunks        uint                  `json:"chunks,omitempty"`
+	MinSimilarity *float32              `json:"min_similarity,omitempty"`
+	Range         bool                  `json:"range,omitempty"`
+	MMRLambda     *float32              `json:"mmr_lambda,omitempty"`
+	Rerank        *RerankOptions        `json:"rerank,omitempty"`
+	Expand        *ExpandOptions        `json:"expand,omitempty"`
+	Positive      []QueryExample        `json:"positive,omitempty"`
+	Negative      []QueryExample        `json:"negative,omitempty"`
+	Score         *ScoreOptions         `json:"score,omitempty"`
+	Cursor        string                `json:"cursor,omitempty"`
+	Aggregation   *database.Aggregation `json:"aggregation,omitempty"`
+	ContextWindow uint32                `json:"context_window,omitempty"`
+	Explain       bool                  `json:"explain,omitempty"`
 }
 
 type SearchResponse struct {
-	Documents []DocumentSearch `json:"documents"`
+	Documents  []DocumentSearch `json:"documents"`
+	Total      *uint            `json:"total,omitempty"`
+	Expansions []string         `json:"expansions,omitempty"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+	Explain    *SearchExplain   `json:"explain,omitempty"`
 }
 
 type DocumentSearch struct {
 	DocumentUpload
-	DocumentID         uint64  `json:"document_id"`
-	DocumentSimilarity float32 `json:"document_similarity"`
+	Category           string       `json:"category"`
+	DocumentID         uint64       `json:"document_id"`
+	DocumentSimilarity float32      `json:"document_similarity"`
+	AggregateScore     *float32     `json:"aggregate_score,omitempty"`
+	KeywordScore       float32      `json:"keyword_score,omitempty"`
+	HybridScore        float32      `json:"hybrid_score,omitempty"`
+	RerankScore        *float32     `json:"rerank_score,omitempty"`
+	Score              *float32     `json:"score,omitempty"`
+	Chunks             []ChunkMatch `json:"chunks,omitempty"`
+	Passages           []Passage    `json:"passages,omitempty"`
+}
+
+type ChunkMatch struct {
+	Index      uint32  `json:"index"`
+	Text       string  `json:"text"`
+	Similarity float32 `json:"similarity"`
 }
 
 func (s *Server) SearchHttp(w http.ResponseWriter, r *http.Request) {
@@ -89,6 +145,12 @@ func (s *Server) SearchHttp(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(499)
 		io.WriteString(w, `{"error":"Client canceled search request"}`)
 		return
+	} else if errors.Is(err, ErrInvalidRequest) {
+		// search request invalid
+		logger.Sugar().Debugf("%d search request invalid: %s", txid, err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":"Invalid search request"}`)
+		return
 	} else {
 		// search failed
 		logger.Sugar().Errorf("%d search request failed: %s", txid, err.Error())
@@ -113,164 +175,367 @@ func (s *Server) SearchHttp(w http.ResponseWriter, r *http.Request) {
 
 // Search for a previously uploaded embedding vector in the database and return similar documents.
 func (s *Server) Search(ctx context.Context, req SearchRequest) (res SearchResponse, err error) {
-	req.Count = max(1, min(req.Count, 20))
+	if req.Range {
+		req.Count = max(1, min(req.Count, config.RANGE_LIMIT))
+	} else {
+		req.Count = max(1, min(req.Count, s.config.Search.GetMaxCount()))
+	}
 	req.Offset = max(0, req.Offset)
-	if req.Centroids == 0 {
-		req.Centroids = 1
-	} else if req.Centroids < 0 {
+	req.Chunks = max(1, min(req.Chunks, config.CHUNK_LIMIT))
+	req.ContextWindow = min(req.ContextWindow, config.WINDOW_LIMIT)
+	if req.Centroids < 0 {
 		req.Centroids = math.MaxInt
+	} else if req.Centroids == 0 && req.Probe == nil {
+		req.Probe = &ProbeOptions{}
+	}
+	if req.Probe != nil {
+		if req.Centroids > 0 {
+			return res, errors.Join(ErrInvalidRequest, errors.New("probe cannot be combined with a fixed centroid count"))
+		}
+		err = req.Probe.Validate(s.config.Search)
+		if err != nil {
+			return res, errors.Join(ErrInvalidRequest, err)
+		}
+	}
+	if req.EF <= 0 {
+		req.EF = s.config.Search.GetEF()
+	}
+	req.EF = min(req.EF, s.config.Search.GetMaxEF())
+	if req.Rescore == nil {
+		rescore := uint(config.PQ_RESCORE)
+		req.Rescore = &rescore
+	}
+	*req.Rescore = min(*req.Rescore, config.PQ_RESCORE_LIMIT)
+	if req.Prefilter == 0 {
+		req.Prefilter = config.PREFILTER_CANDIDATES
+	}
+	req.Prefilter = min(req.Prefilter, config.PREFILTER_LIMIT)
+	switch req.Mode {
+	case "":
+		req.Mode = SearchModeVector
+	case SearchModeVector, SearchModeKeyword, SearchModeHybrid:
+	default:
+		return res, errors.Join(ErrInvalidRequest, fmt.Errorf("unknown search mode: %s", req.Mode))
+	}
+	switch req.Pooling {
+	case "":
+		req.Pooling = PoolingMean
+	case PoolingMean, PoolingMax:
+	default:
+		return res, errors.Join(ErrInvalidRequest, fmt.Errorf("unknown pooling: %s", req.Pooling))
+	}
+	if req.DocumentID != 0 && req.Mode == SearchModeKeyword {
+		return res, errors.Join(ErrInvalidRequest, errors.New("document search requires vector or hybrid mode"))
+	}
+	if req.DocumentID != 0 && req.Vector != nil {
+		return res, errors.Join(ErrInvalidRequest, errors.New("document id and vector are mutually exclusive"))
+	}
+	if req.AllCategories && (req.Category != "" || len(req.Categories) > 0) {
+		return res, errors.Join(ErrInvalidRequest, errors.New("all categories and category names are mutually exclusive"))
+	}
+	if req.MinSimilarity != nil && req.Mode == SearchModeKeyword {
+		return res, errors.Join(ErrInvalidRequest, errors.New("minimum similarity requires vector or hybrid mode"))
+	}
+	if req.Range && (req.MinSimilarity == nil || req.Mode != SearchModeVector) {
+		return res, errors.Join(ErrInvalidRequest, errors.New("range search requires vector mode and a minimum similarity"))
+	}
+	if req.MMRLambda != nil && (*req.MMRLambda < 0 || *req.MMRLambda > 1) {
+		return res, errors.Join(ErrInvalidRequest, errors.New("mmr lambda must be between 0 and 1"))
+	}
+	if req.MMRLambda != nil && (req.Mode == SearchModeKeyword || req.Range) {
+		return res, errors.Join(ErrInvalidRequest, errors.New("mmr requires vector or hybrid mode without range"))
+	}
+	if req.Rerank != nil {
+		if req.Rerank.TopN == 0 {
+			req.Rerank.TopN = config.RERANK_CANDIDATES
+		}
+		req.Rerank.TopN = min(req.Rerank.TopN, config.RERANK_LIMIT)
+	}
+	if req.Expand != nil {
+		switch req.Expand.Mode {
+		case ExpansionModeHyde, ExpansionModeMultiQuery:
+		default:
+			return res, errors.Join(ErrInvalidRequest, fmt.Errorf("unknown expansion mode: %s", req.Expand.Mode))
+		}
+		if req.Mode == SearchModeKeyword || req.Vector != nil || req.DocumentID != 0 {
+			return res, errors.Join(ErrInvalidRequest, errors.New("query expansion requires a text query in vector or hybrid mode"))
+		}
+		if req.Expand.Queries == 0 {
+			req.Expand.Queries = config.EXPAND_QUERIES
+		}
+		req.Expand.Queries = min(req.Expand.Queries, config.EXPAND_LIMIT)
+	}
+	examples := len(req.Positive) + len(req.Negative)
+	if examples > 0 {
+		if req.Mode == SearchModeKeyword || req.Expand != nil {
+			return res, errors.Join(ErrInvalidRequest, errors.New("example queries require vector or hybrid mode without expansion"))
+		}
+		if examples > config.EXAMPLE_LIMIT {
+			return res, errors.Join(ErrInvalidRequest, fmt.Errorf("example queries exceed limit of %d", config.EXAMPLE_LIMIT))
+		}
+		if req.Text == "" && req.Vector == nil && req.DocumentID == 0 && len(req.Positive) == 0 {
+			return res, errors.Join(ErrInvalidRequest, errors.New("negative examples require a query or positive examples"))
+		}
+		for _, example := range slices.Concat(req.Positive, req.Negative) {
+			if (example.Text == "") == (example.DocumentID == 0) {
+				return res, errors.Join(ErrInvalidRequest, errors.New("example requires either text or a document id"))
+			}
+			if example.Weight < 0 {
+				return res, errors.Join(ErrInvalidRequest, errors.New("example weight must not be negative"))
+			}
+		}
+	}
+	paged := req.Mode == SearchModeVector && !req.Range && req.MMRLambda == nil && req.Rerank == nil && req.Expand == nil && req.Score == nil
+	if req.Cursor != "" && (!paged || req.Offset > 0) {
+		return res, errors.Join(ErrInvalidRequest, errors.New("cursor requires vector mode without offset, range, mmr, rerank, expansion or scoring"))
+	}
+	if req.Aggregation != nil {
+		if req.Mode == SearchModeKeyword {
+			return res, errors.Join(ErrInvalidRequest, errors.New("chunk aggregation requires vector or hybrid mode"))
+		}
+		if err = validateAggregation(req.Aggregation); err != nil {
+			return res, errors.Join(ErrInvalidRequest, err)
+		}
+	}
+	if req.Score != nil {
+		if err = req.Score.Validate(); err != nil {
+			return res, errors.Join(ErrInvalidRequest, err)
+		}
+	}
+	if req.Filter != nil {
+		if err = req.Filter.Validate(); err != nil {
+			return res, errors.Join(ErrInvalidRequest, err)
+		}
 	}
 	logger.Sugar().Debug("search request received")
+	if req.Explain {
+		res.Explain = &SearchExplain{}
+		defer res.Explain.stage("total", time.Now())
+	}
 
 	// Get embedding
-	logger.Sugar().Debug("embedding search query")
-	embedRes, err := s.ai.Embed(ctx, aicomms.EmbedRequest{
-		Model: s.ai.EmbedModel(),
-		Input: []string{fmt.Sprintf("search_query: %s", req.Text)},
-	})
-	if err == nil {
-		// success
-	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
-		// request canceled
-		return res, err
-	} else {
-		// exception encountered
-		return res, errors.Join(errors.New("failed to embed search query"), err)
+	var target []uint8
+	var expansions [][]uint8
+	var exampleEmbeddings [][]uint8
+	var embedInput []string
+	if req.Mode == SearchModeKeyword || req.DocumentID != 0 {
+		// no query embedding required
+	} else if req.Vector != nil {
+		if len(req.Vector) == 0 {
+			return res, errors.Join(ErrInvalidRequest, errors.New("query vector is empty"))
+		}
+		target = compute.QuantizeVectorFloat32(req.Vector)
+	} else if req.Text != "" || len(req.Positive) == 0 {
+		embedInput = append(embedInput, fmt.Sprintf("search_query: %s", req.Text))
+		if req.Expand != nil {
+			logger.Sugar().Debugf("expanding search query: %s", req.Expand.Mode)
+			var expansionInput []string
+			stageStart := time.Now()
+			res.Expansions, expansionInput, err = s.expandQuery(ctx, req.Text, *req.Expand)
+			if err != nil {
+				return res, err
+			}
+			res.Explain.stage("expand", stageStart)
+			embedInput = append(embedInput, expansionInput...)
+		}
 	}
-	if len(embedRes.Embeddings) < 1 {
-		return res, errors.New("embedding returned empty response")
+	exampleInput := len(embedInput)
+	for _, example := range slices.Concat(req.Positive, req.Negative) {
+		if example.Text != "" {
+			embedInput = append(embedInput, fmt.Sprintf("search_document: %s", example.Text))
+		}
+	}
+	if len(embedInput) > 0 {
+		logger.Sugar().Debug("embedding search query")
+		stageStart := time.Now()
+		embedRes, err := s.ai.Embed(ctx, aicomms.EmbedRequest{
+			Model: s.ai.EmbedModel(),
+			Input: embedInput,
+		})
+		res.Explain.stage("embed", stageStart)
+		if err == nil {
+			// success
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			// request canceled
+			return res, err
+		} else {
+			// exception encountered
+			return res, errors.Join(errors.New("failed to embed search query"), err)
+		}
+		if len(embedRes.Embeddings) < len(embedInput) {
+			return res, errors.New("embedding returned empty response")
+		}
+		embeddings := embedRes.Embeddings.Value()
+		if exampleInput > 0 {
+			target = embeddings[0]
+			expansions = embeddings[1:exampleInput]
+		}
+		exampleEmbeddings = embeddings[exampleInput:len(embedInput)]
 	}
-	target := compute.NewVector(embedRes.Embeddings[0])
 
-	// Get Owner
-	logger.Sugar().Debugf("retrieving owner: %s", req.Owner)
-	owner, err := s.cache.FetchOwner(req.Owner, func() (owner database.Owner, err error) {
-		logger.Sugar().Debug("retrieve owner from database")
-		return owner, s.db.WithContext(ctx).Clauses(dbresolver.Read).Where("name = ?", req.Owner).Take(&owner).Error
-	})
+	// Get Categories
+	categoryNames := req.Categories
+	if req.Category != "" || len(req.Categories) == 0 {
+		categoryNames = append([]string{req.Category}, req.Categories...)
+	}
+	categories, err := s.findCategories(ctx, req.Owner, categoryNames, req.AllCategories, res.Explain)
 	if err == nil {
-		// owner found
+		// categories found
 	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
-		// owner request canceled
+		// categories request canceled
 		return res, err
 	} else if errors.Is(err, gorm.ErrRecordNotFound) {
 		// owner not found
 		return res, nil
 	} else {
-		// owner retrieve error
-		return res, errors.Join(errors.New("failed to get owner"), err)
-	}
-
-	// Get Category
-	logger.Sugar().Debugf("retrieving category: %s", req.Category)
-	category, err := s.cache.FetchCategory(req.Category, owner.ID, func() (category database.Category, err error) {
-		logger.Sugar().Debug("retrieve category from database")
-		return category, s.db.WithContext(ctx).Clauses(dbresolver.Read).Where("name = ? AND owner_id = ?", req.Category, owner.ID).Take(&category).Error
-	})
-	if err == nil {
-		// category found
-	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
-		// category request canceled
+		// categories retrieve error
 		return res, err
-	} else if errors.Is(err, gorm.ErrRecordNotFound) {
-		// category not found
+	}
+	if len(categories) == 0 {
 		return res, nil
-	} else {
-		// category retrieve error
-		return res, errors.Join(errors.New("failed to get category"), err)
+	}
+	categoryIDs := make([]uint64, len(categories))
+	categoryNameByID := make(map[uint64]string, len(categories))
+	for idx, category := range categories {
+		categoryIDs[idx] = category.ID
+		categoryNameByID[category.ID] = category.Name
 	}
 
-	// Get Centroids
-	logger.Sugar().Debug("retrieving centroids")
-	centroids, err := s.cache.FetchCentroids(category.ID, func() (centroids []database.Centroid, err error) {
-		logger.Sugar().Debug("retrieve centroids from database")
-		return centroids, s.db.WithContext(ctx).Clauses(dbresolver.Read).Where("category_id = ?", category.ID).Find(&centroids).Error
-	})
-	if err == nil {
-		// centroids found
-	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
-		// centroids request canceled
-		return res, err
-	} else {
-		// centroids retrieve error
-		return res, errors.Join(errors.New("failed to get centroids"), err)
+	// Get document vector
+	if req.DocumentID != 0 {
+		logger.Sugar().Debugf("pooling document vectors: %d", req.DocumentID)
+		stageStart := time.Now()
+		target, err = s.documentVector(ctx, categoryIDs, req.DocumentID, req.Pooling)
+		res.Explain.stage("document_vector", stageStart)
+		if err == nil {
+			// success
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			// request canceled
+			return res, err
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			// document not found in categories
+			return res, errors.Join(ErrInvalidRequest, fmt.Errorf("document not found: %d", req.DocumentID))
+		} else {
+			// exception encountered
+			return res, errors.Join(errors.New("failed to get document vector"), err)
+		}
 	}
-	if len(centroids) == 0 {
-		return res, nil
+
+	// Combine example queries
+	exclude := []uint64{req.DocumentID}
+	if examples > 0 {
+		logger.Sugar().Debugf("combining example queries: %d", examples)
+		var exampleIDs []uint64
+		stageStart := time.Now()
+		target, exampleIDs, err = s.exampleVector(ctx, categoryIDs, target, req.Positive, req.Negative, exampleEmbeddings, req.Pooling)
+		res.Explain.stage("examples", stageStart)
+		if err == nil {
+			// success
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			// request canceled
+			return res, err
+		} else if errors.Is(err, ErrInvalidRequest) {
+			// example invalid
+			return res, err
+		} else {
+			// exception encountered
+			return res, errors.Join(errors.New("failed to combine example queries"), err)
+		}
+		exclude = append(exclude, exampleIDs...)
 	}
 
-	// Find closest centroids to embedding
-	type centroidSimilarity struct {
-		centroid   database.Centroid
-		similarity float32
+	// Rank documents
+	limit := req.Count + req.Offset
+	if req.Range {
+		// range search collects every match up to the server limit then pages
+		limit = config.RANGE_LIMIT
+		req.Centroids = math.MaxInt
+		req.Probe = nil
+	} else if req.MMRLambda != nil {
+		// diversification selects from a deeper candidate list
+		limit = max(limit, config.MMR_CANDIDATES)
+	}
+	if req.Score != nil && !req.Range {
+		// boosts can lift documents from deeper in the ranking
+		limit = max(limit, config.SCORE_CANDIDATES)
+	}
+	if req.Rerank != nil {
+		limit = max(limit, req.Rerank.TopN)
+	}
+	query := vectorQuery{
+		target:        target,
+		centroids:     req.Centroids,
+		limit:         limit,
+		chunks:        req.Chunks,
+		filter:        req.Filter,
+		exclude:       exclude,
+		minSimilarity: req.MinSimilarity,
+		expansions:    expansions,
+		aggregation:   req.Aggregation,
+		explain:       res.Explain,
+		ef:            req.EF,
+		rescore:       *req.Rescore,
+		prefilter:     req.Prefilter,
 	}
-	closestCentroids := make([]centroidSimilarity, len(centroids))
-	// Convert centroids to matrix format for cosine similarity calculation
-	matrixCentroids := make([][]uint8, len(centroids))
-	for idx, centroid := range centroids {
-		matrixCentroids[idx] = centroid.Vector
+	if req.Probe != nil {
+		query.centroids = int(s.config.Search.GetMaxProbe())
+		query.adaptive = req.Probe
 	}
-	logger.Sugar().Debugf("calculate nearest centroids: %d", min(req.Centroids, len(closestCentroids)))
-	for idx, similarity := range target.Clone().MatrixCosineSimilarity(compute.NewMatrix(matrixCentroids)) {
-		closestCentroids[idx] = centroidSimilarity{
-			centroid:   centroids[idx],
-			similarity: similarity,
+	if paged && slices.ContainsFunc(categories, func(category database.Category) bool {
+		return category.IndexType == database.IndexTypeHNSW || category.IndexType == database.IndexTypeIVFPQ
+	}) {
+		// graph searches cannot be pinned to centroids and code similarities change when rescored
+		if req.Cursor != "" {
+			return res, errors.Join(ErrInvalidRequest, errors.New("cursor is not supported on hnsw or ivf_pq categories"))
 		}
+		paged = false
 	}
-	slices.SortFunc(closestCentroids, func(a, b centroidSimilarity) int {
-		return cmp.Compare(b.similarity, a.similarity)
-	})
-	closestCentroids = closestCentroids[:min(req.Centroids, len(closestCentroids))]
-	closestCentroidIdList := make([]uint64, len(closestCentroids))
-	for idx, centroid := range closestCentroids {
-		closestCentroidIdList[idx] = centroid.centroid.ID
-	}
-
-	// create new cosine similarity graph
-	cosineSimilarity, closeGraph := compute.VectorMatrixCosineSimilarity()
-	defer closeGraph()
-
-	// For each centroid, find the closest documents to the embedding
-	type documentSimilarity struct {
-		documentID uint64
-		document   database.Document
-		similarity float32
-	}
-	closestDocuments := make([]documentSimilarity, 0, req.Count+req.Offset+config.BATCH_SIZE_DATABASE)
-	var embeddings []database.Embedding
-	err = s.db.WithContext(ctx).Clauses(dbresolver.Read).
-		Where("centroid_id IN ?", closestCentroidIdList).
-		FindInBatches(&embeddings, config.BATCH_SIZE_DATABASE, func(tx *gorm.DB, n int) error {
-			// find nearest embedding to the query
-			matrixEmbeddings := make([][]uint8, len(embeddings))
-			for idx, embedding := range embeddings {
-				matrixEmbeddings[idx] = embedding.Vector
-			}
-			for idx, similarity := range cosineSimilarity(target.Clone(), compute.NewMatrix(matrixEmbeddings)) {
-				closestDocuments = append(closestDocuments, documentSimilarity{
-					documentID: embeddings[idx].DocumentID,
-					similarity: similarity,
-				})
+	if paged && slices.ContainsFunc(categories, func(category database.Category) bool {
+		if req.Aggregation != nil {
+			return aggregates(req.Aggregation)
+		}
+		return aggregates(&category.Aggregation)
+	}) {
+		// cursor positions assume documents are ranked by their best chunk
+		if req.Cursor != "" {
+			return res, errors.Join(ErrInvalidRequest, errors.New("cursor requires max chunk aggregation"))
+		}
+		paged = false
+	}
+	var hash uint64
+	if paged {
+		// pin the probed centroids so every page ranks the same documents
+		hash = queryHash(target, req)
+		if req.Cursor != "" {
+			cursor, err := decodeCursor(req.Cursor)
+			if err != nil {
+				return res, errors.Join(ErrInvalidRequest, err)
 			}
-			// sort by nearest
-			slices.SortFunc(closestDocuments, func(a, b documentSimilarity) int {
-				return cmp.Compare(b.similarity, a.similarity)
-			})
-			// remove duplicates
-			seen := make(map[uint64]struct{}, len(closestDocuments))
-			unqiueClosestDocuents := make([]documentSimilarity, 0, len(closestDocuments))
-			for _, document := range closestDocuments {
-				if _, ok := seen[document.documentID]; !ok {
-					unqiueClosestDocuents = append(unqiueClosestDocuents, document)
-					seen[document.documentID] = struct{}{}
-				}
+			if cursor.Hash != hash {
+				return res, errors.Join(ErrInvalidRequest, errors.New("cursor does not match the query"))
 			}
-			closestDocuments = unqiueClosestDocuents
-			// truncate list
-			closestDocuments = closestDocuments[:min(req.Count+req.Offset, uint(len(closestDocuments)))]
-			return nil
-		}).
-		Error
+			query.probe = cursor.Centroids
+			query.after = &cursorPosition{similarity: cursor.Similarity, documentID: cursor.DocumentID, returned: cursor.Returned}
+		} else {
+			// record the centroids the first page scans
+			query.scanned = &[]uint64{}
+		}
+	}
+	var closestDocuments []documentSimilarity
+	switch req.Mode {
+	case SearchModeVector:
+		closestDocuments, err = s.vectorSearch(ctx, categories, query)
+	case SearchModeKeyword:
+		stageStart := time.Now()
+		var scores []keywordScore
+		scores, err = s.keywordSearch(ctx, categoryIDs, req.Text)
+		if err == nil {
+			closestDocuments, err = s.keywordRank(ctx, categories, scores, limit, req.Filter)
+		}
+		res.Explain.stage("keyword", stageStart)
+	case SearchModeHybrid:
+		closestDocuments, err = s.hybridSearch(ctx, categories, query, req.Text)
+	}
 	if err == nil {
 		// success
 	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
@@ -278,17 +543,92 @@ func (s *Server) Search(ctx context.Context, req SearchRequest) (res SearchRespo
 		return res, err
 	} else {
 		// exception encountered
-		return res, errors.Join(errors.New("database document embedding batch retrieval failed"), err)
+		return res, errors.Join(errors.New("failed to rank documents"), err)
+	}
+	relevance := func(item documentSimilarity) float32 { return item.rankScore() }
+	switch req.Mode {
+	case SearchModeKeyword:
+		relevance = func(item documentSimilarity) float32 { return item.keywordScore }
+	case SearchModeHybrid:
+		relevance = func(item documentSimilarity) float32 { return item.hybridScore }
+	}
+	if req.Score != nil {
+		logger.Sugar().Debugf("scoring documents: %d", len(closestDocuments))
+		stageStart := time.Now()
+		err = s.score(ctx, closestDocuments, relevance, *req.Score)
+		res.Explain.stage("score", stageStart)
+		if err == nil {
+			// success
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			// request canceled
+			return res, err
+		} else {
+			// exception encountered
+			return res, errors.Join(errors.New("failed to score documents"), err)
+		}
+		relevance = func(item documentSimilarity) float32 { return *item.score }
+	}
+	if req.MMRLambda != nil {
+		stageStart := time.Now()
+		calibrations, err := s.fetchCategoriesCalibrations(ctx, categories, res.Explain)
+		if err != nil {
+			return res, err
+		}
+		closestDocuments, err = diversify(closestDocuments, relevance, *req.MMRLambda, req.Count+req.Offset, calibrations)
+		if err != nil {
+			return res, err
+		}
+		res.Explain.stage("mmr", stageStart)
+	}
+	if req.Rerank != nil {
+		logger.Sugar().Debugf("reranking documents: %d", min(req.Rerank.TopN, uint(len(closestDocuments))))
+		stageStart := time.Now()
+		err = s.rerank(ctx, req.Text, closestDocuments, *req.Rerank)
+		res.Explain.stage("rerank", stageStart)
+		if err == nil {
+			// success
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			// request canceled
+			return res, err
+		} else {
+			// exception encountered
+			return res, errors.Join(errors.New("failed to rerank documents"), err)
+		}
+	}
+	if req.Range {
+		total := uint(len(closestDocuments))
+		res.Total = &total
+	}
+	closestDocuments = closestDocuments[min(uint(len(closestDocuments)), req.Offset):]
+	closestDocuments = closestDocuments[:min(uint(len(closestDocuments)), req.Count)]
+	for idx := range closestDocuments {
+		// aggregation keeps more chunks than are returned
+		closestDocuments[idx].chunks = closestDocuments[idx].chunks[:min(uint(len(closestDocuments[idx].chunks)), req.Chunks)]
+	}
+	if paged && uint(len(closestDocuments)) == req.Count {
+		last := closestDocuments[len(closestDocuments)-1]
+		var returned uint
+		if query.after != nil {
+			returned = query.after.returned
+		}
+		probe := query.probe
+		if query.scanned != nil {
+			probe = *query.scanned
+		}
+		res.NextCursor = searchCursor{
+			Hash:       hash,
+			Centroids:  probe,
+			Similarity: last.similarity,
+			DocumentID: last.documentID,
+			Returned:   returned + req.Offset + req.Count,
+		}.encode()
 	}
 
 	// Fetch closest documents data
-	ids := make([]uint64, len(closestDocuments))
-	for idx, item := range closestDocuments {
-		ids[idx] = item.documentID
-	}
-	var documents []database.Document
 	logger.Sugar().Debug("fetching nearest documents")
-	err = s.db.WithContext(ctx).Clauses(dbresolver.Read).Find(&documents, ids).Error
+	stageStart := time.Now()
+	err = s.fetchDocuments(ctx, closestDocuments)
+	res.Explain.stage("document_fetch", stageStart)
 	if err == nil {
 		// success
 	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
@@ -298,37 +638,152 @@ func (s *Server) Search(ctx context.Context, req SearchRequest) (res SearchRespo
 		// exception encountered
 		return res, errors.Join(errors.New("database document retrieval failed"), err)
 	}
-	for _, document := range documents {
-		for idx, item := range closestDocuments {
-			if item.documentID == document.ID {
-				closestDocuments[idx].document = document
-				break
-			}
+
+	// Fetch matched chunks text
+	logger.Sugar().Debug("fetching matched chunks")
+	stageStart = time.Now()
+	chunks, err := s.fetchChunks(ctx, closestDocuments)
+	res.Explain.stage("chunk_fetch", stageStart)
+	if err == nil {
+		// success
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// request canceled
+		return res, err
+	} else {
+		// exception encountered
+		return res, errors.Join(errors.New("database chunk retrieval failed"), err)
+	}
+
+	// Fetch neighbouring chunks of the matches
+	var passages map[uint64][]Passage
+	if req.ContextWindow > 0 {
+		logger.Sugar().Debugf("fetching context windows: %d", req.ContextWindow)
+		stageStart = time.Now()
+		passages, err = s.fetchPassages(ctx, closestDocuments, req.ContextWindow)
+		res.Explain.stage("passage_fetch", stageStart)
+		if err == nil {
+			// success
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			// request canceled
+			return res, err
+		} else {
+			// exception encountered
+			return res, errors.Join(errors.New("database passage retrieval failed"), err)
 		}
 	}
 
 	// Create response
 	logger.Sugar().Debug("creating response")
-	res.Documents = make([]DocumentSearch, req.Count)
-	skipCount := 0
-	addCount := 0
+	res.Documents = make([]DocumentSearch, len(closestDocuments))
 	for idx, item := range closestDocuments {
-		if uint(idx) < req.Offset {
-			skipCount++
+		res.Documents[idx] = searchDocument(item, categoryNameByID[item.document.CategoryID], chunks, passages[item.documentID])
+	}
+
+	return res, nil
+}
+
+// searchDocument converts a ranked document, its matched chunks and passages into the response format.
+func searchDocument(item documentSimilarity, categoryName string, chunks map[uint64]database.Embedding, passages []Passage) (document DocumentSearch) {
+	document = DocumentSearch{
+		DocumentUpload: DocumentUpload{
+			Name:       item.document.Name,
+			ExternalID: item.document.ExternalID,
+			Document:   item.document.Document.JSON(),
+		},
+		Category:           categoryName,
+		DocumentID:         item.documentID,
+		DocumentSimilarity: item.similarity,
+		AggregateScore:     item.aggregateScore,
+		KeywordScore:       item.keywordScore,
+		HybridScore:        item.hybridScore,
+		RerankScore:        item.rerankScore,
+		Score:              item.score,
+		Passages:           passages,
+	}
+	for _, chunk := range item.chunks {
+		document.Chunks = append(document.Chunks, ChunkMatch{
+			Index:      chunk.ordinal,
+			Text:       string(chunks[chunk.embeddingID].Text),
+			Similarity: chunk.similarity,
+		})
+	}
+	return document
+}
+
+// findCategories retrieves the existing categories of an owner, all categories of the owner are returned if all is set.
+// Categories that do not exist are skipped, gorm.ErrRecordNotFound is returned if the owner does not exist.
+func (s *Server) findCategories(ctx context.Context, ownerName string, categoryNames []string, all bool, explain *SearchExplain) (categories []database.Category, err error) {
+	// Get Owner
+	logger.Sugar().Debugf("retrieving owner: %s", ownerName)
+	start := time.Now()
+	fromDatabase := false
+	owner, err := s.cache.FetchOwner(ownerName, func() (owner database.Owner, err error) {
+		logger.Sugar().Debug("retrieve owner from database")
+		fromDatabase = true
+		return owner, s.db.WithContext(ctx).Clauses(dbresolver.Read).Where("name = ?", ownerName).Take(&owner).Error
+	})
+	explain.cache("owner", ownerName, fromDatabase, start)
+	if err == nil {
+		// owner found
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// owner request canceled
+		return nil, err
+	} else if errors.Is(err, gorm.ErrRecordNotFound) {
+		// owner not found
+		return nil, err
+	} else {
+		// owner retrieve error
+		return nil, errors.Join(errors.New("failed to get owner"), err)
+	}
+
+	// Get all Categories
+	if all {
+		logger.Sugar().Debug("retrieving all categories")
+		start = time.Now()
+		err = s.db.WithContext(ctx).Clauses(dbresolver.Read).Where("owner_id = ?", owner.ID).Order("id").Find(&categories).Error
+		explain.stage("categories", start)
+		if err == nil {
+			// categories found
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			// categories request canceled
+			return nil, err
+		} else {
+			// categories retrieve error
+			return nil, errors.Join(errors.New("failed to get categories"), err)
+		}
+		return categories, nil
+	}
+
+	// Get Categories
+	categories = make([]database.Category, 0, len(categoryNames))
+	seen := make(map[uint64]struct{}, len(categoryNames))
+	for _, categoryName := range categoryNames {
+		logger.Sugar().Debugf("retrieving category: %s", categoryName)
+		start = time.Now()
+		fromDatabase = false
+		category, err := s.cache.FetchCategory(categoryName, owner.ID, func() (category database.Category, err error) {
+			logger.Sugar().Debug("retrieve category from database")
+			fromDatabase = true
+			return category, s.db.WithContext(ctx).Clauses(dbresolver.Read).Where("name = ? AND owner_id = ?", categoryName, owner.ID).Take(&category).Error
+		})
+		explain.cache("category", categoryName, fromDatabase, start)
+		if err == nil {
+			// category found
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			// category request canceled
+			return nil, err
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			// category not found
 			continue
+		} else {
+			// category retrieve error
+			return nil, errors.Join(errors.New("failed to get category"), err)
 		}
-		addCount++
-		res.Documents[idx-skipCount] = DocumentSearch{
-			DocumentUpload: DocumentUpload{
-				Name:       item.document.Name,
-				ExternalID: item.document.ExternalID,
-				Document:   item.document.Document.JSON(),
-			},
-			DocumentID:         item.documentID,
-			DocumentSimilarity: item.similarity,
+		if _, ok := seen[category.ID]; ok {
+			continue
 		}
+		seen[category.ID] = struct{}{}
+		categories = append(categories, category)
 	}
-	res.Documents = res.Documents[:addCount]
-
-	return res, nil
+	return categories, nil
 }
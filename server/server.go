@@ -2,6 +2,8 @@ package server
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"sync/atomic"
 
 	"github.com/expki/go-vectorsearch/ai"
@@ -9,16 +11,22 @@ import (
 	"github.com/expki/go-vectorsearch/config"
 	"github.com/expki/go-vectorsearch/database"
 	_ "github.com/expki/go-vectorsearch/env"
+	"github.com/expki/go-vectorsearch/memindex"
 )
 
 var index atomic.Uint64
 
+// ErrInvalidRequest is joined to errors caused by the request content rather than the server.
+var ErrInvalidRequest = errors.New("invalid request")
+
 func New(appCtx context.Context, cfg config.Config, db *database.Database, ai ai.AI) *Server {
 	return &Server{
 		db:     db,
 		ai:     ai,
 		config: cfg,
 		cache:  cache.NewCache(appCtx),
+		memory: memindex.New(cfg.Index.GetBudget()),
+		graphs: newGraphIndex(cfg.Index.GetGraphBudget()),
 	}
 }
 
@@ -27,4 +35,8 @@ type Server struct {
 	ai     ai.AI
 	config config.Config
 	cache  *cache.Cache
+	memory *memindex.Index
+	graphs *graphIndex
+	// centroidVersions holds the index version of each category read before its cached centroids
+	centroidVersions sync.Map
 }
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -8,11 +9,13 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/expki/go-vectorsearch/ai/aicomms"
 	"github.com/expki/go-vectorsearch/compute"
+	"github.com/expki/go-vectorsearch/config"
 	"github.com/expki/go-vectorsearch/database"
 	_ "github.com/expki/go-vectorsearch/env"
 	"github.com/expki/go-vectorsearch/logger"
@@ -24,19 +27,36 @@ import (
 type UploadRequest struct {
 	Owner     string           `json:"owner"`
 	Category  string           `json:"category"`
+	Upsert    bool             `json:"upsert,omitempty"`
 	Documents []DocumentUpload `json:"documents"`
 }
 
 type DocumentUpload struct {
-	Name       string `json:"name,omitempty"`
-	ExternalID string `json:"external_id,omitempty"`
-	Document   any    `json:"document"`
+	Name         string        `json:"name,omitempty"`
+	ExternalID   string        `json:"external_id,omitempty"`
+	Document     any           `json:"document"`
+	Vector       []float32     `json:"vector,omitempty"`
+	ChunkVectors []ChunkVector `json:"chunk_vectors,omitempty"`
+}
+
+type ChunkVector struct {
+	Text   string    `json:"text,omitempty"`
+	Vector []float32 `json:"vector"`
 }
 
 type UploadResponse struct {
-	DocumentIDs []uint64 `json:"document_ids"`
+	DocumentIDs []uint64       `json:"document_ids"`
+	Statuses    []UploadStatus `json:"statuses"`
 }
 
+type UploadStatus string
+
+const (
+	UploadStatusCreated   UploadStatus = "created"
+	UploadStatusUpdated   UploadStatus = "updated"
+	UploadStatusUnchanged UploadStatus = "unchanged"
+)
+
 func (s *Server) UploadHttp(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	txid := index.Add(1)
@@ -84,6 +104,12 @@ func (s *Server) UploadHttp(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(499)
 		io.WriteString(w, `{"error":"Client canceled upload request"}`)
 		return
+	} else if errors.Is(err, ErrInvalidRequest) {
+		// upload request invalid
+		logger.Sugar().Debugf("%d upload request invalid: %s", txid, err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":"Invalid upload request"}`)
+		return
 	} else {
 		// upload failed
 		logger.Sugar().Errorf("%d upload request failed: %s", txid, err.Error())
@@ -108,49 +134,13 @@ func (s *Server) UploadHttp(w http.ResponseWriter, r *http.Request) {
 }
 
 // Upload calculates the embedding for the uploaded document then saves the document and embedding in the database.
+// In upsert mode documents are matched by external id within the category and only changed documents are re-embedded.
+// Documents carrying precomputed vectors are stored as provided without calling the embed provider.
 func (s *Server) Upload(ctx context.Context, req UploadRequest) (res UploadResponse, err error) {
 	if len(req.Documents) == 0 {
 		return res, errors.New("no documents provided")
 	}
 
-	// Generate embeddings
-	logger.Sugar().Debug("preparing documents")
-	embeddingCountPerDocumentList := make([]int, len(req.Documents))
-	embeddingInputList := make([]string, 0, len(req.Documents))
-	for idx, file := range req.Documents {
-		prefix := ""
-		if file.Name != "" {
-			prefix = strings.TrimSuffix(strings.TrimSpace(file.Name), ".") + ". "
-		}
-		document := Flatten(file.Document)
-		sections := Split(prefix, document, s.ai.EmbedCtxNum())
-		for idx, section := range sections {
-			sections[idx] = fmt.Sprintf("search_document: %s", section)
-		}
-		embeddingCountPerDocumentList[idx] = len(sections)
-		embeddingInputList = append(embeddingInputList, sections...)
-	}
-
-	// Get embeddings
-	logger.Sugar().Debug("generating embeddings")
-	embedRes, err := s.ai.Embed(ctx, aicomms.EmbedRequest{
-		Model: s.ai.EmbedModel(),
-		Input: embeddingInputList,
-	})
-	if err == nil {
-		// success
-	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
-		// request canceled
-		return res, err
-	} else {
-		// exception encountered
-		return res, errors.Join(errors.New("failed to embed documents"), err)
-	}
-	matrixEmbeddings := embedRes.Embeddings
-	if len(matrixEmbeddings) != len(embeddingInputList) {
-		return res, errors.New("invalid response embeddings count")
-	}
-
 	// Get Owner
 	logger.Sugar().Debug("retrieve owner from cache")
 	owner, err := s.cache.FetchOwner(req.Owner, func() (owner database.Owner, err error) {
@@ -206,18 +196,194 @@ func (s *Server) Upload(ctx context.Context, req UploadRequest) (res UploadRespo
 		// category retrieve error
 		return res, errors.Join(errors.New("failed to get category"), err)
 	}
+	calibrations, err := s.fetchCalibrations(ctx, category, nil)
+	if err != nil {
+		return res, err
+	}
+
+	// Prepare documents
+	logger.Sugar().Debug("preparing documents")
+	files := make([][]byte, len(req.Documents))
+	for idx, documentReq := range req.Documents {
+		files[idx], err = json.Marshal(documentReq.Document)
+		if err != nil {
+			return res, errors.Join(fmt.Errorf("failed to marshal document %d", idx), err)
+		}
+	}
+	supplied := make([]*documentChunks, len(req.Documents))
+	for idx, documentReq := range req.Documents {
+		supplied[idx], err = suppliedChunks(documentReq)
+		if err != nil {
+			return res, errors.Join(ErrInvalidRequest, fmt.Errorf("invalid vectors for document %d", idx), err)
+		}
+	}
+	res.DocumentIDs = make([]uint64, len(req.Documents))
+	res.Statuses = make([]UploadStatus, len(req.Documents))
+	for idx := range req.Documents {
+		res.Statuses[idx] = UploadStatusCreated
+	}
+
+	// Match existing documents
+	existingDocuments := make(map[int]database.Document)
+	var duplicateDocumentIDs []uint64
+	if req.Upsert {
+		logger.Sugar().Debug("matching existing documents")
+		existingDocuments, duplicateDocumentIDs, err = s.matchDocuments(ctx, category.ID, req.Documents)
+		if err == nil {
+			// documents matched
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			// documents request canceled
+			return res, err
+		} else {
+			// documents match error
+			return res, errors.Join(errors.New("failed to match existing documents"), err)
+		}
+		vectorChecks := make(map[uint64]*documentChunks)
+		for idx, existing := range existingDocuments {
+			res.DocumentIDs[idx] = existing.ID
+			if existing.Name == req.Documents[idx].Name && bytes.Equal(existing.Document, files[idx]) {
+				res.Statuses[idx] = UploadStatusUnchanged
+				if supplied[idx] != nil {
+					vectorChecks[existing.ID] = supplied[idx]
+				}
+			} else {
+				res.Statuses[idx] = UploadStatusUpdated
+			}
+		}
+
+		// Documents with supplied vectors are only unchanged if their stored chunks are too
+		if len(vectorChecks) > 0 {
+			logger.Sugar().Debug("comparing supplied vectors")
+			equal, err := s.storedChunksEqual(ctx, vectorChecks, calibrations)
+			if err == nil {
+				// vectors compared
+			} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+				// vectors request canceled
+				return res, err
+			} else {
+				// vectors compare error
+				return res, errors.Join(errors.New("failed to compare supplied vectors"), err)
+			}
+			for idx, existing := range existingDocuments {
+				if _, ok := vectorChecks[existing.ID]; ok && !equal[existing.ID] {
+					res.Statuses[idx] = UploadStatusUpdated
+				}
+			}
+		}
+	}
+
+	// Generate embeddings
+	embeddingCountPerDocumentList := make([]int, len(req.Documents))
+	embeddingInputList := make([]string, 0, len(req.Documents))
+	chunkTextList := make([]string, 0, len(req.Documents))
+	chunkVectorList := make(aicomms.Embeddings, 0, len(req.Documents))
+	for idx, file := range req.Documents {
+		if res.Statuses[idx] == UploadStatusUnchanged {
+			continue
+		}
+		if supplied[idx] != nil {
+			chunkTextList = append(chunkTextList, supplied[idx].texts...)
+			chunkVectorList = append(chunkVectorList, supplied[idx].vectors...)
+			embeddingCountPerDocumentList[idx] = len(supplied[idx].vectors)
+			continue
+		}
+		prefix := ""
+		if file.Name != "" {
+			prefix = strings.TrimSuffix(strings.TrimSpace(file.Name), ".") + ". "
+		}
+		document := Flatten(file.Document)
+		sections := Split(prefix, document, s.ai.EmbedCtxNum())
+		for idx, section := range sections {
+			chunkTextList = append(chunkTextList, strings.TrimSpace(strings.TrimPrefix(section, prefix)))
+			chunkVectorList = append(chunkVectorList, nil)
+			sections[idx] = fmt.Sprintf("search_document: %s", section)
+		}
+		embeddingCountPerDocumentList[idx] = len(sections)
+		embeddingInputList = append(embeddingInputList, sections...)
+	}
+	if len(chunkTextList) == 0 {
+		logger.Sugar().Debug("all documents unchanged")
+		if len(duplicateDocumentIDs) == 0 {
+			return res, nil
+		}
+		var version uint64
+		err = s.db.WithContext(ctx).Clauses(dbresolver.Write).Transaction(func(tx *gorm.DB) (err error) {
+			err = removeDuplicates(tx, category.ID, duplicateDocumentIDs)
+			if err != nil {
+				return err
+			}
+			version, err = bumpIndexVersion(tx, category.ID)
+			return err
+		})
+		if err == nil {
+			// duplicates removed
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			// duplicates request canceled
+			return res, err
+		} else {
+			// duplicates delete error
+			return res, errors.Join(errors.New("failed to save upload"), err)
+		}
+		s.memory.RemoveDocuments(category.ID, version, duplicateDocumentIDs)
+		if category.IndexType == database.IndexTypeHNSW {
+			s.linkGraph(ctx, category, duplicateDocumentIDs, nil)
+		}
+		return res, nil
+	}
+
+	// Get embeddings
+	if len(embeddingInputList) > 0 {
+		logger.Sugar().Debug("generating embeddings")
+		embedRes, err := s.ai.Embed(ctx, aicomms.EmbedRequest{
+			Model: s.ai.EmbedModel(),
+			Input: embeddingInputList,
+		})
+		if err == nil {
+			// success
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			// request canceled
+			return res, err
+		} else {
+			// exception encountered
+			return res, errors.Join(errors.New("failed to embed documents"), err)
+		}
+		if len(embedRes.Embeddings) != len(embeddingInputList) {
+			return res, errors.New("invalid response embeddings count")
+		}
+		embedded := embedRes.Embeddings
+		for idx, vector := range chunkVectorList {
+			if vector == nil {
+				chunkVectorList[idx] = embedded[0]
+				embedded = embedded[1:]
+			}
+		}
+	}
+	matrixEmbeddings := chunkVectorList
+	for _, vector := range matrixEmbeddings {
+		if len(vector) != len(matrixEmbeddings[0]) {
+			return res, errors.Join(ErrInvalidRequest, errors.New("vector dimensions do not match"))
+		}
+	}
 
 	// Get Centroids
 	logger.Sugar().Debug("retrieve centroids from cache")
 	centroids, err := s.cache.FetchCentroids(category.ID, func() (centroids []database.Centroid, err error) {
 		logger.Sugar().Debug("retrieve centroids from database")
+		version, err := s.indexVersion(ctx, category)
+		if err != nil {
+			return nil, err
+		}
 		err = s.db.WithContext(ctx).Clauses(dbresolver.Read).Where("category_id = ?", category.ID).Find(&centroids).Error
+		if err == nil {
+			s.centroidVersions.Store(category.ID, version)
+		}
 		if err == nil && len(centroids) == 0 {
 			// centroid create
 			centroids = append(centroids, database.Centroid{
-				Vector:     matrixEmbeddings[0].Value(),
-				CategoryID: category.ID,
-				Category:   &category,
+				Vector:        matrixEmbeddings[0].Value(),
+				MinSimilarity: 1,
+				CategoryID:    category.ID,
+				Category:      &category,
 			})
 			err = s.db.WithContext(ctx).Clauses(dbresolver.Write).Omit(clause.Associations).Create(&centroids).Error
 			if err != nil {
@@ -235,6 +401,9 @@ func (s *Server) Upload(ctx context.Context, req UploadRequest) (res UploadRespo
 		// centroids retrieve error
 		return res, errors.Join(errors.New("failed to get centroids"), err)
 	}
+	if len(centroids[0].Vector)-8 != matrixEmbeddings[0].Dims() {
+		return res, errors.Join(ErrInvalidRequest, fmt.Errorf("vector dimensions %d do not match category dimensions %d", matrixEmbeddings[0].Dims(), len(centroids[0].Vector)-8))
+	}
 
 	// Assign Embeddings to Centroids
 	logger.Sugar().Debug("calculating nearest centroid")
@@ -242,82 +411,408 @@ func (s *Server) Upload(ctx context.Context, req UploadRequest) (res UploadRespo
 	for idx, centroid := range centroids {
 		matrixCentroids[idx] = centroid.Vector
 	}
-	_, centroidIdxList := compute.NewMatrix(matrixCentroids).Clone().MatrixCosineSimilarity(compute.NewMatrix(matrixEmbeddings.Value()).Clone())
+	centroidMatrix, err := compute.NewMatrix(matrixCentroids)
+	if err != nil {
+		return res, errors.Join(errors.New("failed to decode centroids"), err)
+	}
+	embeddingMatrix, err := compute.NewMatrix(matrixEmbeddings.Value())
+	if err != nil {
+		return res, errors.Join(ErrInvalidRequest, err)
+	}
+	_, centroidIdxList := centroidMatrix.Clone().MatrixCosineSimilarity(embeddingMatrix.Clone())
+	centroidMinSimilarity, err := assignedMinSimilarity(centroids, centroidIdxList, matrixEmbeddings.Value())
+	if err != nil {
+		return res, errors.Join(errors.New("failed to decode centroids"), err)
+	}
 
 	// Create documents
 	logger.Sugar().Debug("creating documents")
-	newDocuments := make([]*database.Document, len(req.Documents))
+	newDocuments := make([]*database.Document, 0, len(req.Documents))
+	updatedDocuments := make([]*database.Document, 0, len(existingDocuments))
 	newEmbeddings := make([]*database.Embedding, 0, len(req.Documents))
+	newVectors := make([][]float32, 0, len(req.Documents))
+	documentIdxList := make([]int, 0, len(req.Documents))
 	for idx, documentReq := range req.Documents {
+		if res.Statuses[idx] == UploadStatusUnchanged {
+			continue
+		}
+
 		// create document
-		file, _ := json.Marshal(req.Documents[idx].Document)
+		keywords, length := buildKeywords(documentReq.Name, database.DocumentField(files[idx]).JSON())
 		document := &database.Document{
+			ID:          res.DocumentIDs[idx],
 			Name:        documentReq.Name,
 			ExternalID:  documentReq.ExternalID,
 			LastUpdated: time.Now(),
-			Document:    file,
+			Document:    files[idx],
+			Length:      length,
 			CategoryID:  category.ID,
 			Category:    &category,
+			Keywords:    keywords,
 		}
 
 		// create embeddings
 		newDocumentEmbeddings := make([]*database.Embedding, 0, embeddingCountPerDocumentList[idx])
-		for range embeddingCountPerDocumentList[idx] {
+		for ordinal := range embeddingCountPerDocumentList[idx] {
 			vector := matrixEmbeddings[0]
 			matrixEmbeddings = matrixEmbeddings[1:]
+			text := chunkTextList[0]
+			chunkTextList = chunkTextList[1:]
 			centroidIdx := centroidIdxList[0]
 			centroidIdxList = centroidIdxList[1:]
 			centroid := centroids[centroidIdx]
 			embedding := &database.Embedding{
-				Vector:     vector.Value(),
+				Ordinal:    uint32(ordinal),
+				Text:       database.TextField(text),
 				CentroidID: centroid.ID,
 				Centroid:   &centroid,
 				Document:   document,
 			}
 			newEmbeddings = append(newEmbeddings, embedding)
+			newVectors = append(newVectors, vector)
 			newDocumentEmbeddings = append(newDocumentEmbeddings, embedding)
 		}
 
 		// save
 		document.Embeddings = newDocumentEmbeddings
-		newDocuments[idx] = document
+		if res.Statuses[idx] == UploadStatusUpdated {
+			updatedDocuments = append(updatedDocuments, document)
+		} else {
+			newDocuments = append(newDocuments, document)
+			documentIdxList = append(documentIdxList, idx)
+		}
+	}
+
+	// Encode embeddings
+	err = s.quantizeEmbeddings(ctx, category, calibrations, newEmbeddings, newVectors)
+	if err == nil {
+		// embeddings quantized
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// calibration request canceled
+		return res, err
+	} else {
+		// calibration retrieve error
+		return res, errors.Join(errors.New("failed to quantize embeddings"), err)
+	}
+	err = s.encodeEmbeddings(ctx, category, newEmbeddings, newVectors)
+	if err == nil {
+		// embeddings encoded
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// codebook request canceled
+		return res, err
+	} else {
+		// codebook retrieve error
+		return res, errors.Join(errors.New("failed to encode embeddings"), err)
 	}
+	encodeBits(category, newEmbeddings, newVectors)
 
-	// Save Documents
+	// Save documents with their embeddings, keywords and attributes
+	// updated documents are never left without embeddings when a later insert fails
 	logger.Sugar().Debug("saving documents")
-	err = s.db.WithContext(ctx).Clauses(dbresolver.Write).Omit(clause.Associations).Create(&newDocuments).Error
+	var version uint64
+	widened := false
+	err = s.db.WithContext(ctx).Clauses(dbresolver.Write).Transaction(func(tx *gorm.DB) (err error) {
+		err = removeDuplicates(tx, category.ID, duplicateDocumentIDs)
+		if err != nil {
+			return err
+		}
+		if len(newDocuments) > 0 {
+			err = tx.Omit(clause.Associations).Create(&newDocuments).Error
+			if err != nil {
+				return errors.Join(errors.New("failed to save documents"), err)
+			}
+		}
+		for _, document := range updatedDocuments {
+			err := tx.Model(document).Select("name", "document", "length", "last_updated").Updates(document).Error
+			if err != nil {
+				return errors.Join(errors.New("failed to update documents"), err)
+			}
+			err = tx.Where("document_id = ?", document.ID).Delete(&database.Embedding{}).Error
+			if err != nil {
+				return errors.Join(errors.New("failed to remove document embeddings"), err)
+			}
+			err = tx.Where("document_id = ?", document.ID).Delete(&database.Attribute{}).Error
+			if err != nil {
+				return errors.Join(errors.New("failed to remove document attributes"), err)
+			}
+			err = tx.Where("document_id = ?", document.ID).Delete(&database.Keyword{}).Error
+			if err != nil {
+				return errors.Join(errors.New("failed to remove document keywords"), err)
+			}
+		}
+
+		// Save Embeddings
+		logger.Sugar().Debug("saving embeddings")
+		for _, embedding := range newEmbeddings {
+			embedding.DocumentID = embedding.Document.ID
+		}
+		err = tx.Omit(clause.Associations).Create(&newEmbeddings).Error
+		if err != nil {
+			return errors.Join(errors.New("failed to save embeddings"), err)
+		}
+
+		// Save Keywords
+		logger.Sugar().Debug("saving keywords")
+		newKeywords := make([]*database.Keyword, 0, len(req.Documents))
+		for _, document := range slices.Concat(newDocuments, updatedDocuments) {
+			for _, keyword := range document.Keywords {
+				keyword.CategoryID = category.ID
+				keyword.DocumentID = document.ID
+				newKeywords = append(newKeywords, keyword)
+			}
+		}
+		if len(newKeywords) > 0 {
+			err = tx.Omit(clause.Associations).CreateInBatches(&newKeywords, config.BATCH_SIZE_DATABASE).Error
+			if err != nil {
+				return errors.Join(errors.New("failed to save keywords"), err)
+			}
+		}
+
+		// Save Attributes
+		// the cached fields may predate a field change of another server
+		fields, err := indexedFields(tx, s.db.Provider, category.ID)
+		if err != nil {
+			return err
+		}
+		if len(fields) > 0 {
+			logger.Sugar().Debug("saving attributes")
+			newAttributes := make([]*database.Attribute, 0, len(req.Documents))
+			for _, document := range slices.Concat(newDocuments, updatedDocuments) {
+				for _, attribute := range buildAttributes(document.Document.JSON(), fields) {
+					attribute.DocumentID = document.ID
+					newAttributes = append(newAttributes, attribute)
+				}
+			}
+			if len(newAttributes) > 0 {
+				err = tx.Omit(clause.Associations).Create(&newAttributes).Error
+				if err != nil {
+					return errors.Join(errors.New("failed to save attributes"), err)
+				}
+			}
+		}
+
+		// Widen centroid radius to cover the new embeddings
+		logger.Sugar().Debug("updating centroid radius")
+		for centroidIdx, minSimilarity := range centroidMinSimilarity {
+			if minSimilarity >= centroids[centroidIdx].MinSimilarity {
+				continue
+			}
+			widened = true
+			err = tx.Model(&database.Centroid{}).
+				Where("id = ?", centroids[centroidIdx].ID).
+				Update("min_similarity", gorm.Expr("CASE WHEN min_similarity > ? THEN ? ELSE min_similarity END", minSimilarity, minSimilarity)).
+				Error
+			if err != nil {
+				return errors.Join(errors.New("failed to update centroid radius"), err)
+			}
+		}
+
+		// other processes load their in-memory index again
+		version, err = bumpIndexVersion(tx, category.ID)
+		return err
+	})
 	if err == nil {
-		// documents created
+		// documents saved
 	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
 		// documents request canceled
 		return res, err
 	} else {
 		// documents save error
-		return res, errors.Join(errors.New("failed to save documents"), err)
+		return res, errors.Join(errors.New("failed to save upload"), err)
+	}
+	if widened {
+		// searches of this process prune centroids by the widened radius right away
+		s.cache.InvalidateCentroids(category.ID)
+	}
+	for idx, document := range newDocuments {
+		res.DocumentIDs[documentIdxList[idx]] = document.ID
 	}
-	for _, embedding := range newEmbeddings {
-		embedding.DocumentID = embedding.Document.ID
+	updatedDocumentIDs := make([]uint64, len(updatedDocuments))
+	for idx, document := range updatedDocuments {
+		updatedDocumentIDs[idx] = document.ID
 	}
+	removedDocumentIDs := append(duplicateDocumentIDs, updatedDocumentIDs...)
+	if len(removedDocumentIDs) > 0 {
+		s.memory.RemoveDocuments(category.ID, version, removedDocumentIDs)
+	}
+	if s.memory != nil {
+		residentEmbeddings := make([]database.Embedding, len(newEmbeddings))
+		for idx, embedding := range newEmbeddings {
+			residentEmbeddings[idx] = *embedding
+		}
+		s.memory.Add(category.ID, version, residentEmbeddings, calibrations)
+	}
+	if category.IndexType == database.IndexTypeHNSW {
+		s.linkGraph(ctx, category, removedDocumentIDs, newEmbeddings)
+	}
+
+	return res, nil
+}
 
-	// Save Embeddings
-	logger.Sugar().Debug("saving embeddings")
-	err = s.db.WithContext(ctx).Clauses(dbresolver.Write).Omit(clause.Associations).Create(&newEmbeddings).Error
+// removeDuplicates deletes the duplicate documents left behind by previous uploads within the save transaction.
+func removeDuplicates(tx *gorm.DB, categoryID uint64, duplicateDocumentIDs []uint64) error {
+	if len(duplicateDocumentIDs) == 0 {
+		return nil
+	}
+	logger.Sugar().Debugf("removing duplicate documents: %d", len(duplicateDocumentIDs))
+	err := tx.Where("category_id = ?", categoryID).Delete(&database.Document{}, duplicateDocumentIDs).Error
+	if err != nil {
+		return errors.Join(errors.New("failed to remove duplicate documents"), err)
+	}
+	return nil
+}
+
+// linkGraph unlinks the removed documents from the graph and links the new embeddings after the upload is saved.
+// A failure is only logged as the upload is already saved, the next centroid refresh links the embeddings left out.
+func (s *Server) linkGraph(ctx context.Context, category database.Category, removedDocumentIDs []uint64, embeddings []*database.Embedding) {
+	logger.Sugar().Debug("linking embeddings into graph")
+	err := s.removeGraph(ctx, category, removedDocumentIDs)
+	if err == nil && len(embeddings) > 0 {
+		err = s.insertGraph(ctx, category, embeddings)
+	}
 	if err == nil {
-		// embeddings created
+		// graph updated
+	} else if errors.Is(err, errGraphOverBudget) {
+		// graph does not fit in memory
+		logger.Sugar().Warnf("graph of category %d exceeds graph memory budget, embeddings are not linked", category.ID)
 	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
-		// embeddings request canceled
-		return res, err
+		// graph request canceled
+		logger.Sugar().Warnf("graph update of category %d canceled, refresh links the embeddings: %v", category.ID, err)
 	} else {
-		// embeddings save error
-		return res, errors.Join(errors.New("failed to save embeddings"), err)
+		// graph update error
+		logger.Sugar().Errorf("graph update of category %d failed, refresh links the embeddings: %v", category.ID, err)
 	}
+}
 
-	// Create response
-	logger.Sugar().Debug("creating response")
-	res.DocumentIDs = make([]uint64, len(newDocuments))
-	for idx, document := range newDocuments {
-		res.DocumentIDs[idx] = document.ID
+// matchDocuments finds the stored documents sharing an external id with the uploaded documents.
+// The oldest stored document is matched, any newer documents with the same external id are returned as duplicates.
+func (s *Server) matchDocuments(ctx context.Context, categoryID uint64, documents []DocumentUpload) (matched map[int]database.Document, duplicateIDs []uint64, err error) {
+	requestIdx := make(map[string]int, len(documents))
+	externalIDs := make([]string, 0, len(documents))
+	for idx, document := range documents {
+		if document.ExternalID == "" {
+			continue
+		}
+		if _, ok := requestIdx[document.ExternalID]; ok {
+			return nil, nil, errors.Join(ErrInvalidRequest, fmt.Errorf("duplicate external id in upsert request: %s", document.ExternalID))
+		}
+		requestIdx[document.ExternalID] = idx
+		externalIDs = append(externalIDs, document.ExternalID)
+	}
+	matched = make(map[int]database.Document, len(externalIDs))
+	for batch := range slices.Chunk(externalIDs, config.BATCH_SIZE_DATABASE) {
+		var existing []database.Document
+		err = s.db.WithContext(ctx).Clauses(dbresolver.Read).
+			Where("category_id = ? AND external_id IN ?", categoryID, batch).
+			Order("id").
+			Find(&existing).
+			Error
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, document := range existing {
+			idx := requestIdx[document.ExternalID]
+			if _, ok := matched[idx]; ok {
+				duplicateIDs = append(duplicateIDs, document.ID)
+				continue
+			}
+			matched[idx] = document
+		}
 	}
+	return matched, duplicateIDs, nil
+}
 
-	return res, nil
+// assignedMinSimilarity returns the lowest similarity of the assigned vectors to each centroid.
+func assignedMinSimilarity(centroids []database.Centroid, centroidIdxList []int, vectors [][]uint8) (minSimilarity map[int]float32, err error) {
+	groups := make(map[int][][]uint8, len(centroids))
+	for idx, centroidIdx := range centroidIdxList {
+		groups[centroidIdx] = append(groups[centroidIdx], vectors[idx])
+	}
+	minSimilarity = make(map[int]float32, len(groups))
+	for centroidIdx, group := range groups {
+		centroid, err := compute.NewVector(centroids[centroidIdx].Vector)
+		if err != nil {
+			return nil, err
+		}
+		matrix, err := compute.NewMatrix(group)
+		if err != nil {
+			return nil, err
+		}
+		minSimilarity[centroidIdx] = slices.Min(centroid.MatrixCosineSimilarity(matrix))
+	}
+	return minSimilarity, nil
+}
+
+type documentChunks struct {
+	vectors []aicomms.Embedding
+	texts   []string
+}
+
+// suppliedChunks collects the precomputed vectors of a document, nil is returned if the document has none.
+func suppliedChunks(document DocumentUpload) (chunks *documentChunks, err error) {
+	if document.Vector == nil && document.ChunkVectors == nil {
+		return nil, nil
+	}
+	if document.Vector != nil && document.ChunkVectors != nil {
+		return nil, errors.New("vector and chunk vectors are mutually exclusive")
+	}
+	chunks = &documentChunks{}
+	if document.Vector != nil {
+		if len(document.Vector) == 0 {
+			return nil, errors.New("vector is empty")
+		}
+		chunks.vectors = append(chunks.vectors, document.Vector)
+		chunks.texts = append(chunks.texts, strings.TrimSpace(Flatten(document.Document)))
+		return chunks, nil
+	}
+	for idx, chunk := range document.ChunkVectors {
+		if len(chunk.Vector) == 0 {
+			return nil, fmt.Errorf("chunk vector %d is empty", idx)
+		}
+		chunks.vectors = append(chunks.vectors, chunk.Vector)
+		chunks.texts = append(chunks.texts, chunk.Text)
+	}
+	if len(chunks.vectors) == 0 {
+		return nil, errors.New("chunk vectors are empty")
+	}
+	return chunks, nil
+}
+
+// storedChunksEqual reports for each document whether its stored embeddings equal the supplied chunks.
+// Supplied vectors are quantized with the encoding of the stored vector they are compared with,
+// vectors the centroid refresh migrated to another encoding were quantized twice and are rewritten once from the supplied vector.
+func (s *Server) storedChunksEqual(ctx context.Context, documents map[uint64]*documentChunks, calibrations compute.Calibrations) (equal map[uint64]bool, err error) {
+	documentIDs := make([]uint64, 0, len(documents))
+	for documentID := range documents {
+		documentIDs = append(documentIDs, documentID)
+	}
+	stored := make(map[uint64][]database.Embedding, len(documents))
+	for batch := range slices.Chunk(documentIDs, config.BATCH_SIZE_DATABASE) {
+		var embeddings []database.Embedding
+		err = s.db.WithContext(ctx).Clauses(dbresolver.Read).
+			Select("document_id", "ordinal", "vector", "text").
+			Where("document_id IN ?", batch).
+			Order("ordinal").
+			Find(&embeddings).
+			Error
+		if err != nil {
+			return nil, err
+		}
+		for _, embedding := range embeddings {
+			stored[embedding.DocumentID] = append(stored[embedding.DocumentID], embedding)
+		}
+	}
+	equal = make(map[uint64]bool, len(documents))
+	for documentID, chunks := range documents {
+		embeddings := stored[documentID]
+		equal[documentID] = len(embeddings) == len(chunks.vectors)
+		for idx := 0; equal[documentID] && idx < len(embeddings); idx++ {
+			vector, err := quantizeLike(embeddings[idx].Vector, chunks.vectors[idx], calibrations)
+			if err != nil {
+				return nil, err
+			}
+			equal[documentID] = bytes.Equal(embeddings[idx].Vector, vector) && string(embeddings[idx].Text) == chunks.texts[idx]
+		}
+	}
+	return equal, nil
 }